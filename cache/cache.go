@@ -0,0 +1,272 @@
+package cache
+
+import (
+	"container/heap"
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// keyPrefix namespaces the keys stored in a shared backend
+const keyPrefix = "uppmax-integration:"
+
+// globEscaper escapes the characters that have a special meaning in redis
+// key patterns
+var globEscaper = strings.NewReplacer(`\`, `\\`, "*", `\*`, "?", `\?`, "[", `\[`, "]", `\]`)
+
+// Store describes a key/value store with per-entry expiry, used for caching
+// the results of the upstream lookups
+type Store interface {
+	// Get returns the value stored under key and whether it was found
+	Get(ctx context.Context, key string) (string, bool, error)
+	// Take removes the entry stored under key and returns its value and
+	// whether it was found. Of concurrent calls for a key only one finds it.
+	Take(ctx context.Context, key string) (string, bool, error)
+	// Set stores value under key for the duration of ttl
+	Set(ctx context.Context, key, value string, ttl time.Duration) error
+	// Delete removes the entry stored under key
+	Delete(ctx context.Context, key string) error
+	// Flush removes all entries whose key starts with prefix
+	Flush(ctx context.Context, prefix string) error
+}
+
+// New returns the store described by storeType, which is one of "memory",
+// "redis" or "none". A nil store is returned for "none".
+func New(storeType, redisAddr, redisPassword string, redisDB int) (Store, error) {
+	switch storeType {
+	case "", "memory":
+		return NewMemoryStore(), nil
+	case "redis":
+		return NewRedisStore(redis.NewClient(&redis.Options{
+			Addr:     redisAddr,
+			Password: redisPassword,
+			DB:       redisDB,
+		})), nil
+	case "none":
+		return nil, nil
+	default:
+		return nil, fmt.Errorf("unknown cache type %s", storeType)
+	}
+}
+
+// memoryMaxEntries bounds the number of entries held by the store returned by
+// NewMemoryStore, the entries closest to expiry are evicted to make room for
+// new ones
+const memoryMaxEntries = 100000
+
+type memoryEntry struct {
+	key     string
+	value   string
+	expires time.Time
+	// index is the position of the entry in the expiry heap
+	index int
+}
+
+// expiryHeap orders the entries of a MemoryStore by expiry, implementing
+// heap.Interface
+type expiryHeap []*memoryEntry
+
+func (h expiryHeap) Len() int           { return len(h) }
+func (h expiryHeap) Less(i, j int) bool { return h[i].expires.Before(h[j].expires) }
+func (h expiryHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+
+func (h *expiryHeap) Push(x any) {
+	entry := x.(*memoryEntry)
+	entry.index = len(*h)
+	*h = append(*h, entry)
+}
+
+func (h *expiryHeap) Pop() any {
+	old := *h
+	entry := old[len(old)-1]
+	old[len(old)-1] = nil
+	*h = old[:len(old)-1]
+
+	return entry
+}
+
+// MemoryStore is an in-process Store. Expired entries are dropped by Get and
+// by Set, and a bounded store evicts the entries closest to expiry when full.
+// The entries are kept in a heap ordered by expiry, so that both take
+// logarithmic time.
+type MemoryStore struct {
+	mu         sync.Mutex
+	entries    map[string]*memoryEntry
+	expiry     expiryHeap
+	maxEntries int
+}
+
+// NewMemoryStore returns an empty in-process store holding at most
+// memoryMaxEntries entries, suitable for caching lookups
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{entries: make(map[string]*memoryEntry), maxEntries: memoryMaxEntries}
+}
+
+// NewUnboundedMemoryStore returns an empty in-process store that never evicts
+// entries before they expire, suitable for data that cannot be recomputed
+// such as refresh tokens
+func NewUnboundedMemoryStore() *MemoryStore {
+	return &MemoryStore{entries: make(map[string]*memoryEntry)}
+}
+
+// Get implements Store
+func (m *MemoryStore) Get(_ context.Context, key string) (string, bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	entry, ok := m.entries[key]
+	if !ok {
+		return "", false, nil
+	}
+	if time.Now().After(entry.expires) {
+		m.remove(entry)
+
+		return "", false, nil
+	}
+
+	return entry.value, true, nil
+}
+
+// Take implements Store
+func (m *MemoryStore) Take(_ context.Context, key string) (string, bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	entry, ok := m.entries[key]
+	if !ok {
+		return "", false, nil
+	}
+	m.remove(entry)
+	if time.Now().After(entry.expires) {
+		return "", false, nil
+	}
+
+	return entry.value, true, nil
+}
+
+// Set implements Store
+func (m *MemoryStore) Set(_ context.Context, key, value string, ttl time.Duration) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := time.Now()
+	if entry, exists := m.entries[key]; exists {
+		entry.value, entry.expires = value, now.Add(ttl)
+		heap.Fix(&m.expiry, entry.index)
+
+		return nil
+	}
+
+	// drop the expired entries, then the ones closest to expiry if full
+	for len(m.expiry) > 0 && now.After(m.expiry[0].expires) {
+		m.remove(m.expiry[0])
+	}
+	if m.maxEntries > 0 && len(m.entries) >= m.maxEntries {
+		m.remove(m.expiry[0])
+	}
+	entry := &memoryEntry{key: key, value: value, expires: now.Add(ttl)}
+	m.entries[key] = entry
+	heap.Push(&m.expiry, entry)
+
+	return nil
+}
+
+// remove drops entry from the store, the caller must hold the lock
+func (m *MemoryStore) remove(entry *memoryEntry) {
+	heap.Remove(&m.expiry, entry.index)
+	delete(m.entries, entry.key)
+}
+
+// Delete implements Store
+func (m *MemoryStore) Delete(_ context.Context, key string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if entry, ok := m.entries[key]; ok {
+		m.remove(entry)
+	}
+
+	return nil
+}
+
+// Flush implements Store
+func (m *MemoryStore) Flush(_ context.Context, prefix string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for key, entry := range m.entries {
+		if strings.HasPrefix(key, prefix) {
+			m.remove(entry)
+		}
+	}
+
+	return nil
+}
+
+// RedisStore is a Store backed by a Redis compatible server, which allows
+// several replicas of the service to share the cached lookups
+type RedisStore struct {
+	client *redis.Client
+}
+
+// NewRedisStore returns a store using the given redis client
+func NewRedisStore(client *redis.Client) *RedisStore {
+	return &RedisStore{client: client}
+}
+
+// Get implements Store
+func (r *RedisStore) Get(ctx context.Context, key string) (string, bool, error) {
+	value, err := r.client.Get(ctx, keyPrefix+key).Result()
+	if err == redis.Nil {
+		return "", false, nil
+	}
+	if err != nil {
+		return "", false, err
+	}
+
+	return value, true, nil
+}
+
+// Take implements Store
+func (r *RedisStore) Take(ctx context.Context, key string) (string, bool, error) {
+	value, err := r.client.GetDel(ctx, keyPrefix+key).Result()
+	if err == redis.Nil {
+		return "", false, nil
+	}
+	if err != nil {
+		return "", false, err
+	}
+
+	return value, true, nil
+}
+
+// Set implements Store
+func (r *RedisStore) Set(ctx context.Context, key, value string, ttl time.Duration) error {
+	return r.client.Set(ctx, keyPrefix+key, value, ttl).Err()
+}
+
+// Delete implements Store
+func (r *RedisStore) Delete(ctx context.Context, key string) error {
+	return r.client.Del(ctx, keyPrefix+key).Err()
+}
+
+// Flush implements Store
+func (r *RedisStore) Flush(ctx context.Context, prefix string) error {
+	pattern := globEscaper.Replace(keyPrefix+prefix) + "*"
+	iter := r.client.Scan(ctx, 0, pattern, 100).Iterator()
+	for iter.Next(ctx) {
+		if err := r.client.Del(ctx, iter.Val()).Err(); err != nil {
+			return err
+		}
+	}
+
+	return iter.Err()
+}
@@ -0,0 +1,176 @@
+package cache
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/suite"
+)
+
+type TestSuite struct {
+	suite.Suite
+	Redis *miniredis.Miniredis
+}
+
+func TestCacheTestSuite(t *testing.T) {
+	suite.Run(t, new(TestSuite))
+}
+
+func (suite *TestSuite) SetupTest() {
+	suite.Redis = miniredis.RunT(suite.T())
+}
+
+func (suite *TestSuite) stores() map[string]Store {
+	return map[string]Store{
+		"memory": NewMemoryStore(),
+		"redis":  NewRedisStore(redis.NewClient(&redis.Options{Addr: suite.Redis.Addr()})),
+	}
+}
+
+func (suite *TestSuite) TestNew() {
+	store, err := New("memory", "", "", 0)
+	assert.NoError(suite.T(), err)
+	assert.IsType(suite.T(), &MemoryStore{}, store)
+
+	store, err = New("redis", suite.Redis.Addr(), "", 0)
+	assert.NoError(suite.T(), err)
+	assert.IsType(suite.T(), &RedisStore{}, store)
+
+	store, err = New("none", "", "", 0)
+	assert.NoError(suite.T(), err)
+	assert.Nil(suite.T(), store)
+
+	_, err = New("memcached", "", "", 0)
+	assert.EqualError(suite.T(), err, "unknown cache type memcached")
+}
+
+func (suite *TestSuite) TestSetGetDelete() {
+	ctx := context.Background()
+	for name, store := range suite.stores() {
+		_, found, err := store.Get(ctx, "ega:someuser")
+		assert.NoError(suite.T(), err, name)
+		assert.False(suite.T(), found, name)
+
+		assert.NoError(suite.T(), store.Set(ctx, "ega:someuser", "allowed", time.Minute), name)
+		value, found, err := store.Get(ctx, "ega:someuser")
+		assert.NoError(suite.T(), err, name)
+		assert.True(suite.T(), found, name)
+		assert.Equal(suite.T(), "allowed", value, name)
+
+		assert.NoError(suite.T(), store.Delete(ctx, "ega:someuser"), name)
+		_, found, _ = store.Get(ctx, "ega:someuser")
+		assert.False(suite.T(), found, name)
+	}
+}
+
+func (suite *TestSuite) TestTake() {
+	ctx := context.Background()
+	for name, store := range suite.stores() {
+		assert.NoError(suite.T(), store.Set(ctx, "refresh:hash", "grant", time.Minute), name)
+
+		// Only one of concurrent calls gets the value
+		found := make(chan bool, 10)
+		for i := 0; i < cap(found); i++ {
+			go func() {
+				_, ok, err := store.Take(ctx, "refresh:hash")
+				assert.NoError(suite.T(), err, name)
+				found <- ok
+			}()
+		}
+		taken := 0
+		for i := 0; i < cap(found); i++ {
+			if <-found {
+				taken++
+			}
+		}
+		assert.Equal(suite.T(), 1, taken, name)
+
+		_, ok, err := store.Get(ctx, "refresh:hash")
+		assert.NoError(suite.T(), err, name)
+		assert.False(suite.T(), ok, name)
+	}
+
+	memory := NewMemoryStore()
+	assert.NoError(suite.T(), memory.Set(ctx, "key", "value", -time.Second))
+	_, found, _ := memory.Take(ctx, "key")
+	assert.False(suite.T(), found)
+	assert.Empty(suite.T(), memory.entries)
+}
+
+func (suite *TestSuite) TestExpiry() {
+	ctx := context.Background()
+
+	memory := NewMemoryStore()
+	assert.NoError(suite.T(), memory.Set(ctx, "key", "value", -time.Second))
+	_, found, _ := memory.Get(ctx, "key")
+	assert.False(suite.T(), found)
+
+	store := NewRedisStore(redis.NewClient(&redis.Options{Addr: suite.Redis.Addr()}))
+	assert.NoError(suite.T(), store.Set(ctx, "key", "value", time.Minute))
+	suite.Redis.FastForward(2 * time.Minute)
+	_, found, _ = store.Get(ctx, "key")
+	assert.False(suite.T(), found)
+}
+
+func (suite *TestSuite) TestFlush() {
+	ctx := context.Background()
+	for name, store := range suite.stores() {
+		for _, key := range []string{"supr:some*user:p1", "supr:some*user:p2", "supr:someuser:p1", "ega:some*user"} {
+			assert.NoError(suite.T(), store.Set(ctx, key, "allowed", time.Minute), name)
+		}
+
+		assert.NoError(suite.T(), store.Flush(ctx, "supr:some*user:"), name)
+		_, found, _ := store.Get(ctx, "supr:some*user:p1")
+		assert.False(suite.T(), found, name)
+		_, found, _ = store.Get(ctx, "supr:some*user:p2")
+		assert.False(suite.T(), found, name)
+		_, found, _ = store.Get(ctx, "supr:someuser:p1")
+		assert.True(suite.T(), found, name)
+
+		assert.NoError(suite.T(), store.Flush(ctx, ""), name)
+		_, found, _ = store.Get(ctx, "ega:some*user")
+		assert.False(suite.T(), found, name)
+	}
+}
+
+// TestMemoryBounds checks that the memory store drops expired entries without
+// them being read and evicts the entries closest to expiry when full, unless
+// it is unbounded
+func (suite *TestSuite) TestMemoryBounds() {
+	ctx := context.Background()
+
+	memory := NewMemoryStore()
+	assert.NoError(suite.T(), memory.Set(ctx, "expired", "value", -time.Second))
+	assert.NoError(suite.T(), memory.Set(ctx, "key", "value", time.Minute))
+	assert.Len(suite.T(), memory.entries, 1)
+	assert.Len(suite.T(), memory.expiry, 1)
+
+	memory = NewMemoryStore()
+	memory.maxEntries = 2
+	assert.NoError(suite.T(), memory.Set(ctx, "short", "value", time.Minute))
+	assert.NoError(suite.T(), memory.Set(ctx, "long", "value", time.Hour))
+	assert.NoError(suite.T(), memory.Set(ctx, "long", "updated", time.Hour))
+	assert.Len(suite.T(), memory.entries, 2)
+	assert.NoError(suite.T(), memory.Set(ctx, "new", "value", time.Hour))
+	assert.Len(suite.T(), memory.entries, 2)
+	_, found, _ := memory.Get(ctx, "short")
+	assert.False(suite.T(), found)
+	value, found, _ := memory.Get(ctx, "long")
+	assert.True(suite.T(), found)
+	assert.Equal(suite.T(), "updated", value)
+	assert.NoError(suite.T(), memory.Delete(ctx, "long"))
+	assert.NoError(suite.T(), memory.Flush(ctx, "n"))
+	assert.Empty(suite.T(), memory.entries)
+	assert.Empty(suite.T(), memory.expiry)
+
+	memory = NewUnboundedMemoryStore()
+	for i := 0; i < 3; i++ {
+		assert.NoError(suite.T(), memory.Set(ctx, fmt.Sprintf("key%d", i), "value", time.Hour))
+	}
+	assert.Len(suite.T(), memory.entries, 3)
+}
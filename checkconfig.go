@@ -0,0 +1,41 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+
+	"github.com/NBISweden/sda-uppmax-integration/helpers"
+)
+
+// checkConfig validates the configuration, and with -probe also contacts the
+// external services. All problems are printed to stderr, and the returned exit
+// code is non-zero if there were any.
+func checkConfig(args []string, stdout, stderr io.Writer) int {
+	flags := flag.NewFlagSet("check-config", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	probe := flags.Bool("probe", false, "also check that the external services are reachable")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+
+	conf, problems := helpers.CheckConf()
+	if conf != nil && *probe {
+		ctx, cancel := context.WithTimeout(context.Background(), conf.RequestBudget)
+		defer cancel()
+		problems = helpers.ProbeUpstreams(ctx, conf)
+	}
+
+	if len(problems) > 0 {
+		for _, problem := range problems {
+			fmt.Fprintf(stderr, "error: %v\n", problem)
+		}
+		fmt.Fprintf(stderr, "the configuration has %d problem(s)\n", len(problems))
+
+		return 1
+	}
+	fmt.Fprintln(stdout, "configuration is valid")
+
+	return 0
+}
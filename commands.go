@@ -0,0 +1,24 @@
+package main
+
+import (
+	"fmt"
+	"os"
+)
+
+// runCommand runs the subcommand called name with args and returns its exit code
+func runCommand(name string, args []string) int {
+	switch name {
+	case "check-config":
+		return checkConfig(args, os.Stdout, os.Stderr)
+	case "issue":
+		return issue(args, os.Stdout, os.Stderr)
+	case "verify":
+		return verify(args, os.Stdout, os.Stderr)
+	case "keygen":
+		return keygen(args, os.Stdout, os.Stderr)
+	default:
+		fmt.Fprintf(os.Stderr, "unknown command %s, expected one of serve, check-config, issue, verify, keygen\n", name)
+
+		return 2
+	}
+}
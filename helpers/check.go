@@ -0,0 +1,232 @@
+package helpers
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+// CheckConf validates the configuration like NewConf, but reports all the
+// problems found instead of stopping at the first one. The configuration is
+// returned if there are no problems.
+func CheckConf() (*Conf, []error) {
+	if err := readConfigFile(); err != nil {
+		return nil, []error{err}
+	}
+
+	var problems []error
+	add := func(format string, args ...any) {
+		problems = append(problems, fmt.Errorf(format, args...))
+	}
+
+	projectRegistries := readProjectRegistries()
+	required, err := requiredFields(projectRegistries)
+	if err != nil {
+		problems = append(problems, err)
+	}
+	resolved, err := loadSecrets()
+	if err != nil {
+		problems = append(problems, err)
+		resolved = &secrets{}
+	}
+	for _, key := range required {
+		if !resolved.isSet(key) {
+			add("required configuration field %s not set", key)
+		}
+	}
+
+	// the URLs of the external services
+	accountVerifier := viper.GetString("global.accountVerifier")
+	if accountVerifier == "" || accountVerifier == "ega" {
+		problems = appendIfError(problems, checkURL("global.egaURL", "http", "https"))
+	}
+	if slices.Contains(projectRegistries, "supr") {
+		problems = appendIfError(problems, checkURL("global.suprURL", "http", "https"))
+	}
+	if accountVerifier == "ldap" {
+		problems = appendIfError(problems, checkURL("ldap.url", "ldap", "ldaps"))
+	}
+	problems = appendIfError(problems, checkURL("oauth.userinfoURL", "http", "https"))
+	problems = appendIfError(problems, checkURL("vault.addr", "http", "https"))
+
+	// the key files and the other files the configuration refers to
+	if path := viper.GetString("global.jwtKey"); path != "" {
+		if _, err := parsePrivateECKey(path); err != nil {
+			add("global.jwtKey: could not parse ec key: %v", err)
+		}
+	}
+	if path := viper.GetString("global.crypt4ghKey"); path != "" {
+		if _, _, err := readCrypt4ghKey(path); err != nil {
+			add("global.crypt4ghKey: %v", err)
+		}
+	}
+	if _, err := loadCrypt4ghProjectKeys(); err != nil {
+		add("crypt4gh.projectKeys: %v", err)
+	}
+	if accountVerifier == "allowlist" {
+		problems = appendIfError(problems, checkReadable("allowlist.file"))
+	}
+	if slices.Contains(projectRegistries, "file") {
+		problems = appendIfError(problems, checkReadable("projects.file"))
+	}
+	names := make([]string, 0, len(defaultTemplates))
+	for name := range defaultTemplates {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if _, err := loadTemplate(name); err != nil {
+			add("templates.%s: %v", name, err)
+		}
+	}
+
+	// the token lifetimes, validated as by NewConf
+	problems = append(problems, readLifetimes(&Conf{})...)
+	for client := range viper.GetStringMap("clients") {
+		if _, err := readSecretSetting("clients." + client + ".password"); err != nil {
+			problems = append(problems, err)
+		}
+	}
+
+	if len(problems) > 0 {
+		return nil, problems
+	}
+
+	// anything not covered above is reported by NewConf
+	conf := &Conf{}
+	if err := NewConf(conf); err != nil {
+		return nil, []error{err}
+	}
+
+	return conf, nil
+}
+
+// appendIfError appends err to problems unless it is nil
+func appendIfError(problems []error, err error) []error {
+	if err != nil {
+		return append(problems, err)
+	}
+
+	return problems
+}
+
+// checkURL checks that the setting key, if set, is an absolute URL with one
+// of the given schemes
+func checkURL(key string, schemes ...string) error {
+	value := viper.GetString(key)
+	if value == "" {
+		return nil
+	}
+
+	parsed, err := url.Parse(value)
+	if err != nil {
+		return fmt.Errorf("%s: %q is not a valid URL", key, value)
+	}
+	if !slices.Contains(schemes, parsed.Scheme) {
+		return fmt.Errorf("%s: %q must use one of the schemes %s", key, value, strings.Join(schemes, ", "))
+	}
+	if parsed.Host == "" {
+		return fmt.Errorf("%s: %q has no host", key, value)
+	}
+
+	return nil
+}
+
+// checkReadable checks that the file given in the setting key, if set, can be read
+func checkReadable(key string) error {
+	path := viper.GetString(key)
+	if path == "" {
+		return nil
+	}
+	file, err := os.Open(filepath.Clean(path))
+	if err != nil {
+		return fmt.Errorf("%s: %v", key, err)
+	}
+
+	return file.Close()
+}
+
+// ProbeUpstreams contacts the external services used by conf, and returns a
+// problem for each service that can not be reached or rejects the configured
+// credentials
+func ProbeUpstreams(ctx context.Context, conf *Conf) []error {
+	var problems []error
+	client := &http.Client{Timeout: conf.UpstreamTimeout}
+	if conf.AccountVerifier == "" || conf.AccountVerifier == "ega" {
+		problems = appendIfError(problems, probeHTTP(ctx, client, "EGA", conf.EgaURL, conf.EgaUsername, conf.EgaPassword))
+	}
+	if slices.Contains(conf.ProjectRegistries, "supr") {
+		problems = appendIfError(problems, probeHTTP(ctx, client, "SUPR", conf.SuprURL, conf.SuprUsername, conf.SuprPassword))
+	}
+	if conf.OAuthUserinfoURL != "" {
+		problems = appendIfError(problems, probeHTTP(ctx, client, "userinfo", conf.OAuthUserinfoURL, "", ""))
+	}
+	if conf.AccountVerifier == "ldap" {
+		problems = appendIfError(problems, probeLDAP(ctx, conf.LdapURL, conf.UpstreamTimeout))
+	}
+
+	return problems
+}
+
+// probeHTTP sends a request to the service called name at rawURL. Any
+// response counts as reachable, except that a service given credentials must
+// not reject them or fail.
+func probeHTTP(ctx context.Context, client *http.Client, name, rawURL, username, password string) error {
+	req, err := http.NewRequestWithContext(ctx, "GET", rawURL, nil)
+	if err != nil {
+		return fmt.Errorf("%s: %v", name, err)
+	}
+	if username != "" {
+		req.SetBasicAuth(username, password)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("%s is not reachable: %v", name, err)
+	}
+	resp.Body.Close()
+
+	switch {
+	case username == "":
+		return nil
+	case resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden:
+		return fmt.Errorf("%s rejected the configured credentials with %v", name, resp.StatusCode)
+	case resp.StatusCode >= http.StatusInternalServerError:
+		return fmt.Errorf("%s responded with %v", name, resp.StatusCode)
+	}
+
+	return nil
+}
+
+// probeLDAP opens a connection to the LDAP server at rawURL
+func probeLDAP(ctx context.Context, rawURL string, timeout time.Duration) error {
+	parsed, err := url.Parse(rawURL)
+	if err != nil {
+		return fmt.Errorf("LDAP: %v", err)
+	}
+	host := parsed.Host
+	if parsed.Port() == "" {
+		port := "389"
+		if parsed.Scheme == "ldaps" {
+			port = "636"
+		}
+		host = net.JoinHostPort(parsed.Hostname(), port)
+	}
+
+	dialer := &net.Dialer{Timeout: timeout}
+	conn, err := dialer.DialContext(ctx, "tcp", host)
+	if err != nil {
+		return fmt.Errorf("LDAP is not reachable: %v", err)
+	}
+
+	return conn.Close()
+}
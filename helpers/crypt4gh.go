@@ -0,0 +1,118 @@
+package helpers
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/pem"
+	"fmt"
+	"os"
+	"path"
+	"strings"
+
+	b64 "encoding/base64"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+// crypt4ghPublicKeyType is the PEM block type of crypt4gh public keys
+const crypt4ghPublicKeyType = "CRYPT4GH PUBLIC KEY"
+
+// crypt4ghKeySize is the size of an X25519 key
+const crypt4ghKeySize = 32
+
+// Crypt4ghProjectKey maps the projects matching Pattern to a crypt4gh public key
+type Crypt4ghProjectKey struct {
+	// Pattern is a project id, or a shell pattern as in path.Match
+	Pattern string `mapstructure:"project"`
+	// KeyPath is the path of the public key
+	KeyPath string `mapstructure:"key"`
+	// Key is the base64 encoded public key
+	Key string `mapstructure:"-"`
+	// Fingerprint is the fingerprint of the public key
+	Fingerprint string `mapstructure:"-"`
+}
+
+// ParseCrypt4ghPublicKey parses a PEM encoded crypt4gh public key and returns
+// the X25519 key. Private keys are refused.
+func ParseCrypt4ghPublicKey(data []byte) ([]byte, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("no PEM block found")
+	}
+	if strings.Contains(block.Type, "PRIVATE KEY") {
+		return nil, fmt.Errorf("%s is a private key", block.Type)
+	}
+	if block.Type != crypt4ghPublicKeyType {
+		return nil, fmt.Errorf("unexpected PEM block %s", block.Type)
+	}
+	if len(block.Bytes) != crypt4ghKeySize {
+		return nil, fmt.Errorf("key is %d bytes instead of %d", len(block.Bytes), crypt4ghKeySize)
+	}
+
+	return block.Bytes, nil
+}
+
+// Crypt4ghFingerprint returns the fingerprint of an X25519 public key, which
+// is the hex encoded SHA-256 hash of the key
+func Crypt4ghFingerprint(key []byte) string {
+	hash := sha256.Sum256(key)
+
+	return hex.EncodeToString(hash[:])
+}
+
+// readCrypt4ghKey reads and validates the crypt4gh public key at keyPath, and
+// returns the file base64 encoded along with the fingerprint of the key
+func readCrypt4ghKey(keyPath string) (string, string, error) {
+	keyBytes, err := os.ReadFile(keyPath)
+	if err != nil {
+		return "", "", fmt.Errorf("could not parse crypt4gh public key: %v", err)
+	}
+	key, err := ParseCrypt4ghPublicKey(keyBytes)
+	if err != nil {
+		return "", "", fmt.Errorf("could not parse crypt4gh public key %s: %v", keyPath, err)
+	}
+	fingerprint := Crypt4ghFingerprint(key)
+	log.Infof("loaded crypt4gh public key %s with fingerprint %s", keyPath, fingerprint)
+
+	return b64.StdEncoding.EncodeToString(keyBytes), fingerprint, nil
+}
+
+// loadCrypt4ghProjectKeys reads the per-project crypt4gh public keys from
+// crypt4gh.projectKeys, in the order they are listed
+func loadCrypt4ghProjectKeys() ([]Crypt4ghProjectKey, error) {
+	var projectKeys []Crypt4ghProjectKey
+	if err := viper.UnmarshalKey("crypt4gh.projectKeys", &projectKeys); err != nil {
+		return nil, fmt.Errorf("could not parse crypt4gh.projectKeys: %v", err)
+	}
+
+	for i := range projectKeys {
+		if projectKeys[i].Pattern == "" || projectKeys[i].KeyPath == "" {
+			return nil, fmt.Errorf("could not parse crypt4gh.projectKeys: entry without project or key")
+		}
+		if _, err := path.Match(projectKeys[i].Pattern, ""); err != nil {
+			return nil, fmt.Errorf("invalid project pattern %s: %v", projectKeys[i].Pattern, err)
+		}
+		key, fingerprint, err := readCrypt4ghKey(projectKeys[i].KeyPath)
+		if err != nil {
+			return nil, fmt.Errorf("key of project %s: %v", projectKeys[i].Pattern, err)
+		}
+		projectKeys[i].Key = key
+		projectKeys[i].Fingerprint = fingerprint
+	}
+
+	return projectKeys, nil
+}
+
+// Crypt4ghKeyFor returns the base64 encoded crypt4gh public key of projectID,
+// which is the key of the first matching entry of crypt4gh.projectKeys, or the
+// global key if no entry matches
+func (conf *Conf) Crypt4ghKeyFor(projectID string) string {
+	for _, projectKey := range conf.Crypt4ghProjectKeys {
+		if matched, _ := path.Match(projectKey.Pattern, projectID); matched {
+			return projectKey.Key
+		}
+	}
+
+	return conf.Crypt4ghKey
+}
@@ -11,8 +11,9 @@ import (
 	"path"
 	"path/filepath"
 	"strings"
-
-	b64 "encoding/base64"
+	"sync"
+	"text/template"
+	"time"
 
 	log "github.com/sirupsen/logrus"
 
@@ -20,31 +21,72 @@ import (
 	"github.com/spf13/viper"
 )
 
-// Config holds the configuration of the service
-var Config Conf
-
 // Conf describes the configuration of the service
 type Conf struct {
-	Crypt4ghKeyPath string
-	Crypt4ghKey     string
-	EgaUsername     string
-	EgaPassword     string
-	EgaURL          string
-	ExpirationDays  int
-	Iss             string
-	JwtKeyPath      string
-	JwtParsedKey    *ecdsa.PrivateKey
-	S3URL           string
-	Username        string
-	Password        string
-	SuprUsername    string
-	SuprPassword    string
-	SuprURL         string
+	AccountVerifier     string
+	AllowlistPath       string
+	AuditFile           string
+	CacheType           string
+	CacheRedisAddr      string
+	CacheRedisPassword  string
+	CacheRedisDB        int
+	CachePositiveTTL    time.Duration
+	CacheNegativeTTL    time.Duration
+	ClientMaxLifetimes  map[string]time.Duration
+	ClientPasswords     map[string]string
+	Crypt4ghKeyPath     string
+	Crypt4ghKey         string
+	Crypt4ghFingerprint string
+	Crypt4ghProjectKeys []Crypt4ghProjectKey
+	EgaUsername         string
+	EgaPassword         string
+	EgaURL              string
+	ExpirationDays      int
+	Iss                 string
+	LdapURL             string
+	LdapBindDN          string
+	LdapBindPassword    string
+	LdapBaseDN          string
+	LdapFilter          string
+	MaxLifetime         time.Duration
+	OAuthUserinfoURL    string
+	OAuthUserClaim      string
+	ProjectFile         string
+	ProjectRegistries   []string
+	RefreshLifetime     time.Duration
+	RequestBudget       time.Duration
+	JwtKeyPath          string
+	JwtParsedKey        *ecdsa.PrivateKey
+	S3URL               string
+	Username            string
+	Password            string
+	SuprUsername        string
+	SuprPassword        string
+	SuprURL             string
+	Templates           map[string]*template.Template
+	UpstreamTimeout     time.Duration
+	UpstreamRetries     int
+	UpstreamBackoff     time.Duration
+	UpstreamMaxBackoff  time.Duration
+	BreakerThreshold    int
+	BreakerCooldown     time.Duration
+	ReloadInterval      time.Duration
+	VaultInterval       time.Duration
+	LogFormat           string
+	LogLevel            string
+
+	// filesHash is the hash of the files the configuration was read from
+	filesHash string
+	// vaultHash is the hash of the Vault secret the configuration was read
+	// from, empty if Vault is not used
+	vaultHash string
+	// vaultLease is the lease duration of the Vault secret, zero if it has none
+	vaultLease time.Duration
 }
 
-// NewConf reads the configuration from the config.yaml file
-func NewConf(conf *Conf) error {
-	viper.SetConfigName("config")
+// setupViper sets up the sources of the configuration. It only runs once, so
+// that reloads do not add the search paths again.
+var setupViper = sync.OnceFunc(func() {
 	viper.AddConfigPath(".")
 	viper.AutomaticEnv()
 	viper.SetEnvKeyReplacer(strings.NewReplacer(".", "_"))
@@ -54,7 +96,14 @@ func NewConf(conf *Conf) error {
 		splitPath := strings.Split(strings.TrimLeft(configPath, "/"), "/")
 		viper.AddConfigPath(path.Join(splitPath...))
 	}
+})
+
+// readConfigFile sets up viper and reads the configuration file, if there is one
+func readConfigFile() error {
+	setupViper()
 
+	// Setting the name also forgets a configuration file set by an earlier read
+	viper.SetConfigName("config")
 	if viper.IsSet("configFile") {
 		viper.SetConfigFile(viper.GetString("configFile"))
 	}
@@ -67,65 +116,258 @@ func NewConf(conf *Conf) error {
 		}
 	}
 
+	return applyAliases()
+}
+
+// readProjectRegistries returns the registries listed in
+// global.projectRegistries, which defaults to supr
+func readProjectRegistries() []string {
+	projectRegistries := []string{"supr"}
+	if viper.IsSet("global.projectRegistries") {
+		projectRegistries = nil
+		for _, registry := range viper.GetStringSlice("global.projectRegistries") {
+			for _, name := range strings.Split(registry, ",") {
+				if name = strings.TrimSpace(name); name != "" {
+					projectRegistries = append(projectRegistries, name)
+				}
+			}
+		}
+	}
+
+	return projectRegistries
+}
+
+// requiredFields returns the settings that must be set with the selected
+// project registries and account verifier
+func requiredFields(projectRegistries []string) ([]string, error) {
 	requiredConfVars := []string{
 		"global.iss", "global.crypt4ghKey", "global.uppmaxUsername", "global.uppmaxPassword", "global.s3url", "global.jwtKey",
-		"global.suprUsername", "global.suprPassword", "global.suprUrl", "global.egaUsername", "global.egaPassword", "global.egaUrl",
 	}
 
-	for _, s := range requiredConfVars {
-		if !viper.IsSet(s) || viper.GetString(s) == "" {
-			return fmt.Errorf("required configuration field %s not set", s)
+	if len(projectRegistries) == 0 {
+		return nil, fmt.Errorf("required configuration field global.projectRegistries not set")
+	}
+	for _, registry := range projectRegistries {
+		switch registry {
+		case "supr":
+			requiredConfVars = append(requiredConfVars, "global.suprUsername", "global.suprPassword", "global.suprURL")
+		case "file":
+			requiredConfVars = append(requiredConfVars, "projects.file")
+		default:
+			return nil, fmt.Errorf("project registry %s is not supported", registry)
 		}
 	}
 
-	if viper.IsSet("log.format") {
-		if viper.GetString("log.format") == "json" {
-			log.SetFormatter(&log.JSONFormatter{})
-			log.Info("The logs format is set to JSON")
-		}
+	switch viper.GetString("global.accountVerifier") {
+	case "", "ega":
+		requiredConfVars = append(requiredConfVars, "global.egaUsername", "global.egaPassword", "global.egaURL")
+	case "ldap":
+		requiredConfVars = append(requiredConfVars, "ldap.url", "ldap.baseDN")
+	case "allowlist":
+		requiredConfVars = append(requiredConfVars, "allowlist.file")
+	default:
+		return nil, fmt.Errorf("global.accountVerifier %s is not supported", viper.GetString("global.accountVerifier"))
+	}
+
+	return requiredConfVars, nil
+}
+
+// NewConf reads the configuration from the config.yaml file and sets up the
+// logging it describes
+func NewConf(conf *Conf) error {
+	if err := readConf(conf); err != nil {
+		return err
+	}
+	conf.configureLogging()
+
+	return nil
+}
+
+// configureLogging sets the format and the level of the logs. The logger is
+// global, so it is only set up at startup and not on a reload.
+func (conf *Conf) configureLogging() {
+	if conf.LogFormat == "json" {
+		log.SetFormatter(&log.JSONFormatter{})
+		log.Info("The logs format is set to JSON")
 	}
 
-	if viper.IsSet("log.level") {
-		stringLevel := viper.GetString("log.level")
-		intLevel, err := log.ParseLevel(stringLevel)
+	if conf.LogLevel != "" {
+		intLevel, err := log.ParseLevel(conf.LogLevel)
 		if err != nil {
-			log.Printf("Log level '%s' not supported, setting to 'trace'", stringLevel)
+			log.Printf("Log level '%s' not supported, setting to 'trace'", conf.LogLevel)
 			intLevel = log.TraceLevel
 		}
 		log.SetLevel(intLevel)
-		log.Printf("Setting log level to '%s'", stringLevel)
+		log.Printf("Setting log level to '%s'", conf.LogLevel)
+	}
+}
+
+// readConf reads the configuration from the config.yaml file
+func readConf(conf *Conf) error {
+	if err := readConfigFile(); err != nil {
+		return err
+	}
+
+	projectRegistries := readProjectRegistries()
+	requiredConfVars, err := requiredFields(projectRegistries)
+	if err != nil {
+		return err
+	}
+
+	secrets, err := loadSecrets()
+	if err != nil {
+		return err
+	}
+	for _, s := range requiredConfVars {
+		if !secrets.isSet(s) {
+			return fmt.Errorf("required configuration field %s not set", s)
+		}
 	}
 
+	conf.LogFormat = viper.GetString("log.format")
+	conf.LogLevel = viper.GetString("log.level")
 	conf.Iss = viper.GetString("global.iss")
 	conf.JwtKeyPath = viper.GetString("global.jwtKey")
 	conf.Username = viper.GetString("global.uppmaxUsername")
-	conf.Password = viper.GetString("global.uppmaxPassword")
+	conf.Password = secrets.settings["global.uppmaxPassword"]
 	conf.S3URL = viper.GetString("global.s3url")
 	conf.EgaUsername = viper.GetString("global.egaUsername")
-	conf.EgaPassword = viper.GetString("global.egaPassword")
+	conf.EgaPassword = secrets.settings["global.egaPassword"]
 	conf.EgaURL = viper.GetString("global.egaURL")
 	conf.Crypt4ghKeyPath = viper.GetString("global.crypt4ghKey")
-	conf.SuprPassword = viper.GetString("global.suprPassword")
+	conf.AccountVerifier = viper.GetString("global.accountVerifier")
+	conf.LdapURL = viper.GetString("ldap.url")
+	conf.LdapBindDN = viper.GetString("ldap.bindDN")
+	conf.LdapBindPassword = secrets.settings["ldap.bindPassword"]
+	conf.LdapBaseDN = viper.GetString("ldap.baseDN")
+	conf.LdapFilter = viper.GetString("ldap.filter")
+	conf.AllowlistPath = viper.GetString("allowlist.file")
+	conf.ProjectRegistries = projectRegistries
+	conf.ProjectFile = viper.GetString("projects.file")
+	conf.AuditFile = viper.GetString("audit.file")
+	conf.OAuthUserinfoURL = viper.GetString("oauth.userinfoURL")
+	conf.OAuthUserClaim = viper.GetString("oauth.userClaim")
+	if conf.OAuthUserClaim == "" {
+		conf.OAuthUserClaim = "email"
+	}
+	conf.SuprPassword = secrets.settings["global.suprPassword"]
 	conf.SuprURL = viper.GetString("global.suprURL")
 	conf.SuprUsername = viper.GetString("global.suprUsername")
 
-	if !viper.IsSet("global.expirationDays") {
-		conf.ExpirationDays = 14
+	if problems := readLifetimes(conf); len(problems) > 0 {
+		return problems[0]
+	}
+	conf.ClientPasswords = make(map[string]string)
+	for client := range viper.GetStringMap("clients") {
+		password, err := readSecretSetting("clients." + client + ".password")
+		if err != nil {
+			return err
+		}
+		if password != "" {
+			conf.ClientPasswords[client] = password
+		}
+	}
+
+	conf.CacheType = viper.GetString("cache.type")
+	conf.CacheRedisAddr = viper.GetString("cache.redisAddr")
+	conf.CacheRedisPassword = secrets.settings["cache.redisPassword"]
+	conf.vaultHash = secrets.vaultHash
+	conf.vaultLease = secrets.vaultLease
+	conf.CacheRedisDB = viper.GetInt("cache.redisDB")
+	switch conf.CacheType {
+	case "", "memory", "none", "redis":
+	default:
+		return fmt.Errorf("cache.type %s is not supported", conf.CacheType)
+	}
+	if conf.CacheType == "redis" && conf.CacheRedisAddr == "" {
+		return fmt.Errorf("required configuration field cache.redisAddr not set")
+	}
+
+	if !viper.IsSet("cache.positiveTTL") {
+		conf.CachePositiveTTL = 10 * time.Minute
 	} else {
-		conf.ExpirationDays = viper.GetInt("global.expirationDays")
+		conf.CachePositiveTTL = viper.GetDuration("cache.positiveTTL")
+	}
+	if !viper.IsSet("cache.negativeTTL") {
+		conf.CacheNegativeTTL = time.Minute
+	} else {
+		conf.CacheNegativeTTL = viper.GetDuration("cache.negativeTTL")
+	}
+
+	if !viper.IsSet("upstream.timeout") {
+		conf.UpstreamTimeout = 5 * time.Second
+	} else {
+		conf.UpstreamTimeout = viper.GetDuration("upstream.timeout")
+	}
+	if !viper.IsSet("upstream.retries") {
+		conf.UpstreamRetries = 2
+	} else {
+		conf.UpstreamRetries = viper.GetInt("upstream.retries")
+	}
+	if !viper.IsSet("upstream.backoff") {
+		conf.UpstreamBackoff = 200 * time.Millisecond
+	} else {
+		conf.UpstreamBackoff = viper.GetDuration("upstream.backoff")
+	}
+	if !viper.IsSet("upstream.maxBackoff") {
+		conf.UpstreamMaxBackoff = 2 * time.Second
+	} else {
+		conf.UpstreamMaxBackoff = viper.GetDuration("upstream.maxBackoff")
+	}
+	if !viper.IsSet("upstream.breakerThreshold") {
+		conf.BreakerThreshold = 5
+	} else {
+		conf.BreakerThreshold = viper.GetInt("upstream.breakerThreshold")
+	}
+	if !viper.IsSet("upstream.breakerCooldown") {
+		conf.BreakerCooldown = 30 * time.Second
+	} else {
+		conf.BreakerCooldown = viper.GetDuration("upstream.breakerCooldown")
+	}
+	if !viper.IsSet("reload.interval") {
+		conf.ReloadInterval = 30 * time.Second
+	} else {
+		conf.ReloadInterval = viper.GetDuration("reload.interval")
+	}
+	if !viper.IsSet("vault.interval") {
+		conf.VaultInterval = 5 * time.Minute
+	} else {
+		conf.VaultInterval = viper.GetDuration("vault.interval")
+	}
+	if !viper.IsSet("upstream.requestBudget") {
+		conf.RequestBudget = 20 * time.Second
+	} else {
+		conf.RequestBudget = viper.GetDuration("upstream.requestBudget")
+	}
+	if conf.UpstreamTimeout <= 0 || conf.UpstreamRetries < 0 || conf.RequestBudget <= 0 {
+		return fmt.Errorf("upstream.timeout and upstream.requestBudget must be positive and upstream.retries not negative")
+	}
+
+	templates, err := loadTemplates()
+	if err != nil {
+		return err
+	}
+	conf.Templates = templates
+
+	if conf.JwtKeyPath != "" {
+		conf.JwtParsedKey, err = parsePrivateECKey(conf.JwtKeyPath)
+	} else {
+		conf.JwtParsedKey, err = jwt.ParseECPrivateKeyFromPEM(secrets.jwtKey)
 	}
-	JwtParsedKey, err := parsePrivateECKey(conf.JwtKeyPath)
 	if err != nil {
 		return fmt.Errorf("could not parse ec key: %v", err)
 	}
-	conf.JwtParsedKey = JwtParsedKey
 
-	// Parse crypt4gh key and store it as base64 encoded
-	keyBytes, err := os.ReadFile(conf.Crypt4ghKeyPath)
+	// Parse crypt4gh keys and store them as base64 encoded
+	conf.Crypt4ghKey, conf.Crypt4ghFingerprint, err = readCrypt4ghKey(conf.Crypt4ghKeyPath)
 	if err != nil {
-		return fmt.Errorf("could not parse crypt4gh public key: %v", err)
+		return err
 	}
-	conf.Crypt4ghKey = b64.StdEncoding.EncodeToString([]byte(keyBytes))
+	conf.Crypt4ghProjectKeys, err = loadCrypt4ghProjectKeys()
+	if err != nil {
+		return err
+	}
+	conf.filesHash = filesHash(conf.watchedFiles())
 
 	return nil
 }
@@ -136,6 +378,46 @@ type errorStruct struct {
 	} `json:"error"`
 }
 
+// readLifetimes reads the token lifetimes into conf and returns the problems
+// found with them. The default lifetime of global.expirationDays is capped at
+// global.maxLifetime when tokens are issued, so that either can be lowered on
+// its own.
+func readLifetimes(conf *Conf) []error {
+	var problems []error
+	conf.ExpirationDays = 14
+	if viper.IsSet("global.expirationDays") {
+		conf.ExpirationDays = viper.GetInt("global.expirationDays")
+	}
+	conf.MaxLifetime = time.Duration(conf.ExpirationDays) * 24 * time.Hour
+	if viper.IsSet("global.maxLifetime") {
+		conf.MaxLifetime = viper.GetDuration("global.maxLifetime")
+	}
+	if conf.ExpirationDays <= 0 {
+		problems = append(problems, fmt.Errorf("global.expirationDays must be positive, got %d", conf.ExpirationDays))
+	}
+	if conf.MaxLifetime <= 0 {
+		problems = append(problems, fmt.Errorf("global.maxLifetime must be positive, got %v", conf.MaxLifetime))
+	}
+	conf.ClientMaxLifetimes = make(map[string]time.Duration)
+	for client := range viper.GetStringMap("clients") {
+		if !viper.IsSet("clients." + client + ".maxLifetime") {
+			continue
+		}
+		maxLifetime := viper.GetDuration("clients." + client + ".maxLifetime")
+		if maxLifetime <= 0 {
+			problems = append(problems, fmt.Errorf("clients.%s.maxLifetime must be positive, got %v", client, maxLifetime))
+		}
+		conf.ClientMaxLifetimes[client] = maxLifetime
+	}
+	// refresh tokens are only issued if enabled with a lifetime
+	conf.RefreshLifetime = viper.GetDuration("refresh.lifetime")
+	if conf.RefreshLifetime < 0 {
+		problems = append(problems, fmt.Errorf("refresh.lifetime must not be negative"))
+	}
+
+	return problems
+}
+
 // CreateErrorResponse returns a JSON structure containing the error passed in the function
 func CreateErrorResponse(errorMessage string) []byte {
 	currentError := errorStruct{}
@@ -145,21 +427,31 @@ func CreateErrorResponse(errorMessage string) []byte {
 	return errorBytes
 }
 
-// BasicAuth checks if the used credentials match the defined ones and
-// returns unauthorised if that's not the case
-func BasicAuth(next http.HandlerFunc) http.HandlerFunc {
+// BasicAuth checks if the used credentials match the ones in the configuration
+// returned by conf, either global.uppmaxUsername or a client with a password in
+// the clients section, and returns unauthorised if that's not the case
+func BasicAuth(conf func() *Conf, next http.HandlerFunc) http.HandlerFunc {
+	return basicAuth(conf, true, next)
+}
+
+// AdminAuth is BasicAuth for the administrative endpoints, which only accepts
+// the credentials in global.uppmaxUsername and global.uppmaxPassword
+func AdminAuth(conf func() *Conf, next http.HandlerFunc) http.HandlerFunc {
+	return basicAuth(conf, false, next)
+}
+
+func basicAuth(conf func() *Conf, allowClients bool, next http.HandlerFunc) http.HandlerFunc {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		username, password, ok := r.BasicAuth()
 		if ok {
-			usernameHash := sha256.Sum256([]byte(username))
-			passwordHash := sha256.Sum256([]byte(password))
-			expectedUsernameHash := sha256.Sum256([]byte(Config.Username))
-			expectedPasswordHash := sha256.Sum256([]byte(Config.Password))
-
-			usernameMatch := (subtle.ConstantTimeCompare(usernameHash[:], expectedUsernameHash[:]) == 1)
-			passwordMatch := (subtle.ConstantTimeCompare(passwordHash[:], expectedPasswordHash[:]) == 1)
+			expected := conf()
+			usernameMatch := secretMatch(username, expected.Username)
+			passwordMatch := secretMatch(password, expected.Password)
+			// the names of the clients are not case sensitive, as other keys
+			clientPassword, isClient := expected.ClientPasswords[strings.ToLower(username)]
+			clientMatch := allowClients && isClient && secretMatch(password, clientPassword)
 
-			if usernameMatch && passwordMatch {
+			if (usernameMatch && passwordMatch) || clientMatch {
 				next.ServeHTTP(w, r)
 
 				return
@@ -171,6 +463,14 @@ func BasicAuth(next http.HandlerFunc) http.HandlerFunc {
 	})
 }
 
+// secretMatch compares a given credential with the expected one in constant time
+func secretMatch(given, expected string) bool {
+	givenHash := sha256.Sum256([]byte(given))
+	expectedHash := sha256.Sum256([]byte(expected))
+
+	return subtle.ConstantTimeCompare(givenHash[:], expectedHash[:]) == 1
+}
+
 // ParsePrivateECKey reads and parses the EC private key
 func parsePrivateECKey(keyPath string) (*ecdsa.PrivateKey, error) {
 
@@ -1,8 +1,20 @@
 package helpers
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
 	"os"
+	"strings"
+	"sync"
 	"testing"
+	"time"
+
+	b64 "encoding/base64"
 
 	log "github.com/sirupsen/logrus"
 	"github.com/stretchr/testify/assert"
@@ -27,7 +39,7 @@ func (suite *TestSuite) SetupTest() {
 	suite.PrivateKeyPath, _ = testhelpers.CreateECkeys(suite.TempDir)
 
 	// Create random public crypt4gh key
-	cryptKey := "-----BEGIN CRYPT4GH PUBLIC KEY-----\nvSome+asd/apublicKey\n-----END CRYPT4GH PUBLIC KEY-----"
+	cryptKey := "-----BEGIN CRYPT4GH PUBLIC KEY-----\nDiuAlYdpdr7jwCIdeHKwJdXGnUGBVUZwRHO2iMG0O2E=\n-----END CRYPT4GH PUBLIC KEY-----"
 	crypt4ghFile, _ := os.CreateTemp(suite.TempDir, "rsakey-")
 	_, err := crypt4ghFile.Write([]byte(cryptKey))
 	if err != nil {
@@ -62,13 +74,10 @@ func (suite *TestSuite) TestNewConf() {
   uppmaxUsername: "user"
   uppmaxPassword: "password"
 `
-	configName := "config.yaml"
-	err := os.WriteFile(configName, []byte(confData), 0600)
-	if err != nil {
-		log.Printf("failed to write temp config file, %v", err)
-	}
+	configName := testhelpers.WriteConfig(suite.T(), confData)
 
-	err = NewConf(&Config)
+	conf := &Conf{}
+	err := NewConf(conf)
 	assert.NoError(suite.T(), err)
 
 	defer os.Remove(configName)
@@ -85,13 +94,10 @@ func (suite *TestSuite) TestNewConfMissingValue() {
   crypt4ghKey: "` + suite.Crypt4ghKeyPath + `"
 `
 
-	configName := "config.yaml"
-	err := os.WriteFile(configName, []byte(confData), 0600)
-	if err != nil {
-		log.Printf("failed to write temp config file, %v", err)
-	}
+	configName := testhelpers.WriteConfig(suite.T(), confData)
 
-	err = NewConf(&Config)
+	conf := &Conf{}
+	err := NewConf(conf)
 	assert.EqualError(suite.T(), err, "required configuration field global.iss not set")
 
 	defer os.Remove(configName)
@@ -113,13 +119,10 @@ func (suite *TestSuite) TestNewConfMissingKey() {
   uppmaxUsername: "user"
   uppmaxPassword: "password"
 `
-	configName := "config.yaml"
-	err := os.WriteFile(configName, []byte(confData), 0600)
-	if err != nil {
-		log.Printf("failed to write temp config file, %v", err)
-	}
+	configName := testhelpers.WriteConfig(suite.T(), confData)
 
-	err = NewConf(&Config)
+	conf := &Conf{}
+	err := NewConf(conf)
 	assert.EqualError(suite.T(), err, "could not parse ec key: open some/path: no such file or directory")
 
 	defer os.Remove(configName)
@@ -136,3 +139,667 @@ func (suite *TestSuite) TestParsePrivateECKey() {
 
 	defer os.Remove(privateKeyPath)
 }
+
+func (suite *TestSuite) TestNewConfAccountVerifier() {
+	confData := `global:
+  accountVerifier: ldap
+  crypt4ghKey: ` + suite.Crypt4ghKeyPath + `
+  iss: "https://some.url"
+  jwtKey: "` + suite.PrivateKeyPath + `"
+  suprUsername: "some-user"
+  suprPassword: "some-pass"
+  suprURL: "http://supr.dev"
+  s3url: "some.s3.url"
+  uppmaxUsername: "user"
+  uppmaxPassword: "password"
+ldap:
+  url: "ldap://ldap.dev"
+`
+	configName := testhelpers.WriteConfig(suite.T(), confData)
+
+	// The EGA settings are not required, but the LDAP ones are
+	conf := &Conf{}
+	err := NewConf(conf)
+	assert.EqualError(suite.T(), err, "required configuration field ldap.baseDN not set")
+
+	err = os.WriteFile(configName, []byte(confData+"  baseDN: \"dc=sda,dc=dev\"\n"), 0600)
+	assert.NoError(suite.T(), err)
+	err = NewConf(conf)
+	assert.NoError(suite.T(), err)
+	assert.Equal(suite.T(), "ldap", conf.AccountVerifier)
+	assert.Equal(suite.T(), "ldap://ldap.dev", conf.LdapURL)
+	assert.Equal(suite.T(), "dc=sda,dc=dev", conf.LdapBaseDN)
+
+	err = os.WriteFile(configName, []byte(strings.Replace(confData, "accountVerifier: ldap", "accountVerifier: kerberos", 1)), 0600)
+	assert.NoError(suite.T(), err)
+	err = NewConf(conf)
+	assert.EqualError(suite.T(), err, "global.accountVerifier kerberos is not supported")
+}
+
+func (suite *TestSuite) TestNewConfTemplates() {
+	templatePath := suite.TempDir + "/s3cmd.tmpl"
+	confData := `global:
+  crypt4ghKey: ` + suite.Crypt4ghKeyPath + `
+  egaUsername: "some-user"
+  egaPassword: "some-pass"
+  egaURL: "http://ega.dev"
+  iss: "https://some.url"
+  jwtKey: "` + suite.PrivateKeyPath + `"
+  suprUsername: "some-user"
+  suprPassword: "some-pass"
+  suprURL: "http://supr.dev"
+  s3url: "some.s3.url"
+  uppmaxUsername: "user"
+  uppmaxPassword: "password"
+templates:
+  s3cmd: ` + templatePath + `
+`
+	testhelpers.WriteConfig(suite.T(), confData)
+
+	conf := &Conf{}
+	err := NewConf(conf)
+	assert.ErrorContains(suite.T(), err, "could not read template s3cmd")
+
+	err = os.WriteFile(templatePath, []byte("access_token = {{.Token}"), 0600)
+	assert.NoError(suite.T(), err)
+	err = NewConf(conf)
+	assert.ErrorContains(suite.T(), err, "could not parse template s3cmd")
+
+	err = os.WriteFile(templatePath, []byte("access_token = {{.Tokn}}"), 0600)
+	assert.NoError(suite.T(), err)
+	err = NewConf(conf)
+	assert.ErrorContains(suite.T(), err, "invalid template s3cmd")
+
+	err = os.WriteFile(templatePath, []byte("# {{.Project}} until {{.Expiry.Format \"2006-01-02\"}}\naccess_token = {{.Token}}\n"), 0600)
+	assert.NoError(suite.T(), err)
+	err = NewConf(conf)
+	assert.NoError(suite.T(), err)
+
+	var rendered strings.Builder
+	err = conf.Templates["s3cmd"].Execute(&rendered, TemplateData{Token: "some-token", Project: "sda001", Expiry: time.Date(2026, 1, 2, 0, 0, 0, 0, time.UTC)})
+	assert.NoError(suite.T(), err)
+	assert.Equal(suite.T(), "# sda001 until 2026-01-02\naccess_token = some-token\n", rendered.String())
+
+	// The built-in templates are used for the other formats
+	assert.NotEqual(suite.T(), conf.Templates["s3cmd"], conf.Templates["sdaCli"])
+	rendered.Reset()
+	err = conf.Templates["sdaCli"].Execute(&rendered, TemplateData{Token: "some-token", Host: "some.s3.url"})
+	assert.NoError(suite.T(), err)
+	assert.Contains(suite.T(), rendered.String(), "access_token = some-token\nhost_base = some.s3.url\n")
+	assert.Contains(suite.T(), conf.Templates, "rclone")
+	assert.Contains(suite.T(), conf.Templates, "aws")
+	assert.Contains(suite.T(), conf.Templates, "awsCredentials")
+}
+
+func (suite *TestSuite) TestNewConfCrypt4ghProjectKeys() {
+	projectKeyPath := suite.TempDir + "/project.pub.pem"
+	confData := `global:
+  crypt4ghKey: ` + suite.Crypt4ghKeyPath + `
+  egaUsername: "some-user"
+  egaPassword: "some-pass"
+  egaURL: "http://ega.dev"
+  iss: "https://some.url"
+  jwtKey: "` + suite.PrivateKeyPath + `"
+  suprUsername: "some-user"
+  suprPassword: "some-pass"
+  suprURL: "http://supr.dev"
+  s3url: "some.s3.url"
+  uppmaxUsername: "user"
+  uppmaxPassword: "password"
+crypt4gh:
+  projectKeys:
+    - project: sda001
+      key: ` + projectKeyPath + `
+    - project: "sens*"
+      key: ` + projectKeyPath + `
+`
+	testhelpers.WriteConfig(suite.T(), confData)
+
+	conf := &Conf{}
+	err := NewConf(conf)
+	assert.ErrorContains(suite.T(), err, "key of project sda001: could not parse crypt4gh public key")
+
+	err = os.WriteFile(projectKeyPath, []byte("-----BEGIN CRYPT4GH PUBLIC KEY-----\nXWd0GvGwL14Dt1U6tTzBq6e0IVvyP4oEGEqAOBMZBxo=\n-----END CRYPT4GH PUBLIC KEY-----"), 0600)
+	assert.NoError(suite.T(), err)
+	err = NewConf(conf)
+	assert.NoError(suite.T(), err)
+	assert.Len(suite.T(), conf.Crypt4ghProjectKeys, 2)
+
+	globalKey, _ := os.ReadFile(suite.Crypt4ghKeyPath)
+	projectKey, _ := os.ReadFile(projectKeyPath)
+	assert.Equal(suite.T(), b64.StdEncoding.EncodeToString(projectKey), conf.Crypt4ghKeyFor("sda001"))
+	assert.Equal(suite.T(), b64.StdEncoding.EncodeToString(projectKey), conf.Crypt4ghKeyFor("sensitive001"))
+	assert.Equal(suite.T(), b64.StdEncoding.EncodeToString(globalKey), conf.Crypt4ghKeyFor("sda002"))
+	assert.Equal(suite.T(), conf.Crypt4ghKey, conf.Crypt4ghKeyFor("sda002"))
+}
+
+func (suite *TestSuite) TestNewConfSecretFiles() {
+	passwordFile := suite.TempDir + "/uppmax-password"
+	confData := `global:
+  crypt4ghKey: ` + suite.Crypt4ghKeyPath + `
+  egaUsername: "some-user"
+  egaPasswordFile: ` + suite.TempDir + `/ega-password
+  egaURL: "http://ega.dev"
+  iss: "https://some.url"
+  jwtKey: "` + suite.PrivateKeyPath + `"
+  suprUsername: "some-user"
+  suprPassword: "some-pass"
+  suprURL: "http://supr.dev"
+  s3url: "some.s3.url"
+  uppmaxUsername: "user"
+  uppmaxPasswordFile: ` + passwordFile + `
+`
+	configName := testhelpers.WriteConfig(suite.T(), confData)
+
+	conf := &Conf{}
+	err := NewConf(conf)
+	assert.ErrorContains(suite.T(), err, "could not read global.uppmaxPasswordFile")
+
+	// The trailing newline of mounted secrets is not part of the secret
+	assert.NoError(suite.T(), os.WriteFile(passwordFile, []byte("file-password\n"), 0600))
+	assert.NoError(suite.T(), os.WriteFile(suite.TempDir+"/ega-password", []byte("ega-password"), 0600))
+	err = NewConf(conf)
+	assert.NoError(suite.T(), err)
+	assert.Equal(suite.T(), "file-password", conf.Password)
+	assert.Equal(suite.T(), "ega-password", conf.EgaPassword)
+	assert.Equal(suite.T(), "some-pass", conf.SuprPassword)
+	assert.Contains(suite.T(), conf.watchedFiles(), passwordFile)
+
+	// A secret can not be given both ways
+	err = os.WriteFile(configName, []byte(confData+"  uppmaxPassword: password\n"), 0600)
+	assert.NoError(suite.T(), err)
+	err = NewConf(conf)
+	assert.EqualError(suite.T(), err, "only one of global.uppmaxPassword and global.uppmaxPasswordFile can be set")
+}
+
+// TestNewConfVault reads the secrets from a stub of the KV secrets engine of Vault
+func (suite *TestSuite) TestNewConfVault() {
+	jwtKey, err := os.ReadFile(suite.PrivateKeyPath)
+	assert.NoError(suite.T(), err)
+	secret, _ := json.Marshal(map[string]string{
+		"uppmaxPassword": "vault-password",
+		"egaPassword":    "vault-ega-password",
+		"suprPassword":   "vault-supr-password",
+		"jwtKey":         string(jwtKey),
+	})
+	vault := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Vault-Token") != "some-token" {
+			w.WriteHeader(http.StatusForbidden)
+			_, _ = io.WriteString(w, `{"errors":["permission denied"]}`)
+
+			return
+		}
+		switch r.URL.Path {
+		case "/v1/secret/data/sda/uppmax":
+			_, _ = io.WriteString(w, `{"data": {"data": `+string(secret)+`, "metadata": {"version": 1}}}`)
+		case "/v1/kv/sda/uppmax":
+			_, _ = io.WriteString(w, `{"data": `+string(secret)+`}`)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+			_, _ = io.WriteString(w, `{"errors":[]}`)
+		}
+	}))
+	defer vault.Close()
+
+	confData := `global:
+  crypt4ghKey: ` + suite.Crypt4ghKeyPath + `
+  egaUsername: "some-user"
+  egaURL: "http://ega.dev"
+  iss: "https://some.url"
+  suprUsername: "some-user"
+  suprURL: "http://supr.dev"
+  s3url: "some.s3.url"
+  uppmaxUsername: "user"
+  uppmaxPassword: "password"
+vault:
+  addr: ` + vault.URL + `
+  path: sda/uppmax
+  tokenFile: ` + suite.TempDir + `/vault-token
+`
+	configName := testhelpers.WriteConfig(suite.T(), confData)
+
+	conf := &Conf{}
+	assert.NoError(suite.T(), os.WriteFile(suite.TempDir+"/vault-token", []byte("wrong-token\n"), 0600))
+	err = NewConf(conf)
+	assert.EqualError(suite.T(), err, `could not read secrets from vault: got 403 from vault: {"errors":["permission denied"]}`)
+
+	// The settings given in the configuration take precedence over Vault
+	assert.NoError(suite.T(), os.WriteFile(suite.TempDir+"/vault-token", []byte("some-token\n"), 0600))
+	err = NewConf(conf)
+	assert.NoError(suite.T(), err)
+	assert.Equal(suite.T(), "password", conf.Password)
+	assert.Equal(suite.T(), "vault-ega-password", conf.EgaPassword)
+	assert.Equal(suite.T(), "vault-supr-password", conf.SuprPassword)
+	assert.NotNil(suite.T(), conf.JwtParsedKey)
+	assert.Empty(suite.T(), conf.JwtKeyPath)
+
+	// Version 1 of the secrets engine
+	err = os.WriteFile(configName, []byte(confData+"  mount: kv\n  kvVersion: 1\n"), 0600)
+	assert.NoError(suite.T(), err)
+	err = NewConf(conf)
+	assert.NoError(suite.T(), err)
+	assert.Equal(suite.T(), "vault-ega-password", conf.EgaPassword)
+
+	err = os.WriteFile(configName, []byte(strings.Replace(confData, "sda/uppmax", "sda/missing", 1)), 0600)
+	assert.NoError(suite.T(), err)
+	err = NewConf(conf)
+	assert.EqualError(suite.T(), err, `could not read secrets from vault: got 404 from vault: {"errors":[]}`)
+}
+
+func (suite *TestSuite) TestCheckConf() {
+	confData := `global:
+  crypt4ghKey: ` + suite.TempDir + `/missing.pub.pem
+  egaUsername: "some-user"
+  egaURL: "ega.dev"
+  expirationDays: 30
+  maxLifetime: 0s
+  iss: "https://some.url"
+  jwtKey: "` + suite.PrivateKeyPath + `"
+  projectRegistries: file
+  s3url: "some.s3.url"
+  uppmaxUsername: "user"
+  uppmaxPassword: "password"
+templates:
+  rclone: ` + suite.TempDir + `/rclone.tmpl
+`
+	err := os.WriteFile(suite.TempDir+"/rclone.tmpl", []byte("token = {{.Secret}}"), 0600)
+	assert.NoError(suite.T(), err)
+	configName := testhelpers.WriteConfig(suite.T(), confData)
+
+	// All problems are reported at once
+	conf, problems := CheckConf()
+	assert.Nil(suite.T(), conf)
+	var messages []string
+	for _, problem := range problems {
+		messages = append(messages, problem.Error())
+	}
+	assert.Equal(suite.T(), []string{
+		"required configuration field projects.file not set",
+		"required configuration field global.egaPassword not set",
+		`global.egaURL: "ega.dev" must use one of the schemes http, https`,
+		"global.crypt4ghKey: could not parse crypt4gh public key: open " + suite.TempDir + "/missing.pub.pem: no such file or directory",
+	}, messages[:4])
+	assert.Contains(suite.T(), messages[4], "templates.rclone: invalid template rclone")
+	assert.Equal(suite.T(), "global.maxLifetime must be positive, got 0s", messages[5])
+	assert.Len(suite.T(), messages, 6)
+
+	confData = strings.NewReplacer(
+		suite.TempDir+"/missing.pub.pem", suite.Crypt4ghKeyPath,
+		`egaURL: "ega.dev"`, `egaURL: "http://ega.dev"`+"\n  egaPassword: some-pass",
+		"maxLifetime: 0s", "maxLifetime: 720h",
+		"  rclone: "+suite.TempDir+"/rclone.tmpl\n", "",
+	).Replace(confData) + "projects:\n  file: " + suite.TempDir + "/projects.yaml\n"
+	err = os.WriteFile(configName, []byte(confData), 0600)
+	assert.NoError(suite.T(), err)
+	_, problems = CheckConf()
+	assert.EqualError(suite.T(), errors.Join(problems...), "projects.file: open "+suite.TempDir+"/projects.yaml: no such file or directory")
+
+	assert.NoError(suite.T(), os.WriteFile(suite.TempDir+"/projects.yaml", []byte("projects: []\n"), 0600))
+	conf, problems = CheckConf()
+	assert.Empty(suite.T(), problems)
+	assert.Equal(suite.T(), "http://ega.dev", conf.EgaURL)
+
+	// The service validates the lifetimes in the same way
+	err = os.WriteFile(configName, []byte(strings.Replace(confData, "maxLifetime: 720h", "maxLifetime: 0s", 1)), 0600)
+	assert.NoError(suite.T(), err)
+	assert.EqualError(suite.T(), NewConf(&Conf{}), "global.maxLifetime must be positive, got 0s")
+
+	// The maximum lifetime can be lowered below the default lifetime, which
+	// is capped when issuing tokens
+	err = os.WriteFile(configName, []byte(strings.Replace(confData, "maxLifetime: 720h", "maxLifetime: 72h", 1)), 0600)
+	assert.NoError(suite.T(), err)
+	conf, problems = CheckConf()
+	assert.Empty(suite.T(), problems)
+	assert.Equal(suite.T(), 30, conf.ExpirationDays)
+	assert.Equal(suite.T(), 72*time.Hour, conf.MaxLifetime)
+}
+
+func (suite *TestSuite) TestBasicAuth() {
+	conf := &Conf{Username: "pilot", Password: "pilot-pass", ClientPasswords: map[string]string{"portal": "portal-pass"}}
+	handler := func(w http.ResponseWriter, _ *http.Request) { w.WriteHeader(http.StatusNoContent) }
+	authorize := func(auth func(func() *Conf, http.HandlerFunc) http.HandlerFunc, username, password string) int {
+		r := httptest.NewRequest(http.MethodPost, "/token", nil)
+		if username != "" {
+			r.SetBasicAuth(username, password)
+		}
+		w := httptest.NewRecorder()
+		auth(func() *Conf { return conf }, handler)(w, r)
+
+		return w.Code
+	}
+
+	assert.Equal(suite.T(), http.StatusNoContent, authorize(BasicAuth, "pilot", "pilot-pass"))
+	assert.Equal(suite.T(), http.StatusNoContent, authorize(BasicAuth, "portal", "portal-pass"))
+	assert.Equal(suite.T(), http.StatusNoContent, authorize(BasicAuth, "Portal", "portal-pass"))
+	assert.Equal(suite.T(), http.StatusUnauthorized, authorize(BasicAuth, "portal", "pilot-pass"))
+	assert.Equal(suite.T(), http.StatusUnauthorized, authorize(BasicAuth, "pilot", "portal-pass"))
+	assert.Equal(suite.T(), http.StatusUnauthorized, authorize(BasicAuth, "other", ""))
+	assert.Equal(suite.T(), http.StatusUnauthorized, authorize(BasicAuth, "", ""))
+
+	// The administrative endpoints are only available to the pilot
+	assert.Equal(suite.T(), http.StatusNoContent, authorize(AdminAuth, "pilot", "pilot-pass"))
+	assert.Equal(suite.T(), http.StatusUnauthorized, authorize(AdminAuth, "portal", "portal-pass"))
+}
+
+func (suite *TestSuite) TestProbeUpstreams() {
+	ega := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, password, _ := r.BasicAuth(); password != "some-pass" {
+			w.WriteHeader(http.StatusUnauthorized)
+
+			return
+		}
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	defer ega.Close()
+	supr := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	supr.Close()
+
+	conf := &Conf{
+		EgaURL:            ega.URL,
+		EgaUsername:       "some-user",
+		EgaPassword:       "some-pass",
+		ProjectRegistries: []string{"supr"},
+		SuprURL:           supr.URL,
+		SuprUsername:      "some-user",
+		SuprPassword:      "some-pass",
+		UpstreamTimeout:   time.Second,
+	}
+	problems := ProbeUpstreams(context.Background(), conf)
+	assert.Len(suite.T(), problems, 1)
+	assert.ErrorContains(suite.T(), problems[0], "SUPR is not reachable")
+
+	conf.EgaPassword = "wrong-pass"
+	conf.ProjectRegistries = []string{"file"}
+	problems = ProbeUpstreams(context.Background(), conf)
+	assert.EqualError(suite.T(), errors.Join(problems...), "EGA rejected the configured credentials with 401")
+}
+
+func (suite *TestSuite) TestConfigSchema() {
+	confData := `global:
+  crypt4ghKey: ` + suite.Crypt4ghKeyPath + `
+  egaUser: "some-user"
+  egaPassword: "some-pass"
+  egaURL: "http://ega.dev"
+  iss: "https://some.url"
+  jwtKey: "` + suite.PrivateKeyPath + `"
+  suprUsername: "some-user"
+  suprPassword: "some-pass"
+  suprURL: "http://supr.dev"
+  s3url: "some.s3.url"
+  uppmaxUsername: "user"
+  uppmaxPassword: "password"
+  expirationDay: 7
+clients:
+  uppmax:
+    maxLifetime: 24h
+`
+	configName := testhelpers.WriteConfig(suite.T(), confData)
+
+	// Aliases are read into the canonical key, and unknown keys are ignored
+	conf := &Conf{}
+	err := NewConf(conf)
+	assert.NoError(suite.T(), err)
+	assert.Equal(suite.T(), "some-user", conf.EgaUsername)
+	assert.Equal(suite.T(), 14, conf.ExpirationDays)
+
+	effective := EffectiveConfig(conf)
+	assert.Equal(suite.T(), "some-user", effective["global.egaUsername"])
+	assert.Equal(suite.T(), "[REDACTED]", effective["global.egaPassword"])
+	assert.Equal(suite.T(), "[REDACTED]", effective["global.uppmaxPassword"])
+	assert.Equal(suite.T(), "", effective["ldap.bindPassword"])
+	assert.Equal(suite.T(), "336h0m0s", effective["global.maxLifetime"])
+	assert.Equal(suite.T(), map[string]string{"uppmax": "24h0m0s"}, effective["clients"])
+	dump := fmt.Sprint(effective)
+	assert.NotContains(suite.T(), dump, "some-pass")
+	assert.NotContains(suite.T(), dump, "password")
+
+	// The strict mode rejects unknown keys
+	err = os.WriteFile(configName, []byte(confData+"configStrict: true\n"), 0600)
+	assert.NoError(suite.T(), err)
+	err = NewConf(conf)
+	assert.EqualError(suite.T(), err, "unknown configuration keys: global.expirationday")
+
+	err = os.WriteFile(configName, []byte(strings.Replace(confData, "expirationDay:", "expirationDays:", 1)+"configStrict: true\n"), 0600)
+	assert.NoError(suite.T(), err)
+	err = NewConf(conf)
+	assert.NoError(suite.T(), err)
+	assert.Equal(suite.T(), 7, conf.ExpirationDays)
+
+	// A setting can not be given with both its key and an alias
+	err = os.WriteFile(configName, []byte(strings.Replace(confData, "egaUser:", "egaUsername: other-user\n  egaUser:", 1)), 0600)
+	assert.NoError(suite.T(), err)
+	err = NewConf(conf)
+	assert.EqualError(suite.T(), err, "global.egaUser is an alias of global.egaUsername, only one of them can be set")
+
+	// Values read from an alias do not outlive it
+	err = os.WriteFile(configName, []byte(strings.Replace(confData, "  egaUser: \"some-user\"\n", "", 1)), 0600)
+	assert.NoError(suite.T(), err)
+	err = NewConf(conf)
+	assert.EqualError(suite.T(), err, "required configuration field global.egaUsername not set")
+}
+
+func (suite *TestSuite) TestParseCrypt4ghPublicKey() {
+	publicKey, err := os.ReadFile(suite.Crypt4ghKeyPath)
+	assert.NoError(suite.T(), err)
+	key, err := ParseCrypt4ghPublicKey(publicKey)
+	assert.NoError(suite.T(), err)
+	assert.Len(suite.T(), key, 32)
+	assert.Equal(suite.T(), "682f6697fa93eca6c801a232519a09e3fe0c5c339465ee53c3f9edf92fd01f35", Crypt4ghFingerprint([]byte("some-key")))
+
+	// Private keys are refused, whether they are encrypted or not
+	for _, private := range []string{
+		"-----BEGIN CRYPT4GH ENCRYPTED PRIVATE KEY-----\nYzRnaC12MQAGc2NyeXB0ABQAAAAAEH6qYh/xGeglR/UwPlAr0pgAEWNoYWNoYTIwX3BvbHkxMzA1\n-----END CRYPT4GH ENCRYPTED PRIVATE KEY-----\n",
+		"-----BEGIN CRYPT4GH PRIVATE KEY-----\nDiuAlYdpdr7jwCIdeHKwJdXGnUGBVUZwRHO2iMG0O2E=\n-----END CRYPT4GH PRIVATE KEY-----\n",
+	} {
+		_, err = ParseCrypt4ghPublicKey([]byte(private))
+		assert.ErrorContains(suite.T(), err, "is a private key")
+	}
+	for _, passphrase := range []string{"", "pass"} {
+		publicKeyPath, privateKeyPath, err := testhelpers.CreateCrypt4ghKeys(suite.T().TempDir(), []byte(passphrase))
+		assert.NoError(suite.T(), err)
+		_, _, err = readCrypt4ghKey(publicKeyPath)
+		assert.NoError(suite.T(), err)
+		_, _, err = readCrypt4ghKey(privateKeyPath)
+		assert.ErrorContains(suite.T(), err, "is a private key")
+	}
+
+	_, err = ParseCrypt4ghPublicKey([]byte("some random bytes"))
+	assert.EqualError(suite.T(), err, "no PEM block found")
+	_, err = ParseCrypt4ghPublicKey([]byte("-----BEGIN PUBLIC KEY-----\nDiuAlYdpdr7jwCIdeHKwJdXGnUGBVUZwRHO2iMG0O2E=\n-----END PUBLIC KEY-----\n"))
+	assert.EqualError(suite.T(), err, "unexpected PEM block PUBLIC KEY")
+	_, err = ParseCrypt4ghPublicKey([]byte("-----BEGIN CRYPT4GH PUBLIC KEY-----\nc29tZS1rZXk=\n-----END CRYPT4GH PUBLIC KEY-----\n"))
+	assert.EqualError(suite.T(), err, "key is 8 bytes instead of 32")
+
+	// The service does not start with a private key
+	privateKeyPath := suite.TempDir + "/c4gh.sec.pem"
+	err = os.WriteFile(privateKeyPath, []byte("-----BEGIN CRYPT4GH ENCRYPTED PRIVATE KEY-----\nYzRnaC12MQAGc2NyeXB0ABQAAAAAEH6qYh/xGeglR/UwPlAr0pgAEWNoYWNoYTIwX3BvbHkxMzA1\n-----END CRYPT4GH ENCRYPTED PRIVATE KEY-----\n"), 0600)
+	assert.NoError(suite.T(), err)
+	confData := `global:
+  crypt4ghKey: ` + privateKeyPath + `
+  egaUsername: "some-user"
+  egaPassword: "some-pass"
+  egaURL: "http://ega.dev"
+  iss: "https://some.url"
+  jwtKey: "` + suite.PrivateKeyPath + `"
+  suprUsername: "some-user"
+  suprPassword: "some-pass"
+  suprURL: "http://supr.dev"
+  s3url: "some.s3.url"
+  uppmaxUsername: "user"
+  uppmaxPassword: "password"
+`
+	testhelpers.WriteConfig(suite.T(), confData)
+
+	conf := &Conf{}
+	err = NewConf(conf)
+	assert.EqualError(suite.T(), err, "could not parse crypt4gh public key "+privateKeyPath+": CRYPT4GH ENCRYPTED PRIVATE KEY is a private key")
+}
+
+func (suite *TestSuite) TestWatch() {
+	confData := `global:
+  crypt4ghKey: ` + suite.Crypt4ghKeyPath + `
+  egaUsername: "some-user"
+  egaPassword: "some-pass"
+  egaURL: "http://ega.dev"
+  iss: "https://some.url"
+  jwtKey: "` + suite.PrivateKeyPath + `"
+  suprUsername: "some-user"
+  suprPassword: "some-pass"
+  suprURL: "http://supr.dev"
+  s3url: "some.s3.url"
+  uppmaxUsername: "user"
+  uppmaxPassword: "password"
+`
+	configName := testhelpers.WriteConfig(suite.T(), confData)
+
+	conf := &Conf{}
+	assert.NoError(suite.T(), NewConf(conf))
+	assert.Equal(suite.T(), 30*time.Second, conf.ReloadInterval)
+
+	applied := make(chan *Conf)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go Watch(ctx, conf, 10*time.Millisecond, func(next *Conf) error {
+		if next.S3URL == "rejected.s3.url" {
+			return fmt.Errorf("rejected")
+		}
+		applied <- next
+
+		return nil
+	})
+
+	// A changed configuration is applied
+	err := os.WriteFile(configName, []byte(strings.Replace(confData, "egaPassword: \"some-pass\"", "egaPassword: \"new-pass\"", 1)), 0600)
+	assert.NoError(suite.T(), err)
+	select {
+	case next := <-applied:
+		assert.Equal(suite.T(), "new-pass", next.EgaPassword)
+		assert.Equal(suite.T(), []string{"EgaPassword"}, ChangedFields(conf, next))
+	case <-time.After(5 * time.Second):
+		suite.T().Fatal("configuration was not reloaded")
+	}
+
+	// Invalid and rejected configurations are not applied
+	err = os.WriteFile(suite.Crypt4ghKeyPath, []byte("-----BEGIN CRYPT4GH PRIVATE KEY-----\nDiuAlYdpdr7jwCIdeHKwJdXGnUGBVUZwRHO2iMG0O2E=\n-----END CRYPT4GH PRIVATE KEY-----\n"), 0600)
+	assert.NoError(suite.T(), err)
+	select {
+	case <-applied:
+		suite.T().Fatal("invalid configuration was applied")
+	case <-time.After(100 * time.Millisecond):
+	}
+	err = os.WriteFile(configName, []byte(strings.Replace(confData, "some.s3.url", "rejected.s3.url", 1)), 0600)
+	assert.NoError(suite.T(), err)
+	select {
+	case <-applied:
+		suite.T().Fatal("rejected configuration was applied")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	// A changed key file is picked up along with the fixed configuration
+	err = os.WriteFile(suite.Crypt4ghKeyPath, []byte("-----BEGIN CRYPT4GH PUBLIC KEY-----\nXWd0GvGwL14Dt1U6tTzBq6e0IVvyP4oEGEqAOBMZBxo=\n-----END CRYPT4GH PUBLIC KEY-----\n"), 0600)
+	assert.NoError(suite.T(), err)
+	err = os.WriteFile(configName, []byte(confData), 0600)
+	assert.NoError(suite.T(), err)
+	select {
+	case next := <-applied:
+		assert.Equal(suite.T(), "some.s3.url", next.S3URL)
+		assert.NotEqual(suite.T(), conf.Crypt4ghFingerprint, next.Crypt4ghFingerprint)
+	case <-time.After(5 * time.Second):
+		suite.T().Fatal("configuration was not reloaded")
+	}
+
+	// The settings used at startup keep their values until a restart
+	level := log.GetLevel()
+	err = os.WriteFile(configName, []byte(confData+"log:\n  level: debug\n"), 0600)
+	assert.NoError(suite.T(), err)
+	select {
+	case next := <-applied:
+		assert.Empty(suite.T(), next.LogLevel)
+		assert.Equal(suite.T(), level, log.GetLevel())
+	case <-time.After(5 * time.Second):
+		suite.T().Fatal("configuration was not reloaded")
+	}
+
+	// The password files of the clients are watched as well
+	passwordFile := suite.TempDir + "/portal-password"
+	assert.NoError(suite.T(), os.WriteFile(passwordFile, []byte("portal-pass\n"), 0600))
+	err = os.WriteFile(configName, []byte(confData+"clients:\n  portal:\n    passwordFile: "+passwordFile+"\n"), 0600)
+	assert.NoError(suite.T(), err)
+	select {
+	case next := <-applied:
+		assert.Equal(suite.T(), "portal-pass", next.ClientPasswords["portal"])
+	case <-time.After(5 * time.Second):
+		suite.T().Fatal("configuration was not reloaded")
+	}
+	assert.NoError(suite.T(), os.WriteFile(passwordFile, []byte("rotated-pass\n"), 0600))
+	select {
+	case next := <-applied:
+		assert.Equal(suite.T(), "rotated-pass", next.ClientPasswords["portal"])
+	case <-time.After(5 * time.Second):
+		suite.T().Fatal("configuration was not reloaded")
+	}
+}
+
+// TestWatchVault reloads the configuration when the Vault secret is rotated
+func (suite *TestSuite) TestWatchVault() {
+	var mu sync.Mutex
+	password := "vault-ega-password"
+	requests := 0
+	vault := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		requests++
+		_, _ = io.WriteString(w, `{"lease_duration": 1, "data": {"data": {"egaPassword": "`+password+`"}}}`)
+	}))
+	defer vault.Close()
+
+	confData := `global:
+  crypt4ghKey: ` + suite.Crypt4ghKeyPath + `
+  egaUsername: "some-user"
+  egaURL: "http://ega.dev"
+  iss: "https://some.url"
+  jwtKey: "` + suite.PrivateKeyPath + `"
+  suprUsername: "some-user"
+  suprPassword: "some-pass"
+  suprURL: "http://supr.dev"
+  s3url: "some.s3.url"
+  uppmaxUsername: "user"
+  uppmaxPassword: "password"
+vault:
+  addr: ` + vault.URL + `
+  path: sda/uppmax
+  token: some-token
+`
+	testhelpers.WriteConfig(suite.T(), confData)
+
+	conf := &Conf{}
+	assert.NoError(suite.T(), NewConf(conf))
+	assert.Equal(suite.T(), "vault-ega-password", conf.EgaPassword)
+	assert.Equal(suite.T(), 5*time.Minute, conf.VaultInterval)
+	assert.Equal(suite.T(), time.Second, conf.vaultPollInterval())
+
+	applied := make(chan *Conf)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go Watch(ctx, conf, 10*time.Millisecond, func(next *Conf) error {
+		applied <- next
+
+		return nil
+	})
+
+	// The secret is not read again on every check of the files, but when
+	// its lease expires
+	time.Sleep(200 * time.Millisecond)
+	mu.Lock()
+	assert.Equal(suite.T(), 1, requests)
+	password = "rotated-password"
+	mu.Unlock()
+	select {
+	case next := <-applied:
+		assert.Equal(suite.T(), "rotated-password", next.EgaPassword)
+	case <-time.After(5 * time.Second):
+		suite.T().Fatal("configuration was not reloaded")
+	}
+}
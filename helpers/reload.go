@@ -0,0 +1,161 @@
+package helpers
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"os"
+	"reflect"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+// watchedFiles returns the configuration file and the files it refers to,
+// whose changes trigger a reload
+func (conf *Conf) watchedFiles() []string {
+	files := []string{viper.ConfigFileUsed(), conf.JwtKeyPath, conf.Crypt4ghKeyPath, conf.AllowlistPath, conf.ProjectFile}
+	for _, projectKey := range conf.Crypt4ghProjectKeys {
+		files = append(files, projectKey.KeyPath)
+	}
+	for name := range defaultTemplates {
+		files = append(files, viper.GetString("templates."+name))
+	}
+	files = append(files, secretFiles()...)
+
+	return files
+}
+
+// filesHash returns a hash of the contents of files. Files that can not be
+// read count as empty, so that they are reported by the reload.
+func filesHash(files []string) string {
+	hash := sha256.New()
+	for _, file := range files {
+		_, _ = io.WriteString(hash, file+"\x00")
+		if file == "" {
+			continue
+		}
+		content, err := os.ReadFile(file) // #nosec G304 -- the files are given by the operator
+		if err == nil {
+			_, _ = hash.Write(content)
+		}
+		_, _ = io.WriteString(hash, "\x00")
+	}
+
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+// ChangedFields returns the names of the fields that differ between two
+// configurations. Only the names are returned, so that secrets are not logged.
+func ChangedFields(previous, next *Conf) []string {
+	var changed []string
+	previousValue := reflect.ValueOf(previous).Elem()
+	nextValue := reflect.ValueOf(next).Elem()
+	for i := 0; i < previousValue.NumField(); i++ {
+		field := previousValue.Type().Field(i)
+		// templates are compared through their files, which are watched
+		if !field.IsExported() || field.Name == "Templates" {
+			continue
+		}
+		name := field.Name
+		if !reflect.DeepEqual(previousValue.Field(i).Interface(), nextValue.Field(i).Interface()) {
+			changed = append(changed, name)
+		}
+	}
+
+	return changed
+}
+
+// keepRestartSettings sets the settings of next that are only used at
+// startup to their values in previous, which stay in use, and returns the
+// names of those that differed
+func keepRestartSettings(previous, next *Conf) []string {
+	var changed []string
+	previousValue := reflect.ValueOf(previous).Elem()
+	nextValue := reflect.ValueOf(next).Elem()
+	for _, s := range schema {
+		if !s.restart || s.field == "" {
+			continue
+		}
+		field := nextValue.FieldByName(s.field)
+		if !reflect.DeepEqual(previousValue.FieldByName(s.field).Interface(), field.Interface()) {
+			changed = append(changed, s.field)
+			field.Set(previousValue.FieldByName(s.field))
+		}
+	}
+
+	return changed
+}
+
+// Watch polls the configuration file and the files it refers to every
+// interval, and the Vault secret as given by vaultPollInterval, until ctx is
+// cancelled. When any of them changed since conf was read, a new
+// configuration is read and passed to apply. If reading or applying the new
+// configuration fails the configuration in use is kept, and it is read again
+// on the next change. Changes of the settings that are only used at startup,
+// such as the cache backend and the logging, are logged as requiring a
+// restart, and their values in use are kept.
+func Watch(ctx context.Context, conf *Conf, interval time.Duration, apply func(*Conf) error) {
+	if interval <= 0 {
+		return
+	}
+
+	hash, secretHash := conf.filesHash, conf.vaultHash
+	nextVaultCheck := time.Now().Add(conf.vaultPollInterval())
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		newHash, newSecretHash := filesHash(conf.watchedFiles()), secretHash
+		if conf.vaultHash != "" && !time.Now().Before(nextVaultCheck) {
+			var lease time.Duration
+			var err error
+			newSecretHash, lease, err = vaultHash()
+			if err != nil {
+				log.Warnf("could not check the vault secret for changes: %v", err)
+				newSecretHash = secretHash
+			}
+			nextVaultCheck = time.Now().Add(conf.VaultInterval)
+			if lease > 0 {
+				nextVaultCheck = time.Now().Add(lease)
+			}
+		}
+		if newHash == hash && newSecretHash == secretHash {
+			continue
+		}
+		hash, secretHash = newHash, newSecretHash
+
+		next := &Conf{}
+		if err := readConf(next); err != nil {
+			log.Errorf("keeping the current configuration, invalid new configuration: %v", err)
+
+			continue
+		}
+		restartRequired := keepRestartSettings(conf, next)
+		if err := apply(next); err != nil {
+			log.Errorf("keeping the current configuration, failed to apply new configuration: %v", err)
+
+			continue
+		}
+		// the new configuration may refer to other files and another secret
+		hash, secretHash = next.filesHash, next.vaultHash
+		nextVaultCheck = time.Now().Add(next.vaultPollInterval())
+
+		changed := ChangedFields(conf, next)
+		if conf.Crypt4ghFingerprint != next.Crypt4ghFingerprint {
+			log.Infof("crypt4gh public key changed from %s to %s", conf.Crypt4ghFingerprint, next.Crypt4ghFingerprint)
+		}
+		log.Infof("configuration reloaded, changed fields: %v", changed)
+		if len(restartRequired) > 0 {
+			log.Warnf("changed fields %v are only applied after a restart", restartRequired)
+		}
+		conf = next
+	}
+}
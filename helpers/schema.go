@@ -0,0 +1,248 @@
+package helpers
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+// redacted replaces the values of secret settings in the configuration dump
+const redacted = "[REDACTED]"
+
+// setting declares a configuration key
+type setting struct {
+	// key is the canonical key
+	key string
+	// field is the field of Conf holding the effective value, if any
+	field string
+	// aliases are other keys accepted for the setting, kept for compatibility
+	aliases []string
+	// secret settings are redacted in the configuration dump
+	secret bool
+	// prefix settings hold a map, whose entries are keys below the setting,
+	// e.g. clients.<name>.maxLifetime
+	prefix bool
+	// restart settings are only used at startup, so a reload can not apply them
+	restart bool
+}
+
+// schema declares the configuration keys, in the order they are dumped
+var schema = []setting{
+	{key: "configPath"},
+	{key: "configFile"},
+	{key: "configStrict"},
+	{key: "global.accountVerifier", field: "AccountVerifier"},
+	{key: "global.crypt4ghKey", field: "Crypt4ghKeyPath"},
+	{key: "global.egaUsername", field: "EgaUsername", aliases: []string{"global.egaUser"}},
+	{key: "global.egaPassword", field: "EgaPassword", secret: true},
+	{key: "global.egaURL", field: "EgaURL"},
+	{key: "global.expirationDays", field: "ExpirationDays"},
+	{key: "global.iss", field: "Iss"},
+	{key: "global.jwtKey", field: "JwtKeyPath"},
+	{key: "global.maxLifetime", field: "MaxLifetime"},
+	{key: "global.projectRegistries", field: "ProjectRegistries"},
+	{key: "global.suprUsername", field: "SuprUsername", aliases: []string{"global.suprUser"}},
+	{key: "global.suprPassword", field: "SuprPassword", secret: true},
+	{key: "global.suprURL", field: "SuprURL"},
+	{key: "global.s3url", field: "S3URL"},
+	{key: "global.uppmaxUsername", field: "Username", aliases: []string{"global.uppmaxUser"}},
+	{key: "global.uppmaxPassword", field: "Password", secret: true},
+	{key: "clients", field: "ClientMaxLifetimes", prefix: true},
+	{key: "crypt4gh.projectKeys", field: "Crypt4ghProjectKeys"},
+	{key: "ldap.url", field: "LdapURL"},
+	{key: "ldap.bindDN", field: "LdapBindDN"},
+	{key: "ldap.bindPassword", field: "LdapBindPassword", secret: true},
+	{key: "ldap.baseDN", field: "LdapBaseDN"},
+	{key: "ldap.filter", field: "LdapFilter"},
+	{key: "allowlist.file", field: "AllowlistPath"},
+	{key: "projects.file", field: "ProjectFile"},
+	{key: "templates.s3cmd"},
+	{key: "templates.sdaCli"},
+	{key: "templates.rclone"},
+	{key: "templates.aws"},
+	{key: "templates.awsCredentials"},
+	{key: "oauth.userinfoURL", field: "OAuthUserinfoURL"},
+	{key: "oauth.userClaim", field: "OAuthUserClaim"},
+	{key: "vault.addr"},
+	{key: "vault.token", secret: true},
+	{key: "vault.mount"},
+	{key: "vault.path"},
+	{key: "vault.kvVersion"},
+	{key: "vault.interval", field: "VaultInterval"},
+	{key: "reload.interval", field: "ReloadInterval", restart: true},
+	{key: "refresh.lifetime", field: "RefreshLifetime"},
+	{key: "audit.file", field: "AuditFile"},
+	{key: "cache.type", field: "CacheType", restart: true},
+	{key: "cache.redisAddr", field: "CacheRedisAddr", restart: true},
+	{key: "cache.redisPassword", field: "CacheRedisPassword", secret: true, restart: true},
+	{key: "cache.redisDB", field: "CacheRedisDB", restart: true},
+	{key: "cache.positiveTTL", field: "CachePositiveTTL"},
+	{key: "cache.negativeTTL", field: "CacheNegativeTTL"},
+	{key: "upstream.timeout", field: "UpstreamTimeout"},
+	{key: "upstream.retries", field: "UpstreamRetries"},
+	{key: "upstream.backoff", field: "UpstreamBackoff"},
+	{key: "upstream.maxBackoff", field: "UpstreamMaxBackoff"},
+	{key: "upstream.breakerThreshold", field: "BreakerThreshold"},
+	{key: "upstream.breakerCooldown", field: "BreakerCooldown"},
+	{key: "upstream.requestBudget", field: "RequestBudget"},
+	{key: "log.format", field: "LogFormat", restart: true},
+	{key: "log.level", field: "LogLevel", restart: true},
+}
+
+// knownKeys returns the lower case keys that may appear in the configuration,
+// which are the canonical keys, their aliases and the file variants of the
+// secrets, mapped to the canonical key
+func knownKeys() map[string]string {
+	known := make(map[string]string)
+	for _, s := range schema {
+		known[strings.ToLower(s.key)] = s.key
+		for _, alias := range s.aliases {
+			known[strings.ToLower(alias)] = s.key
+		}
+	}
+	for _, key := range fileSettings() {
+		known[strings.ToLower(key+"File")] = key + "File"
+	}
+
+	return known
+}
+
+// unknownKeys returns the keys of the configuration that are not declared
+// in the schema, sorted
+func unknownKeys() []string {
+	known := knownKeys()
+	var unknown []string
+	for _, key := range viper.AllKeys() {
+		if _, ok := known[key]; ok {
+			continue
+		}
+		if !isPrefixKey(key) {
+			unknown = append(unknown, key)
+		}
+	}
+	sort.Strings(unknown)
+
+	return unknown
+}
+
+// isPrefixKey reports whether key is an entry of a prefix setting
+func isPrefixKey(key string) bool {
+	for _, s := range schema {
+		if s.prefix && strings.HasPrefix(key, strings.ToLower(s.key)+".") {
+			return true
+		}
+	}
+
+	return false
+}
+
+// fileSettings returns the settings that can be read from a file given in
+// <setting>File
+func fileSettings() []string {
+	return append([]string{"vault.token"}, secretSettings...)
+}
+
+// aliasOverrides holds the canonical keys set from an alias when the
+// configuration was last read, which are cleared before it is read again
+var aliasOverrides []string
+
+// applyAliases sets the canonical keys of the settings given with an alias.
+// Unknown keys are logged, or rejected if configStrict is set.
+func applyAliases() error {
+	for _, key := range aliasOverrides {
+		viper.Set(key, nil)
+	}
+	aliasOverrides = nil
+
+	for _, s := range schema {
+		for _, alias := range s.aliases {
+			if !viper.IsSet(alias) {
+				continue
+			}
+			if viper.IsSet(s.key) && viper.GetString(s.key) != "" {
+				return fmt.Errorf("%s is an alias of %s, only one of them can be set", alias, s.key)
+			}
+			log.Warnf("configuration key %s is deprecated, use %s", alias, s.key)
+			viper.Set(s.key, viper.Get(alias))
+			aliasOverrides = append(aliasOverrides, s.key)
+		}
+	}
+
+	unknown := unknownKeys()
+	if len(unknown) == 0 {
+		return nil
+	}
+	if viper.GetBool("configStrict") {
+		return fmt.Errorf("unknown configuration keys: %s", strings.Join(unknown, ", "))
+	}
+	for _, key := range unknown {
+		log.Warnf("unknown configuration key %s is ignored", key)
+	}
+
+	return nil
+}
+
+// EffectiveConfig returns the settings in use by conf, keyed by their
+// canonical keys, where the values of secrets are redacted. Settings that are
+// not held in conf are taken as given in the configuration.
+func EffectiveConfig(conf *Conf) map[string]any {
+	effective := make(map[string]any)
+	confValue := reflect.ValueOf(conf).Elem()
+	for _, s := range schema {
+		var value any
+		if s.field != "" {
+			value = confValue.FieldByName(s.field).Interface()
+		} else {
+			value = viper.Get(s.key)
+		}
+		if s.secret {
+			value = redact(value)
+		}
+		effective[s.key] = displayValue(value)
+	}
+	for _, key := range fileSettings() {
+		if file := viper.GetString(key + "File"); file != "" {
+			effective[key+"File"] = file
+		}
+	}
+
+	return effective
+}
+
+// displayValue returns value in a form that reads well when dumped
+func displayValue(value any) any {
+	switch v := value.(type) {
+	case time.Duration:
+		return v.String()
+	case map[string]time.Duration:
+		durations := make(map[string]string, len(v))
+		for name, duration := range v {
+			durations[name] = duration.String()
+		}
+
+		return durations
+	case []Crypt4ghProjectKey:
+		keys := make([]map[string]string, 0, len(v))
+		for _, key := range v {
+			keys = append(keys, map[string]string{"project": key.Pattern, "key": key.KeyPath, "fingerprint": key.Fingerprint})
+		}
+
+		return keys
+	default:
+		return value
+	}
+}
+
+// redact hides the value of a secret, but shows whether it is set
+func redact(value any) any {
+	if value == nil || reflect.ValueOf(value).IsZero() {
+		return ""
+	}
+
+	return redacted
+}
@@ -0,0 +1,300 @@
+package helpers
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+// secretSettings are the settings holding credentials. Each of them can also
+// be read from the file given in <setting>File, or from Vault.
+var secretSettings = []string{
+	"global.uppmaxPassword",
+	"global.egaPassword",
+	"global.suprPassword",
+	"ldap.bindPassword",
+	"cache.redisPassword",
+}
+
+// vaultJwtKey is the field of the Vault secret holding the PEM encoded JWT
+// signing key
+const vaultJwtKey = "jwtKey"
+
+// secrets holds the resolved secret settings and the key material read from Vault
+type secrets struct {
+	settings map[string]string
+	// jwtKey is the PEM encoded JWT signing key from Vault, nil if not given
+	jwtKey []byte
+	// vaultHash is the hash of the Vault secret, empty if Vault is not used
+	vaultHash string
+	// vaultLease is the lease duration of the Vault secret, zero if it has none
+	vaultLease time.Duration
+}
+
+// isSet reports whether the required setting key has a value, either in the
+// configuration or as a secret
+func (s *secrets) isSet(key string) bool {
+	if value, ok := s.settings[key]; ok {
+		return value != ""
+	}
+	if key == "global.jwtKey" && s.jwtKey != nil {
+		return true
+	}
+
+	return viper.IsSet(key) && viper.GetString(key) != ""
+}
+
+// vaultField returns the name of the field of the Vault secret holding the
+// setting key, which is the last element of the key
+func vaultField(key string) string {
+	return key[strings.LastIndex(key, ".")+1:]
+}
+
+// loadSecrets resolves the secret settings. A value given in the
+// configuration takes precedence over the file given in <setting>File, which
+// takes precedence over the Vault secret.
+func loadSecrets() (*secrets, error) {
+	vault, err := newVaultClient()
+	if err != nil {
+		return nil, err
+	}
+	var vaultSecret map[string]string
+	var vaultLease time.Duration
+	if vault != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), vault.client.Timeout)
+		defer cancel()
+		vaultSecret, vaultLease, err = vault.readSecret(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("could not read secrets from vault: %v", err)
+		}
+		log.Infof("read %d fields of secret %s/%s from vault", len(vaultSecret), vault.mount, vault.path)
+	}
+
+	s := &secrets{settings: make(map[string]string), vaultHash: secretHash(vaultSecret), vaultLease: vaultLease}
+	for _, key := range secretSettings {
+		value, err := readSecretSetting(key)
+		if err != nil {
+			return nil, err
+		}
+		if value == "" {
+			value = vaultSecret[vaultField(key)]
+		}
+		s.settings[key] = value
+	}
+	if key, ok := vaultSecret[vaultJwtKey]; ok {
+		s.jwtKey = []byte(key)
+	}
+
+	return s, nil
+}
+
+// readSecretSetting returns the value of the setting key, which is read from
+// the file given in <key>File if that is set
+func readSecretSetting(key string) (string, error) {
+	file := viper.GetString(key + "File")
+	if file == "" {
+		return viper.GetString(key), nil
+	}
+	if viper.GetString(key) != "" {
+		return "", fmt.Errorf("only one of %s and %sFile can be set", key, key)
+	}
+
+	content, err := os.ReadFile(filepath.Clean(file))
+	if err != nil {
+		return "", fmt.Errorf("could not read %sFile: %v", key, err)
+	}
+
+	return strings.TrimRight(string(content), "\r\n"), nil
+}
+
+// secretFiles returns the files the secrets are read from, including the
+// password files of the clients
+func secretFiles() []string {
+	var files []string
+	for _, key := range fileSettings() {
+		files = append(files, viper.GetString(key+"File"))
+	}
+	clients := make([]string, 0, len(viper.GetStringMap("clients")))
+	for client := range viper.GetStringMap("clients") {
+		clients = append(clients, client)
+	}
+	sort.Strings(clients)
+	for _, client := range clients {
+		files = append(files, viper.GetString("clients."+client+".passwordFile"))
+	}
+
+	return files
+}
+
+// vaultClient reads a secret from the KV secrets engine of HashiCorp Vault
+type vaultClient struct {
+	addr      string
+	token     string
+	mount     string
+	path      string
+	kvVersion int
+	client    *http.Client
+}
+
+// newVaultClient returns a client for the Vault configured in vault.*, or nil
+// if vault.addr is not set
+func newVaultClient() (*vaultClient, error) {
+	if viper.GetString("vault.addr") == "" {
+		return nil, nil
+	}
+
+	token, err := readSecretSetting("vault.token")
+	if err != nil {
+		return nil, err
+	}
+	if token == "" {
+		return nil, fmt.Errorf("required configuration field vault.token not set")
+	}
+	if viper.GetString("vault.path") == "" {
+		return nil, fmt.Errorf("required configuration field vault.path not set")
+	}
+
+	v := &vaultClient{
+		addr:      strings.TrimRight(viper.GetString("vault.addr"), "/"),
+		token:     token,
+		mount:     strings.Trim(viper.GetString("vault.mount"), "/"),
+		path:      strings.Trim(viper.GetString("vault.path"), "/"),
+		kvVersion: 2,
+		client:    &http.Client{Timeout: 10 * time.Second},
+	}
+	if v.mount == "" {
+		v.mount = "secret"
+	}
+	if viper.IsSet("vault.kvVersion") {
+		v.kvVersion = viper.GetInt("vault.kvVersion")
+	}
+	if v.kvVersion != 1 && v.kvVersion != 2 {
+		return nil, fmt.Errorf("vault.kvVersion %d is not supported", v.kvVersion)
+	}
+
+	return v, nil
+}
+
+// readSecret returns the fields of the configured secret and its lease
+// duration, which is zero if the secret has none
+func (v *vaultClient) readSecret(ctx context.Context) (map[string]string, time.Duration, error) {
+	url := v.addr + "/v1/" + v.mount + "/" + v.path
+	if v.kvVersion == 2 {
+		url = v.addr + "/v1/" + v.mount + "/data/" + v.path
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return nil, 0, err
+	}
+	req.Header.Set("X-Vault-Token", v.token)
+	resp, err := v.client.Do(req)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		message, _ := io.ReadAll(resp.Body)
+
+		return nil, 0, fmt.Errorf("got %v from vault: %s", resp.StatusCode, strings.TrimSpace(string(message)))
+	}
+
+	var secret struct {
+		Data          json.RawMessage `json:"data"`
+		LeaseDuration int64           `json:"lease_duration"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&secret); err != nil {
+		return nil, 0, err
+	}
+	data := secret.Data
+	if v.kvVersion == 2 {
+		// version 2 nests the fields along with the metadata of the version
+		var versioned struct {
+			Data json.RawMessage `json:"data"`
+		}
+		if err := json.Unmarshal(data, &versioned); err != nil {
+			return nil, 0, err
+		}
+		data = versioned.Data
+	}
+
+	var fields map[string]any
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return nil, 0, err
+	}
+	if fields == nil {
+		return nil, 0, fmt.Errorf("secret %s/%s has no data", v.mount, v.path)
+	}
+	values := make(map[string]string, len(fields))
+	for name, value := range fields {
+		text, ok := value.(string)
+		if !ok {
+			return nil, 0, fmt.Errorf("field %s of secret %s/%s is not a string", name, v.mount, v.path)
+		}
+		values[name] = text
+	}
+
+	return values, time.Duration(secret.LeaseDuration) * time.Second, nil
+}
+
+// secretHash returns a hash of the fields of a Vault secret, or an empty
+// string if there is no secret
+func secretHash(secret map[string]string) string {
+	if secret == nil {
+		return ""
+	}
+	names := make([]string, 0, len(secret))
+	for name := range secret {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	hash := sha256.New()
+	for _, name := range names {
+		_, _ = io.WriteString(hash, name+"\x00"+secret[name]+"\x00")
+	}
+
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+// vaultHash reads the configured Vault secret again and returns its hash, so
+// that rotated secrets are detected, along with its lease duration. It returns
+// an empty string if Vault is not used.
+func vaultHash() (string, time.Duration, error) {
+	vault, err := newVaultClient()
+	if err != nil || vault == nil {
+		return "", 0, err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), vault.client.Timeout)
+	defer cancel()
+	secret, lease, err := vault.readSecret(ctx)
+	if err != nil {
+		return "", 0, fmt.Errorf("could not read secrets from vault: %v", err)
+	}
+
+	return secretHash(secret), lease, nil
+}
+
+// vaultPollInterval returns how often the Vault secret is read again to detect
+// rotated secrets: when its lease expires, or every vault.interval for secrets
+// without a lease
+func (conf *Conf) vaultPollInterval() time.Duration {
+	if conf.vaultLease > 0 {
+		return conf.vaultLease
+	}
+
+	return conf.VaultInterval
+}
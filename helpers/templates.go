@@ -0,0 +1,126 @@
+package helpers
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"text/template"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+// TemplateData holds the variables available in the client configuration templates
+type TemplateData struct {
+	// Username is the user the token is issued for
+	Username string
+	// AccessKey is the username in the form used as S3 access and secret key
+	AccessKey string
+	// Token is the access token
+	Token string
+	// Host is the host of the S3 inbox
+	Host string
+	// Endpoint is the URL of the S3 inbox
+	Endpoint string
+	// Project is the requested project
+	Project string
+	// Expiry is the expiration time of the token
+	Expiry time.Time
+}
+
+// s3cmdTemplate is the built-in template of the s3cmd style configuration,
+// which is also used by sda-cli
+const s3cmdTemplate = `guess_mime_type = True
+human_readable_sizes = True
+use_https = True
+multipart_chunk_size_mb = 50
+check_ssl_certificate = True
+check_ssl_hostname = True
+encoding = UTF-8
+encrypt = False
+socket_timeout = 30
+secret_key = {{.AccessKey}}
+access_key = {{.AccessKey}}
+access_token = {{.Token}}
+host_base = {{.Host}}
+host_bucket = {{.Host}}`
+
+// defaultTemplates holds the built-in client configuration templates
+var defaultTemplates = map[string]string{
+	"s3cmd":  s3cmdTemplate,
+	"sdaCli": s3cmdTemplate,
+	"rclone": `[sda]
+type = s3
+provider = Other
+env_auth = false
+access_key_id = {{.AccessKey}}
+secret_access_key = {{.AccessKey}}
+session_token = {{.Token}}
+endpoint = {{.Endpoint}}
+force_path_style = true
+chunk_size = 50Mi
+upload_cutoff = 50Mi
+`,
+	"aws": `[profile sda]
+endpoint_url = {{.Endpoint}}
+s3 =
+    addressing_style = path
+    multipart_threshold = 50MB
+    multipart_chunksize = 50MB
+`,
+	"awsCredentials": `[sda]
+aws_access_key_id = {{.AccessKey}}
+aws_secret_access_key = {{.AccessKey}}
+aws_session_token = {{.Token}}
+`,
+}
+
+// loadTemplates parses the client configuration templates, using the file
+// configured in templates.<name> if set and the built-in template otherwise.
+// Every template is executed once with sample data so that references to
+// unknown fields of TemplateData are caught at startup.
+func loadTemplates() (map[string]*template.Template, error) {
+	templates := make(map[string]*template.Template)
+	for name := range defaultTemplates {
+		tmpl, err := loadTemplate(name)
+		if err != nil {
+			return nil, err
+		}
+		templates[name] = tmpl
+	}
+
+	return templates, nil
+}
+
+// loadTemplate parses and tries out the template called name
+func loadTemplate(name string) (*template.Template, error) {
+	text := defaultTemplates[name]
+	if path := viper.GetString("templates." + name); path != "" {
+		content, err := os.ReadFile(filepath.Clean(path))
+		if err != nil {
+			return nil, fmt.Errorf("could not read template %s: %v", name, err)
+		}
+		text = string(content)
+	}
+
+	tmpl, err := template.New(name).Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("could not parse template %s: %v", name, err)
+	}
+
+	sample := TemplateData{
+		Username:  "user@example.org",
+		AccessKey: "user_example.org",
+		Token:     "token",
+		Host:      "s3.example.org",
+		Endpoint:  "https://s3.example.org",
+		Project:   "project",
+		Expiry:    time.Now(),
+	}
+	if err := tmpl.Execute(io.Discard, sample); err != nil {
+		return nil, fmt.Errorf("invalid template %s: %v", name, err)
+	}
+
+	return tmpl, nil
+}
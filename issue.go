@@ -0,0 +1,119 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/NBISweden/sda-uppmax-integration/helpers"
+	"github.com/NBISweden/sda-uppmax-integration/token"
+)
+
+// issue creates a client configuration for an account and a project with the
+// configuration of the service and writes it to a local file, for operators
+// handing out tokens when the service or the pilot can not be used. With
+// -override the account and the project are not verified, which is recorded
+// in the token and requires audit.file. Every token is recorded in the audit
+// trail.
+func issue(args []string, stdout, stderr io.Writer) int {
+	flags := flag.NewFlagSet("issue", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	swamID := flags.String("swamid", "", "account the token is issued to")
+	projectID := flags.String("project", "", "project the token is issued for")
+	ttl := flags.Duration("ttl", 0, "lifetime of the token, defaults to global.expirationDays and is bounded by global.maxLifetime")
+	format := flags.String("format", "s3cmd", "format of the client configuration")
+	output := flags.String("output", "", "file the client configuration is written to, defaults to <project>.<format>.conf")
+	override := flags.Bool("override", false, "issue the token without verifying the account and the project, requires audit.file")
+	reason := flags.String("reason", "", "why the token is issued, required with -override")
+	operator := flags.String("operator", os.Getenv("USER"), "person issuing the token")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if *swamID == "" || *projectID == "" {
+		fmt.Fprintln(stderr, "error: -swamid and -project are required")
+
+		return 2
+	}
+	if *operator == "" {
+		fmt.Fprintln(stderr, "error: -operator is required when USER is not set")
+
+		return 2
+	}
+	if *output == "" {
+		*output = *projectID + "." + *format + ".conf"
+	}
+	credentials := *output + ".credentials"
+	// the token is recorded once issued, so the files are checked beforehand
+	for _, path := range []string{*output, credentials} {
+		if _, err := os.Stat(path); err == nil {
+			fmt.Fprintf(stderr, "error: %s already exists\n", path)
+
+			return 1
+		}
+	}
+
+	conf := &helpers.Conf{}
+	if err := helpers.NewConf(conf); err != nil {
+		fmt.Fprintf(stderr, "error: %v\n", err)
+
+		return 1
+	}
+	service, err := token.NewService(conf, nil, nil)
+	if err != nil {
+		fmt.Fprintf(stderr, "error: %v\n", err)
+
+		return 1
+	}
+
+	issued, err := service.Issue(context.Background(), token.IssueRequest{
+		SwamID:    *swamID,
+		ProjectID: *projectID,
+		Format:    *format,
+		Lifetime:  *ttl,
+		Override:  *override,
+		Operator:  *operator,
+		Reason:    *reason,
+	})
+	if err != nil {
+		fmt.Fprintf(stderr, "error: %v\n", err)
+
+		return 1
+	}
+
+	if err := writeNewFile(*output, issued.Config, 0600); err != nil {
+		fmt.Fprintf(stderr, "error: %v\n", err)
+
+		return 1
+	}
+	fmt.Fprintf(stdout, "wrote the %s configuration to %s, valid until %s\n", *format, *output, issued.ExpiresAt.Format(time.RFC3339))
+	if issued.Credentials != "" {
+		if err := writeNewFile(credentials, issued.Credentials, 0600); err != nil {
+			fmt.Fprintf(stderr, "error: %v\n", err)
+
+			return 1
+		}
+		fmt.Fprintf(stdout, "wrote the credentials to %s\n", credentials)
+	}
+
+	return 0
+}
+
+// writeNewFile writes content to a file with the permissions perm, which
+// must not exist already
+func writeNewFile(path, content string, perm os.FileMode) error {
+	file, err := os.OpenFile(filepath.Clean(path), os.O_CREATE|os.O_EXCL|os.O_WRONLY, perm)
+	if err != nil {
+		return err
+	}
+	if _, err := io.WriteString(file, content); err != nil {
+		file.Close()
+
+		return err
+	}
+
+	return file.Close()
+}
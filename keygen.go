@@ -0,0 +1,135 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/NBISweden/sda-uppmax-integration/helpers"
+	"github.com/NBISweden/sda-uppmax-integration/keys"
+)
+
+// keygen generates a signing key, written as <out>.pem along with the public
+// key in <out>.pub.pem and <out>.jwk.json, or a crypt4gh key pair, written as
+// <out>.sec.pem and <out>.pub.pem. The crypt4gh private key is encrypted with
+// C4GH_PASSPHRASE if it is set. Existing files are not overwritten.
+func keygen(args []string, stdout, stderr io.Writer) int {
+	flags := flag.NewFlagSet("keygen", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	keyType := flags.String("type", "ec", "type of the key, one of ec, rsa, ed25519 and crypt4gh")
+	out := flags.String("out", "", "prefix of the files the keys are written to, defaults to jwt, or c4gh for crypt4gh keys")
+	bits := flags.Int("bits", 2048, "size of rsa keys")
+	keep := flags.Bool("keep", false, "do nothing if the private key exists")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if *out == "" {
+		*out = "jwt"
+		if *keyType == "crypt4gh" {
+			*out = "c4gh"
+		}
+	}
+
+	privatePath := *out + ".pem"
+	if *keyType == "crypt4gh" {
+		privatePath = *out + ".sec.pem"
+	}
+	if _, err := os.Stat(privatePath); err == nil && *keep {
+		fmt.Fprintf(stdout, "%s exists, keeping it\n", privatePath)
+
+		return 0
+	}
+
+	var files []keyFile
+	var summary string
+	var err error
+	if *keyType == "crypt4gh" {
+		files, summary, err = crypt4ghKeyFiles(*out)
+	} else {
+		files, summary, err = signingKeyFiles(*keyType, *bits, *out)
+	}
+	if err != nil {
+		fmt.Fprintf(stderr, "error: %v\n", err)
+
+		return 1
+	}
+
+	for _, file := range files {
+		if _, err := os.Stat(file.path); err == nil {
+			fmt.Fprintf(stderr, "error: %s already exists\n", file.path)
+
+			return 1
+		}
+	}
+	for _, file := range files {
+		if err := writeNewFile(file.path, string(file.content), file.perm); err != nil {
+			fmt.Fprintf(stderr, "error: %v\n", err)
+
+			return 1
+		}
+		fmt.Fprintf(stdout, "wrote %s\n", file.path)
+	}
+	fmt.Fprintln(stdout, summary)
+
+	return 0
+}
+
+// keyFile is a file written by keygen
+type keyFile struct {
+	path    string
+	content []byte
+	perm    os.FileMode
+}
+
+// signingKeyFiles generates a signing key of keyType and returns its files
+// along with a description of the key
+func signingKeyFiles(keyType string, bits int, out string) ([]keyFile, string, error) {
+	key, err := keys.GenerateSigningKey(keyType, bits)
+	if err != nil {
+		return nil, "", err
+	}
+	private, err := key.PrivatePEM()
+	if err != nil {
+		return nil, "", err
+	}
+	public, err := key.PublicPEM()
+	if err != nil {
+		return nil, "", err
+	}
+	jwk, err := key.JWK()
+	if err != nil {
+		return nil, "", err
+	}
+	jwkJSON, err := json.MarshalIndent(jwk, "", "  ")
+	if err != nil {
+		return nil, "", err
+	}
+	summary := fmt.Sprintf("generated %s key with key id %s", key.Algorithm, key.KeyID)
+
+	return []keyFile{
+		{path: out + ".pem", content: private, perm: 0600},
+		{path: out + ".pub.pem", content: public, perm: 0644},
+		{path: out + ".jwk.json", content: append(jwkJSON, '\n'), perm: 0644},
+	}, summary, nil
+}
+
+// crypt4ghKeyFiles generates a crypt4gh key pair and returns its files along
+// with a description of the key
+func crypt4ghKeyFiles(out string) ([]keyFile, string, error) {
+	pair, err := keys.GenerateCrypt4ghKeyPair()
+	if err != nil {
+		return nil, "", err
+	}
+	private, err := pair.PrivatePEM([]byte(os.Getenv("C4GH_PASSPHRASE")))
+	if err != nil {
+		return nil, "", err
+	}
+	summary := fmt.Sprintf("generated crypt4gh key pair with fingerprint %s", helpers.Crypt4ghFingerprint(pair.Private.PublicKey().Bytes()))
+
+	return []keyFile{
+		{path: out + ".sec.pem", content: private, perm: 0600},
+		{path: out + ".pub.pem", content: pair.PublicPEM(), perm: 0644},
+	}, summary, nil
+}
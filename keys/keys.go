@@ -0,0 +1,216 @@
+// Package keys generates the keys used by the service and its tests: signing
+// keys for the tokens, identified by a key id, and crypt4gh key pairs.
+package keys
+
+import (
+	"crypto"
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+
+	b64 "encoding/base64"
+
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/scrypt"
+)
+
+// SigningKey is a private key for signing tokens along with its key id
+type SigningKey struct {
+	// Algorithm is the JWS algorithm of the key, one of ES256, RS256 and EdDSA
+	Algorithm string
+	Private   crypto.Signer
+	// KeyID is the JWK thumbprint of the public key (RFC 7638)
+	KeyID string
+}
+
+// GenerateSigningKey generates a signing key of keyType, which is one of ec
+// (P-256), rsa and ed25519. bits is the size of RSA keys, 2048 if zero.
+func GenerateSigningKey(keyType string, bits int) (*SigningKey, error) {
+	key := &SigningKey{}
+	var err error
+	switch keyType {
+	case "ec":
+		key.Algorithm = "ES256"
+		key.Private, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	case "rsa":
+		if bits == 0 {
+			bits = 2048
+		}
+		if bits < 2048 {
+			return nil, fmt.Errorf("rsa keys must have at least 2048 bits")
+		}
+		key.Algorithm = "RS256"
+		key.Private, err = rsa.GenerateKey(rand.Reader, bits)
+	case "ed25519":
+		key.Algorithm = "EdDSA"
+		_, key.Private, err = ed25519.GenerateKey(rand.Reader)
+	default:
+		return nil, fmt.Errorf("key type %s is not supported", keyType)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	jwk, err := publicJWK(key.Private.Public())
+	if err != nil {
+		return nil, err
+	}
+	key.KeyID, err = thumbprint(jwk)
+	if err != nil {
+		return nil, err
+	}
+
+	return key, nil
+}
+
+// PrivatePEM returns the private key in PKCS #8 form under a PRIVATE KEY header
+func (k *SigningKey) PrivatePEM() ([]byte, error) {
+	der, err := x509.MarshalPKCS8PrivateKey(k.Private)
+	if err != nil {
+		return nil, err
+	}
+
+	return pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), nil
+}
+
+// PublicPEM returns the public key in PKIX form under a PUBLIC KEY header
+func (k *SigningKey) PublicPEM() ([]byte, error) {
+	der, err := x509.MarshalPKIXPublicKey(k.Private.Public())
+	if err != nil {
+		return nil, err
+	}
+
+	return pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}), nil
+}
+
+// JWK returns the public key as a JSON Web Key holding the key id
+func (k *SigningKey) JWK() (map[string]string, error) {
+	jwk, err := publicJWK(k.Private.Public())
+	if err != nil {
+		return nil, err
+	}
+	jwk["kid"] = k.KeyID
+	jwk["alg"] = k.Algorithm
+	jwk["use"] = "sig"
+
+	return jwk, nil
+}
+
+// publicJWK returns the members of the JSON Web Key of public that make up
+// its thumbprint
+func publicJWK(public crypto.PublicKey) (map[string]string, error) {
+	encode := b64.RawURLEncoding.EncodeToString
+	switch key := public.(type) {
+	case *ecdsa.PublicKey:
+		ecdhKey, err := key.ECDH()
+		if err != nil {
+			return nil, err
+		}
+		// the uncompressed point is 0x04 followed by x and y
+		point := ecdhKey.Bytes()
+		size := (len(point) - 1) / 2
+
+		return map[string]string{"kty": "EC", "crv": key.Curve.Params().Name, "x": encode(point[1 : 1+size]), "y": encode(point[1+size:])}, nil
+	case *rsa.PublicKey:
+		exponent := binary.BigEndian.AppendUint32(nil, uint32(key.E))
+		for len(exponent) > 1 && exponent[0] == 0 {
+			exponent = exponent[1:]
+		}
+
+		return map[string]string{"kty": "RSA", "n": encode(key.N.Bytes()), "e": encode(exponent)}, nil
+	case ed25519.PublicKey:
+		return map[string]string{"kty": "OKP", "crv": "Ed25519", "x": encode(key)}, nil
+	default:
+		return nil, fmt.Errorf("unsupported public key %T", public)
+	}
+}
+
+// thumbprint returns the JWK thumbprint of jwk, which is the hash of its
+// members in lexicographic order. encoding/json sorts the keys of maps.
+func thumbprint(jwk map[string]string) (string, error) {
+	members, err := json.Marshal(jwk)
+	if err != nil {
+		return "", err
+	}
+	hash := sha256.Sum256(members)
+
+	return b64.RawURLEncoding.EncodeToString(hash[:]), nil
+}
+
+// crypt4ghMagic starts the private keys in the crypt4gh format
+const crypt4ghMagic = "c4gh-v1"
+
+// Crypt4ghKeyPair is an X25519 key pair for crypt4gh
+type Crypt4ghKeyPair struct {
+	Private *ecdh.PrivateKey
+}
+
+// GenerateCrypt4ghKeyPair generates a crypt4gh key pair
+func GenerateCrypt4ghKeyPair() (*Crypt4ghKeyPair, error) {
+	private, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Crypt4ghKeyPair{Private: private}, nil
+}
+
+// PublicPEM returns the public key under a CRYPT4GH PUBLIC KEY header
+func (k *Crypt4ghKeyPair) PublicPEM() []byte {
+	return pem.EncodeToMemory(&pem.Block{Type: "CRYPT4GH PUBLIC KEY", Bytes: k.Private.PublicKey().Bytes()})
+}
+
+// PrivatePEM returns the private key in the crypt4gh format. With a
+// passphrase the key is encrypted with ChaCha20-Poly1305, using a key derived
+// with scrypt, under a CRYPT4GH ENCRYPTED PRIVATE KEY header.
+func (k *Crypt4ghKeyPair) PrivatePEM(passphrase []byte) ([]byte, error) {
+	key := []byte(crypt4ghMagic)
+	if len(passphrase) == 0 {
+		key = appendString(key, []byte("none"))
+		key = appendString(key, []byte("none"))
+		key = appendString(key, k.Private.Bytes())
+
+		return pem.EncodeToMemory(&pem.Block{Type: "CRYPT4GH PRIVATE KEY", Bytes: key}), nil
+	}
+
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	derived, err := scrypt.Key(passphrase, salt, 1<<14, 8, 1, chacha20poly1305.KeySize)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := chacha20poly1305.New(derived)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, chacha20poly1305.NonceSize)
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+
+	// the options of the key derivation are the rounds, unused by scrypt, and the salt
+	key = appendString(key, []byte("scrypt"))
+	key = appendString(key, append(binary.BigEndian.AppendUint32(nil, 0), salt...))
+	key = appendString(key, []byte("chacha20_poly1305"))
+	key = appendString(key, aead.Seal(nonce, nonce, k.Private.Bytes(), nil))
+
+	return pem.EncodeToMemory(&pem.Block{Type: "CRYPT4GH ENCRYPTED PRIVATE KEY", Bytes: key}), nil
+}
+
+// appendString appends value to key, preceded by its length as two bytes
+func appendString(key, value []byte) []byte {
+	key = binary.BigEndian.AppendUint16(key, uint16(len(value)))
+
+	return append(key, value...)
+}
@@ -0,0 +1,149 @@
+package keys
+
+import (
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/pem"
+	"testing"
+
+	"github.com/NBISweden/sda-uppmax-integration/helpers"
+	"github.com/golang-jwt/jwt"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/suite"
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/scrypt"
+)
+
+type KeysTestSuite struct {
+	suite.Suite
+}
+
+func TestKeysTestSuite(t *testing.T) {
+	suite.Run(t, new(KeysTestSuite))
+}
+
+func (suite *KeysTestSuite) TestSigningKeys() {
+	for keyType, algorithm := range map[string]string{"ec": "ES256", "rsa": "RS256", "ed25519": "EdDSA"} {
+		key, err := GenerateSigningKey(keyType, 0)
+		assert.NoError(suite.T(), err, keyType)
+		assert.Equal(suite.T(), algorithm, key.Algorithm)
+		assert.Len(suite.T(), key.KeyID, 43)
+
+		privatePEM, err := key.PrivatePEM()
+		assert.NoError(suite.T(), err)
+		block, _ := pem.Decode(privatePEM)
+		assert.Equal(suite.T(), "PRIVATE KEY", block.Type)
+		private, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		assert.NoError(suite.T(), err)
+		assert.Equal(suite.T(), key.Private, private)
+
+		publicPEM, err := key.PublicPEM()
+		assert.NoError(suite.T(), err)
+		block, _ = pem.Decode(publicPEM)
+		assert.Equal(suite.T(), "PUBLIC KEY", block.Type)
+		public, err := x509.ParsePKIXPublicKey(block.Bytes)
+		assert.NoError(suite.T(), err)
+		assert.Equal(suite.T(), key.Private.Public(), public)
+
+		jwk, err := key.JWK()
+		assert.NoError(suite.T(), err)
+		assert.Equal(suite.T(), key.KeyID, jwk["kid"])
+		assert.Equal(suite.T(), algorithm, jwk["alg"])
+	}
+
+	// The service reads the EC keys
+	key, err := GenerateSigningKey("ec", 0)
+	assert.NoError(suite.T(), err)
+	privatePEM, _ := key.PrivatePEM()
+	parsed, err := jwt.ParseECPrivateKeyFromPEM(privatePEM)
+	assert.NoError(suite.T(), err)
+	assert.Equal(suite.T(), key.Private, parsed)
+	jwk, _ := key.JWK()
+	assert.Equal(suite.T(), "P-256", jwk["crv"])
+	assert.Len(suite.T(), jwk["x"], 43)
+	assert.Len(suite.T(), jwk["y"], 43)
+
+	key, err = GenerateSigningKey("rsa", 3072)
+	assert.NoError(suite.T(), err)
+	assert.Equal(suite.T(), 3072, key.Private.(*rsa.PrivateKey).N.BitLen())
+
+	_, err = GenerateSigningKey("rsa", 1024)
+	assert.EqualError(suite.T(), err, "rsa keys must have at least 2048 bits")
+	_, err = GenerateSigningKey("dsa", 0)
+	assert.EqualError(suite.T(), err, "key type dsa is not supported")
+}
+
+// TestThumbprint checks the key id against the example of RFC 7638
+func (suite *KeysTestSuite) TestThumbprint() {
+	kid, err := thumbprint(map[string]string{
+		"kty": "RSA",
+		"n":   "0vx7agoebGcQSuuPiLJXZptN9nndrQmbXEps2aiAFbWhM78LhWx4cbbfAAtVT86zwu1RK7aPFFxuhDR1L6tSoc_BJECPebWKRXjBZCiFV4n3oknjhMstn64tZ_2W-5JsGY4Hc5n9yBXArwl93lqt7_RN5w6Cf0h4QyQ5v-65YGjQR0_FDW2QvzqY368QQMicAtaSqzs8KJZgnYb9c7d0zgdAZHzu6qMQvRL5hajrn1n91CbOpbISD08qNLyrdkt-bFTWhAI4vMQFh6WeZu0fM4lFd2NcRwr3XPksINHaQ-G_xBniIqbw0Ls1jF44-csFCur-kEgU8awapJzKnqDKgw",
+		"e":   "AQAB",
+	})
+	assert.NoError(suite.T(), err)
+	assert.Equal(suite.T(), "NzbLsXh8uDCcd-6MNwXF4W_7noWXFZAfHkxZsRGC9Xs", kid)
+
+	// The exponent is encoded without leading zeros
+	key, err := GenerateSigningKey("rsa", 0)
+	assert.NoError(suite.T(), err)
+	jwk, _ := publicJWK(key.Private.Public())
+	assert.Equal(suite.T(), "AQAB", jwk["e"])
+
+	_, err = publicJWK(&ecdsa.PrivateKey{})
+	assert.EqualError(suite.T(), err, "unsupported public key *ecdsa.PrivateKey")
+}
+
+// readString returns the length prefixed string at the start of key and the rest of key
+func readString(key []byte) ([]byte, []byte) {
+	length := binary.BigEndian.Uint16(key)
+
+	return key[2 : 2+length], key[2+length:]
+}
+
+func (suite *KeysTestSuite) TestCrypt4ghKeyPair() {
+	pair, err := GenerateCrypt4ghKeyPair()
+	assert.NoError(suite.T(), err)
+
+	public, err := helpers.ParseCrypt4ghPublicKey(pair.PublicPEM())
+	assert.NoError(suite.T(), err)
+	assert.Equal(suite.T(), pair.Private.PublicKey().Bytes(), public)
+
+	// Without a passphrase the key is stored as is
+	privatePEM, err := pair.PrivatePEM(nil)
+	assert.NoError(suite.T(), err)
+	block, _ := pem.Decode(privatePEM)
+	assert.Equal(suite.T(), "CRYPT4GH PRIVATE KEY", block.Type)
+	assert.Equal(suite.T(), "c4gh-v1", string(block.Bytes[:7]))
+	kdf, rest := readString(block.Bytes[7:])
+	assert.Equal(suite.T(), "none", string(kdf))
+	cipher, rest := readString(rest)
+	assert.Equal(suite.T(), "none", string(cipher))
+	private, rest := readString(rest)
+	assert.Equal(suite.T(), pair.Private.Bytes(), private)
+	assert.Empty(suite.T(), rest)
+
+	// With a passphrase the key is encrypted
+	privatePEM, err = pair.PrivatePEM([]byte("pass"))
+	assert.NoError(suite.T(), err)
+	block, _ = pem.Decode(privatePEM)
+	assert.Equal(suite.T(), "CRYPT4GH ENCRYPTED PRIVATE KEY", block.Type)
+	kdf, rest = readString(block.Bytes[7:])
+	assert.Equal(suite.T(), "scrypt", string(kdf))
+	options, rest := readString(rest)
+	assert.Len(suite.T(), options, 20)
+	cipher, rest = readString(rest)
+	assert.Equal(suite.T(), "chacha20_poly1305", string(cipher))
+	encrypted, rest := readString(rest)
+	assert.Empty(suite.T(), rest)
+
+	derived, err := scrypt.Key([]byte("pass"), options[4:], 1<<14, 8, 1, chacha20poly1305.KeySize)
+	assert.NoError(suite.T(), err)
+	aead, err := chacha20poly1305.New(derived)
+	assert.NoError(suite.T(), err)
+	nonce := encrypted[:chacha20poly1305.NonceSize]
+	private, err = aead.Open(nil, nonce, encrypted[chacha20poly1305.NonceSize:], nil)
+	assert.NoError(suite.T(), err)
+	assert.Equal(suite.T(), pair.Private.Bytes(), private)
+}
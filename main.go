@@ -1,10 +1,17 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
 	"fmt"
+	"net"
 	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
 	"time"
 
+	"github.com/NBISweden/sda-uppmax-integration/cache"
 	"github.com/NBISweden/sda-uppmax-integration/helpers"
 	"github.com/NBISweden/sda-uppmax-integration/token"
 	log "github.com/sirupsen/logrus"
@@ -15,26 +22,78 @@ func ping(w http.ResponseWriter, _ *http.Request) {
 }
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] != "serve" {
+		os.Exit(runCommand(os.Args[1], os.Args[2:]))
+	}
 
-	err := helpers.NewConf(&helpers.Config)
+	conf := &helpers.Conf{}
+	err := helpers.NewConf(conf)
+	if err != nil {
+		log.Fatal(err)
+	}
+	effective, _ := json.Marshal(helpers.EffectiveConfig(conf))
+	log.Infof("effective configuration: %s", effective)
+
+	store, err := cache.New(conf.CacheType, conf.CacheRedisAddr, conf.CacheRedisPassword, conf.CacheRedisDB)
+	if err != nil {
+		log.Fatal(err)
+	}
+	// refresh tokens are kept apart from the cached lookups in memory, so that
+	// they are stored even if lookups are not cached and are never evicted to
+	// make room for lookups, while redis shares them between the replicas
+	var refreshStore cache.Store = cache.NewUnboundedMemoryStore()
+	if conf.CacheType == "redis" {
+		refreshStore = store
+	}
+	service, err := token.NewService(conf, store, refreshStore)
 	if err != nil {
 		log.Fatal(err)
 	}
 
 	servicePort := 8080
 
-	http.HandleFunc("/token", helpers.BasicAuth(token.GetToken))
-	http.HandleFunc("/ping", ping)
+	mux := http.NewServeMux()
+	service.Register(mux)
+	mux.HandleFunc("/ping", ping)
+
+	// The requests derive their context from baseCtx, so that pending calls
+	// to the external services are cancelled when the server shuts down
+	baseCtx, cancelRequests := context.WithCancel(context.Background())
+	defer cancelRequests()
+
+	// Reload the configuration when the configuration file or the key files change
+	go helpers.Watch(baseCtx, conf, conf.ReloadInterval, service.Reload)
 
 	server := &http.Server{
 		Addr:              fmt.Sprintf(":%v", servicePort),
+		Handler:           mux,
 		ReadTimeout:       30 * time.Second,
 		WriteTimeout:      30 * time.Second,
 		IdleTimeout:       30 * time.Second,
 		ReadHeaderTimeout: 30 * time.Second,
+		BaseContext:       func(net.Listener) context.Context { return baseCtx },
 	}
 
+	shutdownDone := make(chan struct{})
+	go func() {
+		defer close(shutdownDone)
+		sigc := make(chan os.Signal, 1)
+		signal.Notify(sigc, syscall.SIGINT, syscall.SIGTERM)
+		<-sigc
+
+		log.Info("Shutting down server")
+		cancelRequests()
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		if err := server.Shutdown(ctx); err != nil {
+			log.Errorf("failed to shut down server: %v", err)
+		}
+	}()
+
 	log.Infof("Starting server at port %v", servicePort)
-	log.Fatal(server.ListenAndServe())
+	if err := server.ListenAndServe(); err != http.ErrServerClosed {
+		log.Fatal(err)
+	}
+	<-shutdownDone
 
 }
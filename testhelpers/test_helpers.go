@@ -1,36 +1,96 @@
 package testhelpers
 
 import (
-	"crypto/ecdsa"
-	"crypto/elliptic"
-	"crypto/rand"
-	"crypto/x509"
-	"encoding/pem"
 	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/NBISweden/sda-uppmax-integration/keys"
+	"gopkg.in/yaml.v3"
 )
 
-// CreateECkeys creates the EC key pair
+// CreateECkeys creates an EC private key in PKCS #8 form and returns its path
 func CreateECkeys(path string) (string, error) {
-	privatekey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	key, err := keys.GenerateSigningKey("ec", 0)
+	if err != nil {
+		return "", err
+	}
+	privatePem, err := key.PrivatePEM()
 	if err != nil {
 		return "", err
 	}
 
 	// dump private key to file
-	privateKeyBytes, _ := x509.MarshalECPrivateKey(privatekey)
-	privateKeyBlock := &pem.Block{
-		Type:  "PRIVATE KEY",
-		Bytes: privateKeyBytes,
-	}
 	prKeyPath := path + "/dummy.ec.pem"
-	privatePem, err := os.Create(prKeyPath)
-	if err != nil {
+	if err := os.WriteFile(prKeyPath, privatePem, 0600); err != nil {
 		return "", err
 	}
-	err = pem.Encode(privatePem, privateKeyBlock)
+
+	return prKeyPath, nil
+}
+
+// CreateCrypt4ghKeys creates a crypt4gh key pair, where the private key is
+// encrypted with passphrase if given, and returns the paths of the public and
+// the private key
+func CreateCrypt4ghKeys(path string, passphrase []byte) (string, string, error) {
+	pair, err := keys.GenerateCrypt4ghKeyPair()
+	if err != nil {
+		return "", "", err
+	}
+	privatePem, err := pair.PrivatePEM(passphrase)
 	if err != nil {
-		return "", err
+		return "", "", err
 	}
 
-	return prKeyPath, nil
+	publicKeyPath := path + "/dummy.c4gh.pub.pem"
+	if err := os.WriteFile(publicKeyPath, pair.PublicPEM(), 0600); err != nil {
+		return "", "", err
+	}
+	privateKeyPath := path + "/dummy.c4gh.sec.pem"
+	if err := os.WriteFile(privateKeyPath, privatePem, 0600); err != nil {
+		return "", "", err
+	}
+
+	return publicKeyPath, privateKeyPath, nil
+}
+
+// WriteConfig writes confData to a configuration file in a temporary
+// directory, which is read instead of config.yaml in the working directory
+// until the test ends, and returns its path
+func WriteConfig(t testing.TB, confData string) string {
+	t.Helper()
+	configFile := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(configFile, []byte(confData), 0600); err != nil {
+		t.Fatalf("failed to write temp config file, %v", err)
+	}
+	t.Setenv("CONFIGFILE", configFile)
+
+	return configFile
+}
+
+// WriteSettings writes the settings, keyed by their dotted names such as
+// global.iss, to a configuration file like WriteConfig
+func WriteSettings(t testing.TB, settings map[string]any) string {
+	t.Helper()
+	confData := make(map[string]any)
+	for key, value := range settings {
+		parts := strings.Split(key, ".")
+		section := confData
+		for _, part := range parts[:len(parts)-1] {
+			next, ok := section[part].(map[string]any)
+			if !ok {
+				next = make(map[string]any)
+				section[part] = next
+			}
+			section = next
+		}
+		section[parts[len(parts)-1]] = value
+	}
+	content, err := yaml.Marshal(confData)
+	if err != nil {
+		t.Fatalf("failed to marshal config settings, %v", err)
+	}
+
+	return WriteConfig(t, string(content))
 }
@@ -0,0 +1,90 @@
+package token
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/NBISweden/sda-uppmax-integration/helpers"
+)
+
+// AccountVerifier checks that a user has an account that tokens can be issued for
+type AccountVerifier interface {
+	// VerifyAccount returns nil if `username` is a valid account and an
+	// error otherwise
+	VerifyAccount(ctx context.Context, username string) error
+}
+
+// newAccountVerifier returns the account verifier selected in the configuration
+func (st *state) newAccountVerifier(conf *helpers.Conf) (AccountVerifier, error) {
+	switch conf.AccountVerifier {
+	case "", "ega":
+		return NewEGAVerifier(conf.EgaURL, conf.EgaUsername, conf.EgaPassword, st.newUpstreamClient("EGA", conf)), nil
+	case "ldap":
+		return NewLDAPVerifier(LDAPOptions{
+			URL:          conf.LdapURL,
+			BindDN:       conf.LdapBindDN,
+			BindPassword: conf.LdapBindPassword,
+			BaseDN:       conf.LdapBaseDN,
+			Filter:       conf.LdapFilter,
+			Timeout:      conf.UpstreamTimeout,
+		})
+	case "allowlist":
+		return NewAllowlistVerifier(conf.AllowlistPath)
+	default:
+		return nil, fmt.Errorf("unknown account verifier %s", conf.AccountVerifier)
+	}
+}
+
+// verifyAccount checks `username` with the configured account verifier.
+// The result is cached.
+func (st *state) verifyAccount(ctx context.Context, username string) error {
+	_, err := st.cachedLookup(ctx, accountCacheKey(username), func() (string, error) {
+		return "", st.accountVerifier.VerifyAccount(ctx, username)
+	})
+
+	return err
+}
+
+// AllowlistVerifier accepts the accounts listed in a file
+type AllowlistVerifier struct {
+	accounts map[string]bool
+}
+
+// NewAllowlistVerifier reads the allowed accounts from the file at path,
+// which contains one account per line. Empty lines and lines starting with
+// # are ignored.
+func NewAllowlistVerifier(path string) (*AllowlistVerifier, error) {
+	file, err := os.Open(filepath.Clean(path))
+	if err != nil {
+		return nil, fmt.Errorf("could not read account allowlist: %v", err)
+	}
+	defer file.Close()
+
+	verifier := &AllowlistVerifier{accounts: make(map[string]bool)}
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		verifier.accounts[line] = true
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("could not read account allowlist: %v", err)
+	}
+
+	return verifier, nil
+}
+
+// VerifyAccount implements AccountVerifier
+func (v *AllowlistVerifier) VerifyAccount(_ context.Context, username string) error {
+	if !v.accounts[username] {
+		return &deniedError{message: "account not in allowlist"}
+	}
+
+	return nil
+}
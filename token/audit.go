@@ -0,0 +1,76 @@
+package token
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// auditRecord is the entry of the audit trail for an issued token
+type auditRecord struct {
+	Time string `json:"time"`
+	// Source is how the token was issued, one of token, refresh, oauth and cli
+	Source    string `json:"source"`
+	SwamID    string `json:"swamid"`
+	ProjectID string `json:"projectid"`
+	Client    string `json:"client,omitempty"`
+	IssuedAt  string `json:"issued_at"`
+	ExpiresAt string `json:"expires_at"`
+	// Override is set for tokens issued without verifying the account and the project
+	Override bool   `json:"override,omitempty"`
+	Operator string `json:"operator,omitempty"`
+	Reason   string `json:"reason,omitempty"`
+}
+
+// auditMutex serializes the writes to the audit file
+var auditMutex sync.Mutex
+
+// audit records an issued token in the audit trail, which is the log and, if
+// audit.file is set, the file holding one JSON record per line
+func (st *state) audit(record auditRecord) error {
+	record.Time = time.Now().UTC().Format(time.RFC3339)
+	line, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	log.Infof("audit: %s", line)
+
+	if st.conf.AuditFile == "" {
+		return nil
+	}
+
+	auditMutex.Lock()
+	defer auditMutex.Unlock()
+	file, err := os.OpenFile(filepath.Clean(st.conf.AuditFile), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return fmt.Errorf("could not open audit file: %v", err)
+	}
+	if _, err := file.Write(append(line, '\n')); err != nil {
+		file.Close()
+
+		return fmt.Errorf("could not write audit file: %v", err)
+	}
+
+	return file.Close()
+}
+
+// auditIssued records a token issued by the service. A failure to write the
+// audit file is logged, but does not fail the request.
+func (st *state) auditIssued(source, swamID, projectID, client string, issuedAt, expiresAt time.Time) {
+	err := st.audit(auditRecord{
+		Source:    source,
+		SwamID:    swamID,
+		ProjectID: projectID,
+		Client:    client,
+		IssuedAt:  issuedAt.UTC().Format(time.RFC3339),
+		ExpiresAt: expiresAt.UTC().Format(time.RFC3339),
+	})
+	if err != nil {
+		log.Errorf("failed to record token in the audit trail: %v", err)
+	}
+}
@@ -0,0 +1,125 @@
+package token
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/NBISweden/sda-uppmax-integration/helpers"
+	log "github.com/sirupsen/logrus"
+)
+
+// prefixes of the cached values marking a positive or negative lookup result
+const (
+	cacheAllowed = "allowed:"
+	cacheDenied  = "denied:"
+)
+
+// deniedError is returned when an upstream gives a definitive negative answer,
+// as opposed to a transient failure, so that the answer can be cached
+type deniedError struct {
+	message string
+	err     error
+}
+
+func (e *deniedError) Error() string {
+	return e.message
+}
+
+func (e *deniedError) Unwrap() error {
+	return e.err
+}
+
+func accountCacheKey(username string) string {
+	return "account:" + username
+}
+
+func projectCacheKey(username, projectID string) string {
+	return "project:" + username + ":" + projectID
+}
+
+// cachedLookup returns the cached result for key if there is one and otherwise
+// runs lookup and caches its result. A successful lookup returns a value, which
+// is cached along with the positive result. Only successes and denials are
+// cached, other errors are returned to the caller as is.
+func (st *state) cachedLookup(ctx context.Context, key string, lookup func() (string, error)) (string, error) {
+	if st.lookupCache == nil {
+		return lookup()
+	}
+
+	cached, found, err := st.lookupCache.Get(ctx, key)
+	if err != nil {
+		log.Warnf("failed to read %v from cache: %v", key, err)
+	}
+	if found {
+		log.Debugf("cache hit for %v", key)
+		if strings.HasPrefix(cached, cacheAllowed) {
+			return strings.TrimPrefix(cached, cacheAllowed), nil
+		}
+
+		return "", &deniedError{message: strings.TrimPrefix(cached, cacheDenied)}
+	}
+
+	value, err := lookup()
+
+	var denied *deniedError
+	switch {
+	case err == nil:
+		if cacheErr := st.lookupCache.Set(ctx, key, cacheAllowed+value, st.conf.CachePositiveTTL); cacheErr != nil {
+			log.Warnf("failed to cache %v: %v", key, cacheErr)
+		}
+	case errors.As(err, &denied):
+		if cacheErr := st.lookupCache.Set(ctx, key, cacheDenied+denied.message, st.conf.CacheNegativeTTL); cacheErr != nil {
+			log.Warnf("failed to cache %v: %v", key, cacheErr)
+		}
+	}
+
+	return value, err
+}
+
+// FlushCache removes cached lookups. If the swamid query parameter is given
+// only the entries of that user are removed, otherwise the whole cache is flushed.
+func (s *Service) FlushCache(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	if r.Method != http.MethodDelete {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		fmt.Fprintln(w, string(helpers.CreateErrorResponse("Method not allowed")))
+
+		return
+	}
+
+	if s.lookupCache == nil {
+		w.WriteHeader(http.StatusNoContent)
+
+		return
+	}
+
+	swamID := strings.ReplaceAll(r.URL.Query().Get("swamid"), "\n", "")
+	swamID = strings.ReplaceAll(swamID, "\r", "")
+
+	var err error
+	if swamID == "" {
+		// the store may be shared with the refresh tokens, which are kept
+		err = s.lookupCache.Flush(r.Context(), "account:")
+		if err == nil {
+			err = s.lookupCache.Flush(r.Context(), "project:")
+		}
+	} else {
+		err = s.lookupCache.Delete(r.Context(), accountCacheKey(swamID))
+		if err == nil {
+			err = s.lookupCache.Flush(r.Context(), projectCacheKey(swamID, ""))
+		}
+	}
+	if err != nil {
+		log.Errorf("failed to flush cache: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintln(w, string(helpers.CreateErrorResponse("Failed to flush cache")))
+
+		return
+	}
+	log.Infof("flushed cached lookups for '%v'", swamID)
+
+	w.WriteHeader(http.StatusNoContent)
+}
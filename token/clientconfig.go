@@ -0,0 +1,79 @@
+package token
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/NBISweden/sda-uppmax-integration/helpers"
+)
+
+// defaultFormat is the output format used when none is requested
+const defaultFormat = "s3cmd"
+
+// clientConfig holds the files of a client configuration. Credentials is
+// only set for clients that keep them in a separate file.
+type clientConfig struct {
+	Config      string
+	Credentials string
+}
+
+// outputFormat names the templates used for the files of an output format
+type outputFormat struct {
+	config      string
+	credentials string
+}
+
+// outputFormats holds the supported output formats
+var outputFormats = map[string]outputFormat{
+	// s3cmd style configuration, which is also used by sda-cli
+	"s3cmd":   {config: "s3cmd"},
+	"sda-cli": {config: "sdaCli"},
+	// rclone remote, where the token is passed as the session token
+	"rclone": {config: "rclone"},
+	// AWS CLI and boto3 profile, made up of a shared config file and a
+	// credentials file holding the token as the session token
+	"aws": {config: "aws", credentials: "awsCredentials"},
+}
+
+// renderClientConfig renders the templates of the given output format
+func (st *state) renderClientConfig(format string, data helpers.TemplateData) (clientConfig, error) {
+	var config clientConfig
+	output, ok := outputFormats[format]
+	if !ok {
+		return config, fmt.Errorf("unsupported format %s", format)
+	}
+
+	var err error
+	config.Config, err = st.renderTemplate(output.config, data)
+	if err != nil {
+		return config, err
+	}
+	if output.credentials != "" {
+		config.Credentials, err = st.renderTemplate(output.credentials, data)
+	}
+
+	return config, err
+}
+
+func (st *state) renderTemplate(name string, data helpers.TemplateData) (string, error) {
+	tmpl, ok := st.conf.Templates[name]
+	if !ok {
+		return "", fmt.Errorf("template %s not loaded", name)
+	}
+
+	var rendered strings.Builder
+	if err := tmpl.Execute(&rendered, data); err != nil {
+		return "", fmt.Errorf("could not render template %s: %v", name, err)
+	}
+
+	return rendered.String(), nil
+}
+
+// endpointURL returns host as an https URL, unless it already has a scheme
+func endpointURL(host string) string {
+	if strings.Contains(host, "://") {
+		return host
+	}
+
+	return "https://" + host
+}
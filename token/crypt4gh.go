@@ -0,0 +1,123 @@
+package token
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	b64 "encoding/base64"
+
+	"github.com/NBISweden/sda-uppmax-integration/helpers"
+	log "github.com/sirupsen/logrus"
+)
+
+// crypt4ghKey describes a crypt4gh public key
+type crypt4ghKey struct {
+	Project     string `json:"project,omitempty"`
+	PEM         string `json:"pem"`
+	Key         string `json:"key"`
+	Fingerprint string `json:"fingerprint"`
+}
+
+// crypt4ghKeysResponse lists the global crypt4gh public key and the keys of
+// the projects that encrypt to a different key
+type crypt4ghKeysResponse struct {
+	Key         crypt4ghKey   `json:"key"`
+	ProjectKeys []crypt4ghKey `json:"project_keys"`
+}
+
+// newCrypt4ghKey describes the base64 encoded PEM key, used for project
+func newCrypt4ghKey(project, encodedKey string) (crypt4ghKey, error) {
+	pemKey, err := b64.StdEncoding.DecodeString(encodedKey)
+	if err != nil {
+		return crypt4ghKey{}, err
+	}
+	key, err := helpers.ParseCrypt4ghPublicKey(pemKey)
+	if err != nil {
+		return crypt4ghKey{}, err
+	}
+
+	return crypt4ghKey{
+		Project:     project,
+		PEM:         string(pemKey),
+		Key:         b64.StdEncoding.EncodeToString(key),
+		Fingerprint: helpers.Crypt4ghFingerprint(key),
+	}, nil
+}
+
+// crypt4ghKeys returns the crypt4gh public keys to publish. With a project
+// only the key resolved for that project is returned.
+func (st *state) crypt4ghKeys(project string) (any, error) {
+	if project != "" {
+		return newCrypt4ghKey(project, st.conf.Crypt4ghKeyFor(project))
+	}
+
+	global, err := newCrypt4ghKey("", st.conf.Crypt4ghKey)
+	if err != nil {
+		return nil, err
+	}
+	response := crypt4ghKeysResponse{Key: global, ProjectKeys: []crypt4ghKey{}}
+	for _, projectKey := range st.conf.Crypt4ghProjectKeys {
+		key, err := newCrypt4ghKey(projectKey.Pattern, projectKey.Key)
+		if err != nil {
+			return nil, err
+		}
+		response.ProjectKeys = append(response.ProjectKeys, key)
+	}
+
+	return response, nil
+}
+
+// GetCrypt4ghKey returns the crypt4gh public keys in PEM and raw base64 form
+// along with their fingerprints. The project query parameter selects the key
+// used for a single project. The response has an ETag, so that clients can
+// cache the keys and revalidate them with If-None-Match.
+func (s *Service) GetCrypt4ghKey(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		fmt.Fprintln(w, string(helpers.CreateErrorResponse("Method not allowed")))
+
+		return
+	}
+
+	project := strings.ReplaceAll(r.URL.Query().Get("project"), "\n", "")
+	project = strings.ReplaceAll(project, "\r", "")
+
+	keys, err := s.current.Load().crypt4ghKeys(project)
+	if err != nil {
+		log.Errorf("failed to describe crypt4gh keys: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintln(w, string(helpers.CreateErrorResponse("Unable to read crypt4gh key")))
+
+		return
+	}
+	response, _ := json.Marshal(keys)
+
+	hash := sha256.Sum256(response)
+	etag := `"` + hex.EncodeToString(hash[:]) + `"`
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Cache-Control", "no-cache")
+	if matchesETag(r.Header.Get("If-None-Match"), etag) {
+		w.WriteHeader(http.StatusNotModified)
+
+		return
+	}
+
+	fmt.Fprint(w, string(response))
+}
+
+// matchesETag reports whether the If-None-Match header matches etag
+func matchesETag(ifNoneMatch, etag string) bool {
+	for _, candidate := range strings.Split(ifNoneMatch, ",") {
+		candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+		if candidate == "*" || candidate == etag {
+			return true
+		}
+	}
+
+	return false
+}
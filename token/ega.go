@@ -1,13 +1,14 @@
 package token
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
 	"net/http"
-	"time"
+	"net/url"
 
-	"github.com/NBISweden/sda-uppmax-integration/helpers"
+	"github.com/NBISweden/sda-uppmax-integration/upstream"
 	log "github.com/sirupsen/logrus"
 )
 
@@ -40,26 +41,34 @@ type EgaReply struct {
 	Response EgaResponse `json:"response"`
 }
 
-// verifyEGABoxAccount checks that a given `username` is a valid EGA account, and
-// returns error if the user does not exist.
-func verifyEGABoxAccount(username string) error {
+// EGAVerifier verifies accounts against the EGA box user API
+type EGAVerifier struct {
+	url      string
+	username string
+	password string
+	client   *upstream.Client
+}
+
+// NewEGAVerifier returns a verifier querying the EGA user API at url with
+// the given credentials
+func NewEGAVerifier(url, username, password string, client *upstream.Client) *EGAVerifier {
+	return &EGAVerifier{url: url, username: username, password: password, client: client}
+}
 
-	egaUser := helpers.Config.EgaUsername
-	egaPass := helpers.Config.EgaPassword
-	egaURL := helpers.Config.EgaURL
+// VerifyAccount checks that a given `username` is a valid EGA account, and
+// returns error if the user does not exist.
+func (v *EGAVerifier) VerifyAccount(ctx context.Context, username string) error {
 
-	url := fmt.Sprintf("%v/%v", egaURL, username)
+	// the username is a single path segment, whatever it contains
+	endpoint := fmt.Sprintf("%v/%v", v.url, url.PathEscape(username))
 
-	client := &http.Client{
-		Timeout: 5 * time.Second,
-	}
-	req, err := http.NewRequest("GET", url, nil)
+	req, err := http.NewRequestWithContext(ctx, "GET", endpoint, nil)
 	if err != nil {
 
 		return err
 	}
-	req.SetBasicAuth(egaUser, egaPass)
-	resp, err := client.Do(req)
+	req.SetBasicAuth(v.username, v.password)
+	resp, err := v.client.Do(req)
 	if err != nil {
 
 		return err
@@ -73,6 +82,10 @@ func verifyEGABoxAccount(username string) error {
 		}
 		defer resp.Body.Close()
 
+		if resp.StatusCode == http.StatusNotFound {
+			return &deniedError{message: fmt.Sprintf("got %v from EGA", message)}
+		}
+
 		return fmt.Errorf("got %v from EGA", message)
 	}
 
@@ -0,0 +1,121 @@
+package token
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	b64 "encoding/base64"
+
+	"github.com/golang-jwt/jwt"
+)
+
+// IssueRequest describes a token issued by an operator without a request to
+// the service
+type IssueRequest struct {
+	SwamID    string
+	ProjectID string
+	// Format of the client configuration, s3cmd if empty
+	Format string
+	// Lifetime of the token, global.expirationDays if zero, which is bounded
+	// by global.maxLifetime. The token is not issued to a client, so the
+	// limits of clients.<name>.maxLifetime do not apply.
+	Lifetime time.Duration
+	// Override skips the verification of the account and the project, and
+	// sets the override claim of the token. It requires audit.file, so that
+	// the override is kept beyond the log.
+	Override bool
+	// Operator is the person issuing the token
+	Operator string
+	// Reason is why the token is issued, required for an override
+	Reason string
+}
+
+// IssuedConfig holds the client configuration of an issued token
+type IssuedConfig struct {
+	Config string
+	// Credentials is only set for formats keeping them in a separate file
+	Credentials string
+	ExpiresAt   time.Time
+}
+
+// Issue creates the token and the client configuration for request. Unless
+// the request is an override, the account and the project are verified as
+// for the token endpoint. The configuration is only returned once the token
+// has been recorded in the audit trail.
+func (s *Service) Issue(ctx context.Context, request IssueRequest) (IssuedConfig, error) {
+	st := s.current.Load()
+
+	switch {
+	case request.SwamID == "" || request.ProjectID == "":
+		return IssuedConfig{}, fmt.Errorf("the account and the project are required")
+	case request.Operator == "":
+		return IssuedConfig{}, fmt.Errorf("the operator is required")
+	case request.Override && request.Reason == "":
+		return IssuedConfig{}, fmt.Errorf("an override requires a reason")
+	case request.Override && st.conf.AuditFile == "":
+		return IssuedConfig{}, fmt.Errorf("an override requires audit.file to be set")
+	case request.Lifetime < 0:
+		return IssuedConfig{}, fmt.Errorf("invalid lifetime %v", request.Lifetime)
+	}
+	if request.Format == "" {
+		request.Format = defaultFormat
+	}
+
+	var project Project
+	var extra jwt.MapClaims
+	if request.Override {
+		extra = jwt.MapClaims{"override": true}
+	} else {
+		ctx, cancel := context.WithTimeout(ctx, st.conf.RequestBudget)
+		defer cancel()
+		var accountErr, projectErr error
+		project, accountErr, projectErr = st.verifyRequest(ctx, request.SwamID, request.ProjectID)
+		if accountErr != nil {
+			return IssuedConfig{}, fmt.Errorf("%v is not a valid account: %v", request.SwamID, accountErr)
+		}
+		if projectErr != nil {
+			return IssuedConfig{}, fmt.Errorf("%v is not authorized for project %v: %v", request.SwamID, request.ProjectID, projectErr)
+		}
+	}
+
+	issuedAt := time.Now().UTC().Truncate(time.Second)
+	// without a client only global.maxLifetime bounds the lifetime
+	expiresAt := st.tokenExpiry(issuedAt, request.Lifetime, "", project)
+	if !expiresAt.After(issuedAt) {
+		return IssuedConfig{}, fmt.Errorf("project %v ended at %v", request.ProjectID, project.EndDate)
+	}
+
+	s3config, credentials, _, err := st.createS3Config(request.SwamID, "", request.ProjectID, request.Format, issuedAt, expiresAt, extra)
+	if err != nil {
+		return IssuedConfig{}, err
+	}
+	config, err := b64.StdEncoding.DecodeString(s3config)
+	if err != nil {
+		return IssuedConfig{}, err
+	}
+	issued := IssuedConfig{Config: string(config), ExpiresAt: expiresAt}
+	if credentials != "" {
+		decoded, err := b64.StdEncoding.DecodeString(credentials)
+		if err != nil {
+			return IssuedConfig{}, err
+		}
+		issued.Credentials = string(decoded)
+	}
+
+	err = st.audit(auditRecord{
+		Source:    "cli",
+		SwamID:    request.SwamID,
+		ProjectID: request.ProjectID,
+		IssuedAt:  issuedAt.Format(time.RFC3339),
+		ExpiresAt: expiresAt.Format(time.RFC3339),
+		Override:  request.Override,
+		Operator:  request.Operator,
+		Reason:    request.Reason,
+	})
+	if err != nil {
+		return IssuedConfig{}, fmt.Errorf("could not record the token in the audit trail: %v", err)
+	}
+
+	return issued, nil
+}
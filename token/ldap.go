@@ -0,0 +1,132 @@
+package token
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/NBISweden/sda-uppmax-integration/upstream"
+	"github.com/go-ldap/ldap/v3"
+	log "github.com/sirupsen/logrus"
+)
+
+// ldapConn holds the LDAP operations used by the LDAPVerifier, which allows
+// replacing the server with a stub in the tests
+type ldapConn interface {
+	Bind(username, password string) error
+	Search(searchRequest *ldap.SearchRequest) (*ldap.SearchResult, error)
+	Close() error
+}
+
+// LDAPOptions describes the LDAP server and how accounts are looked up
+type LDAPOptions struct {
+	URL          string
+	BindDN       string
+	BindPassword string
+	BaseDN       string
+	// Filter is the search filter, where %s is replaced with the escaped username
+	Filter  string
+	Timeout time.Duration
+}
+
+// LDAPVerifier verifies accounts by searching an LDAP directory
+type LDAPVerifier struct {
+	options LDAPOptions
+	dial    func(timeout time.Duration) (ldapConn, error)
+}
+
+// NewLDAPVerifier returns a verifier searching the directory described by
+// options. The filter must contain %s exactly once, and no other verbs.
+func NewLDAPVerifier(options LDAPOptions) (*LDAPVerifier, error) {
+	if options.Filter == "" {
+		options.Filter = "(mail=%s)"
+	}
+	verbs := strings.ReplaceAll(options.Filter, "%%", "")
+	if strings.Count(verbs, "%") != 1 || strings.Count(verbs, "%s") != 1 {
+		return nil, fmt.Errorf("ldap filter %q must contain %%s exactly once", options.Filter)
+	}
+
+	return &LDAPVerifier{
+		options: options,
+		dial: func(timeout time.Duration) (ldapConn, error) {
+			conn, err := ldap.DialURL(options.URL, ldap.DialWithDialer(&net.Dialer{Timeout: timeout}))
+			if err != nil {
+				return nil, err
+			}
+			conn.SetTimeout(timeout)
+
+			return conn, nil
+		},
+	}, nil
+}
+
+// VerifyAccount implements AccountVerifier
+func (v *LDAPVerifier) VerifyAccount(ctx context.Context, username string) error {
+	if err := ctx.Err(); err != nil {
+		return upstream.WrapTimeout("LDAP", err)
+	}
+
+	// the LDAP operations must finish within the deadline of the request
+	timeout := v.options.Timeout
+	if deadline, ok := ctx.Deadline(); ok && (timeout <= 0 || time.Until(deadline) < timeout) {
+		timeout = time.Until(deadline)
+	}
+
+	conn, err := v.dial(timeout)
+	if err != nil {
+		return fmt.Errorf("could not connect to LDAP: %w", upstream.WrapTimeout("LDAP", err))
+	}
+	defer conn.Close()
+
+	// the LDAP client does not support contexts, so the connection is closed
+	// to interrupt pending operations when the request is cancelled
+	stop := context.AfterFunc(ctx, func() { _ = conn.Close() })
+	defer stop()
+
+	if v.options.BindDN != "" {
+		if err := conn.Bind(v.options.BindDN, v.options.BindPassword); err != nil {
+			return fmt.Errorf("could not bind to LDAP: %w", upstream.WrapTimeout("LDAP", err))
+		}
+	}
+
+	result, err := conn.Search(ldap.NewSearchRequest(
+		v.options.BaseDN,
+		ldap.ScopeWholeSubtree,
+		ldap.NeverDerefAliases,
+		2,
+		searchTimeLimit(timeout),
+		false,
+		fmt.Sprintf(v.options.Filter, ldap.EscapeFilter(username)),
+		[]string{"dn"},
+		nil,
+	))
+	if ldap.IsErrorWithCode(err, ldap.LDAPResultSizeLimitExceeded) {
+		return &deniedError{message: "account is ambiguous in LDAP"}
+	}
+	if err != nil {
+		return fmt.Errorf("LDAP search failed: %w", upstream.WrapTimeout("LDAP", err))
+	}
+
+	switch len(result.Entries) {
+	case 0:
+		return &deniedError{message: "account not found in LDAP"}
+	case 1:
+		log.Debugf("found %v in LDAP as %v", username, result.Entries[0].DN)
+
+		return nil
+	default:
+		return &deniedError{message: "account is ambiguous in LDAP"}
+	}
+}
+
+// searchTimeLimit returns the time limit in seconds of a search bounded by
+// timeout. The limit is rounded up, since zero means no limit to the server.
+func searchTimeLimit(timeout time.Duration) int {
+	if timeout <= 0 {
+		return 0
+	}
+
+	return int((timeout + time.Second - 1) / time.Second)
+}
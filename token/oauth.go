@@ -0,0 +1,274 @@
+package token
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/NBISweden/sda-uppmax-integration/helpers"
+	"github.com/NBISweden/sda-uppmax-integration/upstream"
+	log "github.com/sirupsen/logrus"
+)
+
+// grant and token types of OAuth 2.0 token exchange, RFC 8693
+const (
+	grantTypeTokenExchange = "urn:ietf:params:oauth:grant-type:token-exchange"
+	tokenTypeAccessToken   = "urn:ietf:params:oauth:token-type:access_token"
+	tokenTypeJWT           = "urn:ietf:params:oauth:token-type:jwt"
+)
+
+// SubjectVerifier validates the subject tokens presented in token exchanges
+type SubjectVerifier interface {
+	// VerifySubjectToken returns the user the subject token was issued for
+	VerifySubjectToken(ctx context.Context, subjectToken string) (string, error)
+}
+
+// newSubjectVerifier returns the verifier configured in conf, or nil if token
+// exchange is not configured
+func (st *state) newSubjectVerifier(conf *helpers.Conf) SubjectVerifier {
+	if conf.OAuthUserinfoURL == "" {
+		return nil
+	}
+
+	return NewUserinfoVerifier(conf.OAuthUserinfoURL, conf.OAuthUserClaim, st.newUpstreamClient("userinfo", conf))
+}
+
+// UserinfoVerifier validates subject tokens with the OpenID Connect userinfo
+// endpoint of their issuer, e.g. LS-AAI
+type UserinfoVerifier struct {
+	url    string
+	claim  string
+	client *upstream.Client
+}
+
+// NewUserinfoVerifier returns a verifier calling the userinfo endpoint at url,
+// where the user is identified by claim
+func NewUserinfoVerifier(url, claim string, client *upstream.Client) *UserinfoVerifier {
+	return &UserinfoVerifier{url: url, claim: claim, client: client}
+}
+
+// VerifySubjectToken returns the user identified by the configured claim of
+// the userinfo of subjectToken. A token rejected by the userinfo endpoint
+// gives a deniedError.
+func (v *UserinfoVerifier) VerifySubjectToken(ctx context.Context, subjectToken string) (string, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", v.url, nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Authorization", "Bearer "+subjectToken)
+	resp, err := v.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden {
+		return "", &deniedError{message: fmt.Sprintf("subject token rejected with %v", resp.StatusCode)}
+	}
+	if resp.StatusCode != http.StatusOK {
+		message, _ := io.ReadAll(resp.Body)
+
+		return "", fmt.Errorf("got %v from userinfo", message)
+	}
+
+	var userinfo map[string]any
+	if err := json.NewDecoder(resp.Body).Decode(&userinfo); err != nil {
+		return "", err
+	}
+	username, _ := userinfo[v.claim].(string)
+	if username == "" {
+		return "", &deniedError{message: fmt.Sprintf("userinfo has no %s claim", v.claim)}
+	}
+
+	return username, nil
+}
+
+// oauthError is the error response of the OAuth 2.0 token endpoint
+type oauthError struct {
+	Error       string `json:"error"`
+	Description string `json:"error_description,omitempty"`
+}
+
+// tokenExchangeResponse is the response of a successful token exchange
+type tokenExchangeResponse struct {
+	AccessToken     string `json:"access_token"`
+	IssuedTokenType string `json:"issued_token_type"`
+	TokenType       string `json:"token_type"`
+	ExpiresIn       int64  `json:"expires_in"`
+	Scope           string `json:"scope"`
+}
+
+// writeOAuthError writes an OAuth 2.0 error response
+func writeOAuthError(w http.ResponseWriter, status int, code, description string) {
+	response, _ := json.Marshal(oauthError{Error: code, Description: description})
+	w.WriteHeader(status)
+	fmt.Fprintln(w, string(response))
+}
+
+// exchangeProject returns the project requested with the resource or the
+// scope parameter of a token exchange
+func exchangeProject(r *http.Request) (string, error) {
+	resources := r.PostForm["resource"]
+	if len(resources) > 1 {
+		return "", fmt.Errorf("only one resource can be requested")
+	}
+	scopes := strings.Fields(r.PostForm.Get("scope"))
+	if len(scopes) > 1 {
+		return "", fmt.Errorf("only one scope can be requested")
+	}
+
+	switch {
+	case len(resources) == 1 && len(scopes) == 1 && resources[0] != scopes[0]:
+		return "", fmt.Errorf("resource and scope request different projects")
+	case len(resources) == 1:
+		return resources[0], nil
+	case len(scopes) == 1:
+		return scopes[0], nil
+	default:
+		return "", fmt.Errorf("the project must be given as resource or scope")
+	}
+}
+
+// ExchangeToken implements the token exchange grant of OAuth 2.0 (RFC 8693).
+// The pilot presents a subject token for the user and the project as resource
+// or scope, and receives the same inbox token as from the token endpoint.
+func (s *Service) ExchangeToken(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.Header().Set("Cache-Control", "no-store")
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		fmt.Fprintln(w, string(helpers.CreateErrorResponse("Method not allowed")))
+
+		return
+	}
+
+	if err := r.ParseForm(); err != nil {
+		writeOAuthError(w, http.StatusBadRequest, "invalid_request", "could not parse request")
+
+		return
+	}
+	if grantType := r.PostForm.Get("grant_type"); grantType != grantTypeTokenExchange {
+		writeOAuthError(w, http.StatusBadRequest, "unsupported_grant_type", fmt.Sprintf("unsupported grant type %q", grantType))
+
+		return
+	}
+	st := s.current.Load()
+	subjectVerifier := st.subjectVerifier
+	if subjectVerifier == nil {
+		writeOAuthError(w, http.StatusBadRequest, "unsupported_grant_type", "token exchange is not configured")
+
+		return
+	}
+	subjectToken := r.PostForm.Get("subject_token")
+	if subjectToken == "" {
+		writeOAuthError(w, http.StatusBadRequest, "invalid_request", "subject_token not given")
+
+		return
+	}
+	switch tokenType := r.PostForm.Get("subject_token_type"); tokenType {
+	case tokenTypeAccessToken, tokenTypeJWT:
+	default:
+		writeOAuthError(w, http.StatusBadRequest, "invalid_request", fmt.Sprintf("unsupported subject_token_type %q", tokenType))
+
+		return
+	}
+	if tokenType := r.PostForm.Get("requested_token_type"); tokenType != "" && tokenType != tokenTypeJWT {
+		writeOAuthError(w, http.StatusBadRequest, "invalid_request", fmt.Sprintf("unsupported requested_token_type %q", tokenType))
+
+		return
+	}
+	projectID, err := exchangeProject(r)
+	if err != nil {
+		writeOAuthError(w, http.StatusBadRequest, "invalid_target", err.Error())
+
+		return
+	}
+	projectID = strings.ReplaceAll(strings.ReplaceAll(projectID, "\n", ""), "\r", "")
+
+	ctx, cancel := context.WithTimeout(r.Context(), st.conf.RequestBudget)
+	defer cancel()
+
+	swamID, err := subjectVerifier.VerifySubjectToken(ctx, subjectToken)
+	var denied *deniedError
+	switch {
+	case errors.As(err, &denied):
+		log.Infof("subject token rejected: %v", err)
+		writeOAuthError(w, http.StatusBadRequest, "invalid_grant", "invalid subject token")
+
+		return
+	case errors.Is(err, upstream.ErrCircuitOpen):
+		log.Warnf("subject token verification not attempted: %v", err)
+		writeOAuthError(w, http.StatusServiceUnavailable, "temporarily_unavailable", "unable to verify subject token, try again later")
+
+		return
+	case errors.Is(err, upstream.ErrTimeout):
+		log.Warnf("subject token verification timed out: %v", err)
+		writeOAuthError(w, http.StatusGatewayTimeout, "temporarily_unavailable", "timed out verifying subject token")
+
+		return
+	case err != nil:
+		log.Errorf("failed to verify subject token: %v", err)
+		writeOAuthError(w, http.StatusInternalServerError, "server_error", "could not verify subject token")
+
+		return
+	}
+	swamID = strings.ReplaceAll(strings.ReplaceAll(swamID, "\n", ""), "\r", "")
+
+	project, accountErr, projectErr := st.verifyRequest(ctx, swamID, projectID)
+	if err := errors.Join(accountErr, projectErr); err != nil {
+		// only a denial is reported as invalid_target, other failures are
+		// not the fault of the client
+		switch {
+		case errors.As(err, &denied):
+			log.Infof("%v is not authorized for project %v: %v", swamID, projectID, err)
+			writeOAuthError(w, http.StatusBadRequest, "invalid_target", "unauthorized to access specified project")
+		case errors.Is(err, upstream.ErrCircuitOpen):
+			log.Warnf("verification not attempted: %v", err)
+			writeOAuthError(w, http.StatusServiceUnavailable, "temporarily_unavailable", "unable to verify access to specified project, try again later")
+		case errors.Is(err, upstream.ErrTimeout):
+			log.Warnf("verification timed out: %v", err)
+			writeOAuthError(w, http.StatusGatewayTimeout, "temporarily_unavailable", "timed out verifying access to specified project")
+		case errors.Is(err, context.Canceled):
+			log.Infof("request cancelled before verification finished: %v", err)
+		default:
+			log.Errorf("failed to verify access of %v to project %v: %v", swamID, projectID, err)
+			writeOAuthError(w, http.StatusInternalServerError, "server_error", "could not verify access to specified project")
+		}
+
+		return
+	}
+	log.Infof("%v verified as existing account and PI of project %v", swamID, projectID)
+
+	client, _, _ := r.BasicAuth()
+	issuedAt := time.Now().UTC().Truncate(time.Second)
+	expiresAt := st.tokenExpiry(issuedAt, 0, client, project)
+	if !expiresAt.After(issuedAt) {
+		log.Infof("project %v ended at %v", projectID, project.EndDate)
+		writeOAuthError(w, http.StatusBadRequest, "invalid_target", "specified project has ended")
+
+		return
+	}
+
+	accessToken, err := st.createECToken(st.conf.JwtParsedKey, swamID, client, issuedAt, expiresAt, nil)
+	if err != nil {
+		log.Errorf("failed to create token: %v", err)
+		writeOAuthError(w, http.StatusInternalServerError, "server_error", "unable to create token")
+
+		return
+	}
+	st.auditIssued("oauth", swamID, projectID, client, issuedAt, expiresAt)
+
+	response, _ := json.Marshal(tokenExchangeResponse{
+		AccessToken:     accessToken,
+		IssuedTokenType: tokenTypeJWT,
+		TokenType:       "Bearer",
+		ExpiresIn:       int64(expiresAt.Sub(issuedAt).Seconds()),
+		Scope:           projectID,
+	})
+	fmt.Fprint(w, string(response))
+}
@@ -0,0 +1,173 @@
+package token
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/NBISweden/sda-uppmax-integration/helpers"
+	"gopkg.in/yaml.v3"
+)
+
+// ErrUnknownProject is wrapped by the errors of a ProjectAuthorizer that does
+// not know the requested project
+var ErrUnknownProject = errors.New("unknown project")
+
+// Project holds the details of an authorized project
+type Project struct {
+	// EndDate is the time the project ends, the zero time if it is not known
+	EndDate time.Time
+}
+
+// ProjectAuthorizer checks that a user may upload data to a project
+type ProjectAuthorizer interface {
+	// AuthorizeProject returns the project if `username` may upload to
+	// `projectID`, and an error wrapping ErrUnknownProject if the project
+	// is not known
+	AuthorizeProject(ctx context.Context, username string, projectID string) (Project, error)
+}
+
+// newProjectAuthorizer returns the project registries selected in the
+// configuration, chained in the configured order
+func (st *state) newProjectAuthorizer(conf *helpers.Conf) (ProjectAuthorizer, error) {
+	var chain ProjectChain
+	for _, registry := range conf.ProjectRegistries {
+		switch registry {
+		case "supr":
+			chain = append(chain, NewSuprAuthorizer(conf.SuprURL, conf.SuprUsername, conf.SuprPassword, st.newUpstreamClient("SUPR", conf)))
+		case "file":
+			authorizer, err := NewFileAuthorizer(conf.ProjectFile)
+			if err != nil {
+				return nil, err
+			}
+			chain = append(chain, authorizer)
+		default:
+			return nil, fmt.Errorf("unknown project registry %s", registry)
+		}
+	}
+
+	if len(chain) == 1 {
+		return chain[0], nil
+	}
+
+	return chain, nil
+}
+
+// verifyProjectAccount checks that `username` may upload to `projectID` with
+// the configured project registries. The result is cached.
+func (st *state) verifyProjectAccount(ctx context.Context, username string, projectID string) (Project, error) {
+	var project Project
+	endDate, err := st.cachedLookup(ctx, projectCacheKey(username, projectID), func() (string, error) {
+		var err error
+		project, err = st.projectAuthorizer.AuthorizeProject(ctx, username, projectID)
+		if err != nil || project.EndDate.IsZero() {
+			return "", err
+		}
+
+		return project.EndDate.Format(time.RFC3339), nil
+	})
+	if err != nil || endDate == "" {
+		return project, err
+	}
+
+	project.EndDate, err = time.Parse(time.RFC3339, endDate)
+
+	return project, err
+}
+
+// ProjectChain queries several project registries in order. The first
+// registry that knows the project decides.
+type ProjectChain []ProjectAuthorizer
+
+// AuthorizeProject implements ProjectAuthorizer
+func (c ProjectChain) AuthorizeProject(ctx context.Context, username string, projectID string) (Project, error) {
+	for _, authorizer := range c {
+		project, err := authorizer.AuthorizeProject(ctx, username, projectID)
+		if !errors.Is(err, ErrUnknownProject) {
+			return project, err
+		}
+	}
+
+	return Project{}, &deniedError{message: "project not found", err: ErrUnknownProject}
+}
+
+// projectFile describes the file read by the FileAuthorizer
+type projectFile struct {
+	Projects []struct {
+		ID      string `yaml:"id"`
+		Pi      string `yaml:"pi"`
+		EndDate string `yaml:"endDate"`
+	} `yaml:"projects"`
+}
+
+// fileProject is a project read from the project file
+type fileProject struct {
+	pi      string
+	endDate time.Time
+}
+
+// FileAuthorizer authorizes projects listed in a locally managed YAML or JSON
+// file, mainly intended for test environments
+type FileAuthorizer struct {
+	projects map[string]fileProject
+}
+
+// NewFileAuthorizer reads the projects from the file at path
+func NewFileAuthorizer(path string) (*FileAuthorizer, error) {
+	data, err := os.ReadFile(filepath.Clean(path))
+	if err != nil {
+		return nil, fmt.Errorf("could not read project file: %v", err)
+	}
+
+	// JSON is valid YAML, so the same parser handles both formats
+	var file projectFile
+	if err := yaml.Unmarshal(data, &file); err != nil {
+		return nil, fmt.Errorf("could not parse project file: %v", err)
+	}
+
+	authorizer := &FileAuthorizer{projects: make(map[string]fileProject)}
+	for _, project := range file.Projects {
+		if strings.TrimSpace(project.ID) == "" || strings.TrimSpace(project.Pi) == "" {
+			return nil, fmt.Errorf("could not parse project file: project without id or pi")
+		}
+		entry := fileProject{pi: project.Pi}
+		if project.EndDate != "" {
+			entry.endDate, err = parseEndDate(project.EndDate)
+			if err != nil {
+				return nil, fmt.Errorf("could not parse project file: invalid end date of %s: %v", project.ID, err)
+			}
+		}
+		authorizer.projects[project.ID] = entry
+	}
+
+	return authorizer, nil
+}
+
+// AuthorizeProject implements ProjectAuthorizer
+func (a *FileAuthorizer) AuthorizeProject(_ context.Context, username string, projectID string) (Project, error) {
+	project, ok := a.projects[projectID]
+	if !ok {
+		return Project{}, &deniedError{message: "project not found in project file", err: ErrUnknownProject}
+	}
+
+	if project.pi != username {
+		return Project{}, &deniedError{message: "email is different than PI in requested project"}
+	}
+
+	return Project{EndDate: project.endDate}, nil
+}
+
+// parseEndDate parses a project end date given as YYYY-MM-DD. The project is
+// considered to end at the end of that day in UTC.
+func parseEndDate(date string) (time.Time, error) {
+	day, err := time.Parse(time.DateOnly, date)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	return day.AddDate(0, 0, 1), nil
+}
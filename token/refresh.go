@@ -0,0 +1,243 @@
+package token
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	b64 "encoding/base64"
+
+	"github.com/NBISweden/sda-uppmax-integration/helpers"
+	log "github.com/sirupsen/logrus"
+)
+
+type refreshRequest struct {
+	RefreshToken string `json:"refresh_token"`
+}
+
+// refreshGrant is the token request a refresh token was issued for, which is
+// stored under the hash of the refresh token
+type refreshGrant struct {
+	SwamID    string `json:"swamid"`
+	ProjectID string `json:"projectid"`
+	Format    string `json:"format"`
+	Lifetime  string `json:"lifetime,omitempty"`
+	Client    string `json:"client"`
+	// ExpiresAt is the expiry of the refresh token as a Unix time
+	ExpiresAt int64 `json:"expires_at"`
+	// token is the refresh token the grant was consumed from, which is not stored
+	token string
+}
+
+// refreshErrorResponse is the error response of a refresh that failed after
+// the refresh token was used, holding the refresh token replacing it
+type refreshErrorResponse struct {
+	Error struct {
+		Message string `json:"message"`
+	} `json:"error"`
+	RefreshToken string `json:"refresh_token,omitempty"`
+}
+
+// refreshCacheKey returns the key of a refresh token in the store. Only the
+// hash of the token is stored, so that the store does not hold usable tokens.
+func refreshCacheKey(refreshToken string) string {
+	hash := sha256.Sum256([]byte(refreshToken))
+
+	return "refresh:" + hex.EncodeToString(hash[:])
+}
+
+// createRefreshToken creates and stores a refresh token for tokenRequest made
+// by client. The refresh token is valid for refresh.lifetime, or until the
+// expiry of the used refresh token it replaces, but not beyond the end of the
+// project. An empty token is returned if refresh tokens are disabled.
+func (st *state) createRefreshToken(ctx context.Context, tokenRequest tokenRequest, client string, issuedAt time.Time, project Project, used *refreshGrant) (string, error) {
+	if st.refreshStore == nil || st.conf.RefreshLifetime <= 0 {
+		return "", nil
+	}
+
+	expiresAt := issuedAt.Add(st.conf.RefreshLifetime)
+	if used != nil {
+		expiresAt = time.Unix(used.ExpiresAt, 0)
+	}
+	if !project.EndDate.IsZero() && project.EndDate.Before(expiresAt) {
+		expiresAt = project.EndDate
+	}
+
+	return st.storeRefreshGrant(ctx, refreshGrant{
+		SwamID:    tokenRequest.SwamID,
+		ProjectID: tokenRequest.ProjectID,
+		Format:    tokenRequest.Format,
+		Lifetime:  tokenRequest.Lifetime,
+		Client:    client,
+		ExpiresAt: expiresAt.Unix(),
+	})
+}
+
+// storeRefreshGrant stores grant under a new refresh token, which is returned.
+// An empty token is returned if the grant has expired.
+func (st *state) storeRefreshGrant(ctx context.Context, grant refreshGrant) (string, error) {
+	random := make([]byte, 32)
+	if _, err := rand.Read(random); err != nil {
+		return "", err
+	}
+	refreshToken := b64.RawURLEncoding.EncodeToString(random)
+
+	stored, err := st.setRefreshGrant(ctx, refreshToken, grant)
+	if err != nil || !stored {
+		return "", err
+	}
+
+	return refreshToken, nil
+}
+
+// setRefreshGrant stores grant under refreshToken until the grant expires, and
+// returns false if it has already expired
+func (st *state) setRefreshGrant(ctx context.Context, refreshToken string, grant refreshGrant) (bool, error) {
+	ttl := time.Until(time.Unix(grant.ExpiresAt, 0))
+	if ttl <= 0 {
+		return false, nil
+	}
+	value, err := json.Marshal(grant)
+	if err != nil {
+		return false, err
+	}
+
+	return true, st.refreshStore.Set(ctx, refreshCacheKey(refreshToken), string(value), ttl)
+}
+
+// restoreRefreshToken stores a consumed grant again under the refresh token it
+// was consumed from, for requests cancelled by the client, which still holds
+// that refresh token. The store is not cancelled along with ctx.
+func (st *state) restoreRefreshToken(ctx context.Context, grant refreshGrant) {
+	if _, err := st.setRefreshGrant(context.WithoutCancel(ctx), grant.token, grant); err != nil {
+		log.Errorf("failed to restore refresh token: %v", err)
+	}
+}
+
+// consumeRefreshToken removes a refresh token from the store and returns the
+// grant it was issued for, and false if the refresh token is unknown, expired
+// or already used. Of concurrent requests using a token only one finds it.
+func (st *state) consumeRefreshToken(ctx context.Context, refreshToken string) (refreshGrant, bool, error) {
+	if st.refreshStore == nil || refreshToken == "" {
+		return refreshGrant{}, false, nil
+	}
+
+	value, found, err := st.refreshStore.Take(ctx, refreshCacheKey(refreshToken))
+	if err != nil || !found {
+		return refreshGrant{}, false, err
+	}
+
+	var grant refreshGrant
+	if err := json.Unmarshal([]byte(value), &grant); err != nil {
+		return refreshGrant{}, false, fmt.Errorf("could not parse refresh grant: %v", err)
+	}
+	grant.token = refreshToken
+
+	return grant, true, nil
+}
+
+// tokenRequest returns the token request the grant was issued for
+func (grant refreshGrant) tokenRequest() (tokenRequest, error) {
+	request := tokenRequest{
+		SwamID:    grant.SwamID,
+		ProjectID: grant.ProjectID,
+		Format:    grant.Format,
+		Lifetime:  grant.Lifetime,
+	}
+	if request.Lifetime != "" {
+		var err error
+		request.lifetime, err = time.ParseDuration(request.Lifetime)
+		if err != nil {
+			return tokenRequest{}, fmt.Errorf("could not parse refresh grant: %v", err)
+		}
+	}
+
+	return request, nil
+}
+
+// writeIssueError writes the error response of a token request that failed
+// for a reason other than a denial. The refresh token used for the request,
+// if any, has already been consumed, so a refresh token replacing it is
+// issued along with the error to let the client try again.
+func (st *state) writeIssueError(ctx context.Context, w http.ResponseWriter, status int, message string, used *refreshGrant) {
+	response := refreshErrorResponse{}
+	response.Error.Message = message
+	if used != nil {
+		replacement, err := st.storeRefreshGrant(ctx, *used)
+		if err != nil {
+			log.Errorf("failed to replace refresh token: %v", err)
+		}
+		response.RefreshToken = replacement
+	}
+	currentError, _ := json.Marshal(response)
+	w.WriteHeader(status)
+	fmt.Fprintln(w, string(currentError))
+}
+
+// RefreshToken exchanges a refresh token for a new token and S3 configuration.
+// The account and the project are verified again, and the refresh token is
+// rotated, so that each refresh token can only be used once.
+func (s *Service) RefreshToken(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		fmt.Fprintln(w, string(helpers.CreateErrorResponse("Method not allowed")))
+
+		return
+	}
+
+	var request refreshRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		currentError := helpers.CreateErrorResponse("Error reading request body - " + err.Error())
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintln(w, string(currentError))
+
+		return
+	}
+
+	version, err := responseVersion(r)
+	if err != nil {
+		currentError := helpers.CreateErrorResponse(err.Error())
+		w.WriteHeader(http.StatusNotAcceptable)
+		fmt.Fprintln(w, string(currentError))
+
+		return
+	}
+
+	// the refresh token is consumed before the request is verified, so that
+	// it can only be used once even by concurrent requests
+	st := s.current.Load()
+	grant, found, err := st.consumeRefreshToken(r.Context(), request.RefreshToken)
+	if err != nil {
+		log.Errorf("failed to look up refresh token: %v", err)
+		currentError := helpers.CreateErrorResponse("Unable to refresh token")
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintln(w, string(currentError))
+
+		return
+	}
+	if !found {
+		currentError := helpers.CreateErrorResponse("Invalid refresh token")
+		w.WriteHeader(http.StatusUnauthorized)
+		fmt.Fprintln(w, string(currentError))
+
+		return
+	}
+	tokenRequest, err := grant.tokenRequest()
+	if err != nil {
+		log.Errorf("failed to refresh token: %v", err)
+		currentError := helpers.CreateErrorResponse("Unable to refresh token")
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintln(w, string(currentError))
+
+		return
+	}
+	log.Infof("refreshing token of %v for project %v", tokenRequest.SwamID, tokenRequest.ProjectID)
+
+	st.issueToken(w, r, tokenRequest, grant.Client, version, &grant)
+}
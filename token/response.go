@@ -0,0 +1,84 @@
+package token
+
+import (
+	"fmt"
+	"mime"
+	"net/http"
+	"strings"
+	"time"
+
+	b64 "encoding/base64"
+)
+
+// mediaTypeV2 is the media type of version 2 of the token response
+const mediaTypeV2 = "application/vnd.sda.token.v2+json"
+
+// tokenResponseV2 is version 2 of the token response, where the values needed
+// for uploading are returned as separate fields instead of a client configuration.
+// The times are given in UTC as RFC 3339 timestamps, where the expiration is the
+// exp claim of the token.
+type tokenResponseV2 struct {
+	SwamID       string `json:"swamid"`
+	ProjectID    string `json:"projectid"`
+	IssuedAt     string `json:"issued_at"`
+	AccessToken  string `json:"access_token"`
+	AccessKey    string `json:"access_key"`
+	SecretKey    string `json:"secret_key"`
+	HostBase     string `json:"host_base"`
+	HostBucket   string `json:"host_bucket"`
+	Expiration   string `json:"expiration"`
+	Crypt4ghKey  string `json:"crypt4gh_key"`
+	RefreshToken string `json:"refresh_token,omitempty"`
+}
+
+// responseVersion returns the version of the token response requested either
+// with the version query parameter or the media type in the Accept header.
+// Version 1 is the legacy response and the default.
+func responseVersion(r *http.Request) (int, error) {
+	switch r.URL.Query().Get("version") {
+	case "1":
+		return 1, nil
+	case "2":
+		return 2, nil
+	case "":
+	default:
+		return 0, fmt.Errorf("unsupported API version %s", r.URL.Query().Get("version"))
+	}
+
+	for _, accepted := range strings.Split(r.Header.Get("Accept"), ",") {
+		mediaType, _, err := mime.ParseMediaType(strings.TrimSpace(accepted))
+		if err == nil && mediaType == mediaTypeV2 {
+			return 2, nil
+		}
+	}
+
+	return 1, nil
+}
+
+// createResponseV2 creates the token for username, requested by client, and
+// populates version 2 of the token response
+func (st *state) createResponseV2(tokenRequest tokenRequest, username, client string, issuedAt, expiresAt time.Time) (tokenResponse tokenResponseV2, err error) {
+	tokenResponse.SwamID = tokenRequest.SwamID
+	tokenResponse.ProjectID = tokenRequest.ProjectID
+
+	issuedAt, expiresAt = issuedAt.UTC(), expiresAt.UTC()
+	tokenResponse.AccessToken, err = st.createECToken(st.conf.JwtParsedKey, username, client, issuedAt, expiresAt, nil)
+	if err != nil {
+		return tokenResponse, fmt.Errorf("error creating token")
+	}
+	tokenResponse.IssuedAt = issuedAt.Format(time.RFC3339)
+	tokenResponse.Expiration = expiresAt.Format(time.RFC3339)
+
+	tokenResponse.AccessKey = strings.ReplaceAll(username, "@", "_")
+	tokenResponse.SecretKey = tokenResponse.AccessKey
+	tokenResponse.HostBase = st.conf.S3URL
+	tokenResponse.HostBucket = st.conf.S3URL
+
+	crypt4ghKey, err := b64.StdEncoding.DecodeString(st.conf.Crypt4ghKeyFor(tokenRequest.ProjectID))
+	if err != nil {
+		return tokenResponse, fmt.Errorf("error decoding crypt4gh key")
+	}
+	tokenResponse.Crypt4ghKey = string(crypt4ghKey)
+
+	return tokenResponse, nil
+}
@@ -0,0 +1,100 @@
+package token
+
+import (
+	"net/http"
+	"sync/atomic"
+
+	"github.com/NBISweden/sda-uppmax-integration/cache"
+	"github.com/NBISweden/sda-uppmax-integration/helpers"
+	"github.com/NBISweden/sda-uppmax-integration/upstream"
+)
+
+// Service issues tokens with the configuration it was created with. Each
+// Service holds its own configuration, backends and stores, so that several
+// differently configured services can run in one process.
+type Service struct {
+	lookupCache  cache.Store
+	refreshStore cache.Store
+
+	current atomic.Pointer[state]
+}
+
+// state holds the configuration of a Service and the backends created from
+// it, which are replaced as a whole when the configuration is reloaded
+type state struct {
+	conf *helpers.Conf
+
+	// accountVerifier is the backend used for verifying the requested accounts
+	accountVerifier AccountVerifier
+	// projectAuthorizer is the backend used for authorizing the requested projects
+	projectAuthorizer ProjectAuthorizer
+	// subjectVerifier validates the subject tokens, nil disables token exchange
+	subjectVerifier SubjectVerifier
+	// upstreams holds the clients of all external services in use
+	upstreams []*upstream.Client
+	// previousUpstreams holds the clients of the replaced state while the
+	// backends are created, to be kept where their settings did not change
+	previousUpstreams []*upstream.Client
+
+	// lookupCache holds the results of the account and project lookups, nil disables caching
+	lookupCache cache.Store
+	// refreshStore holds the issued refresh tokens, nil disables refresh tokens
+	refreshStore cache.Store
+}
+
+// NewService creates a service issuing tokens with conf. The account and
+// project lookups are cached in lookupCache and the refresh tokens are kept
+// in refreshStore, either of which may be nil to disable them.
+func NewService(conf *helpers.Conf, lookupCache, refreshStore cache.Store) (*Service, error) {
+	s := &Service{lookupCache: lookupCache, refreshStore: refreshStore}
+	if err := s.Reload(conf); err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+// Reload creates the upstream clients, the account verifier, the project
+// authorizer and the subject token verifier from conf. The configuration and
+// the backends in use are only replaced if all of them could be created. The
+// upstream clients whose settings did not change are kept along with the
+// state of their circuit breakers.
+func (s *Service) Reload(conf *helpers.Conf) error {
+	st := &state{conf: conf, lookupCache: s.lookupCache, refreshStore: s.refreshStore}
+	if current := s.current.Load(); current != nil {
+		st.previousUpstreams = current.upstreams
+	}
+
+	verifier, err := st.newAccountVerifier(conf)
+	if err != nil {
+		return err
+	}
+	authorizer, err := st.newProjectAuthorizer(conf)
+	if err != nil {
+		return err
+	}
+	st.accountVerifier = verifier
+	st.projectAuthorizer = authorizer
+	st.subjectVerifier = st.newSubjectVerifier(conf)
+	st.previousUpstreams = nil
+	s.current.Store(st)
+
+	return nil
+}
+
+// Config returns the configuration in use
+func (s *Service) Config() *helpers.Conf {
+	return s.current.Load().conf
+}
+
+// Register adds the endpoints of the service to mux. The endpoints used by
+// the pilot and the other clients require the basic auth credentials of the
+// configuration, and the administrative ones those of the pilot.
+func (s *Service) Register(mux *http.ServeMux) {
+	mux.HandleFunc("/token", helpers.BasicAuth(s.Config, s.GetToken))
+	mux.HandleFunc("/token/refresh", s.RefreshToken)
+	mux.HandleFunc("/oauth/token", helpers.BasicAuth(s.Config, s.ExchangeToken))
+	mux.HandleFunc("/admin/cache", helpers.AdminAuth(s.Config, s.FlushCache))
+	mux.HandleFunc("/crypt4gh/key", s.GetCrypt4ghKey)
+	mux.HandleFunc("/ready", s.Ready)
+}
@@ -1,13 +1,14 @@
 package token
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
 	"net/http"
-	"time"
+	"net/url"
 
-	"github.com/NBISweden/sda-uppmax-integration/helpers"
+	"github.com/NBISweden/sda-uppmax-integration/upstream"
 	log "github.com/sirupsen/logrus"
 )
 
@@ -106,57 +107,83 @@ type Center struct {
 	Name string `json:"name"`
 }
 
-// verifyProjectAccount checks that the given `email` is actually
-// the PI of the given `project_id` and returns error otherwise
-func verifyProjectAccount(username string, projectID string) error {
+// SuprAuthorizer authorizes projects against the SUPR project API
+type SuprAuthorizer struct {
+	url      string
+	username string
+	password string
+	client   *upstream.Client
+}
+
+// NewSuprAuthorizer returns an authorizer querying the SUPR API at url with
+// the given credentials
+func NewSuprAuthorizer(url, username, password string, client *upstream.Client) *SuprAuthorizer {
+	return &SuprAuthorizer{url: url, username: username, password: password, client: client}
+}
 
-	suprUser := helpers.Config.SuprUsername
-	suprPass := helpers.Config.SuprPassword
-	suprURL := helpers.Config.SuprURL
+// AuthorizeProject checks that the given `email` is actually
+// the PI of the given `project_id` and returns error otherwise
+func (a *SuprAuthorizer) AuthorizeProject(ctx context.Context, username string, projectID string) (Project, error) {
 
-	url := fmt.Sprintf("%v?name=%v", suprURL, projectID)
+	query := url.Values{"name": {projectID}}
 
-	client := &http.Client{
-		Timeout: 5 * time.Second,
-	}
-	req, err := http.NewRequest("GET", url, nil)
+	req, err := http.NewRequestWithContext(ctx, "GET", a.url+"?"+query.Encode(), nil)
 	if err != nil {
 
-		return err
+		return Project{}, err
 	}
-	req.SetBasicAuth(suprUser, suprPass)
-	resp, err := client.Do(req)
+	req.SetBasicAuth(a.username, a.password)
+	resp, err := a.client.Do(req)
 	if err != nil {
 
-		return err
+		return Project{}, err
 	}
 
 	if resp.StatusCode != 200 {
 
 		message, err := io.ReadAll(resp.Body)
 		if err != nil {
-			return err
+			return Project{}, err
 		}
 		defer resp.Body.Close()
 
-		return fmt.Errorf("got %v from SUPR", message)
+		return Project{}, fmt.Errorf("got %v from SUPR", message)
 	}
 
 	var response SuprResponse
 	err = json.NewDecoder(resp.Body).Decode(&response)
 	if err != nil {
 
-		return err
+		return Project{}, err
 	}
 
 	defer resp.Body.Close()
 	log.Debugf("reply: %v", response)
 
+	if len(response.Matches) == 0 {
+		log.Infof("SUPR project %v does not exist", projectID)
+
+		return Project{}, &deniedError{message: "project not found in SUPR", err: ErrUnknownProject}
+	}
+	if len(response.Matches) > 1 {
+		log.Infof("SUPR project %v is ambiguous, got %v matches", projectID, len(response.Matches))
+
+		return Project{}, &deniedError{message: "project is ambiguous in SUPR"}
+	}
+
 	if response.Matches[0].Pi.Email != username {
 		log.Infof("Email %v does not exist for SUPR project %v", username, projectID)
 
-		return fmt.Errorf("email is different than PI in requested project")
+		return Project{}, &deniedError{message: "email is different than PI in requested project"}
+	}
+
+	var project Project
+	if response.Matches[0].EndDate != "" {
+		project.EndDate, err = parseEndDate(response.Matches[0].EndDate)
+		if err != nil {
+			return Project{}, fmt.Errorf("invalid end date from SUPR: %v", err)
+		}
 	}
 
-	return nil
+	return project, nil
 }
@@ -1,17 +1,21 @@
 package token
 
 import (
+	"context"
 	"crypto/ecdsa"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
 	"strings"
+	"sync"
 	"time"
 
 	b64 "encoding/base64"
 
 	"github.com/NBISweden/sda-uppmax-integration/helpers"
+	"github.com/NBISweden/sda-uppmax-integration/upstream"
 	"github.com/golang-jwt/jwt"
 	log "github.com/sirupsen/logrus"
 )
@@ -19,15 +23,23 @@ import (
 type tokenRequest struct {
 	SwamID    string `json:"swamid"`
 	ProjectID string `json:"projectid"`
+	Format    string `json:"format,omitempty"`
+	Lifetime  string `json:"lifetime,omitempty"`
+
+	// lifetime is the parsed Lifetime, zero if none was requested
+	lifetime time.Duration
 }
 
 type tokenResponse struct {
-	SwamID      string `json:"swamid"`
-	ProjectID   string `json:"projectid"`
-	RequestTime string `json:"request_time"`
-	Expiration  string `json:"expiration"`
-	S3Config    string `json:"s3config"`
-	Crypt4ghKey string `json:"crypt4gh_key"`
+	SwamID       string `json:"swamid"`
+	ProjectID    string `json:"projectid"`
+	RequestTime  string `json:"request_time"`
+	Expiration   string `json:"expiration"`
+	Format       string `json:"format,omitempty"`
+	S3Config     string `json:"s3config"`
+	Credentials  string `json:"s3credentials,omitempty"`
+	Crypt4ghKey  string `json:"crypt4gh_key"`
+	RefreshToken string `json:"refresh_token,omitempty"`
 }
 
 func readRequestBody(body io.ReadCloser) (tokenRequest tokenRequest, err error) {
@@ -41,21 +53,81 @@ func readRequestBody(body io.ReadCloser) (tokenRequest tokenRequest, err error)
 		return tokenRequest, fmt.Errorf("incomplete incoming data")
 	}
 
+	if tokenRequest.Format == "" {
+		tokenRequest.Format = defaultFormat
+	}
+	if _, ok := outputFormats[tokenRequest.Format]; !ok {
+		return tokenRequest, fmt.Errorf("unsupported format %s", tokenRequest.Format)
+	}
+
+	if tokenRequest.Lifetime != "" {
+		tokenRequest.lifetime, err = time.ParseDuration(tokenRequest.Lifetime)
+		if err != nil || tokenRequest.lifetime <= 0 {
+			return tokenRequest, fmt.Errorf("invalid lifetime %s", tokenRequest.Lifetime)
+		}
+	}
+
 	return tokenRequest, nil
 }
 
-func createECToken(key *ecdsa.PrivateKey, username string) (string, error) {
+// maxLifetime returns the longest lifetime of the tokens requested by client,
+// which is bounded by both the client and global.maxLifetime
+func (st *state) maxLifetime(client string) time.Duration {
+	if lifetime, ok := st.conf.ClientMaxLifetimes[strings.ToLower(client)]; ok {
+		return min(lifetime, st.conf.MaxLifetime)
+	}
+
+	return st.conf.MaxLifetime
+}
+
+// tokenExpiry returns the expiration time of a token issued at issuedAt. The
+// token lives for the requested lifetime, or global.expirationDays if none was
+// requested, but never beyond the maximum lifetime of the client or the end of
+// the project.
+func (st *state) tokenExpiry(issuedAt time.Time, requested time.Duration, client string, project Project) time.Time {
+	maxLifetime := st.maxLifetime(client)
+	expiresAt := issuedAt.Add(min(requested, maxLifetime))
+	if requested <= 0 {
+		// the default lifetime is counted in calendar days, which may be an
+		// hour longer or shorter than 24h across a daylight saving time change
+		expiresAt = issuedAt.Add(maxLifetime)
+		if time.Duration(st.conf.ExpirationDays)*24*time.Hour <= maxLifetime {
+			expiresAt = issuedAt.Local().AddDate(0, 0, st.conf.ExpirationDays).In(issuedAt.Location())
+		}
+	}
+	if !project.EndDate.IsZero() && project.EndDate.Before(expiresAt) {
+		expiresAt = project.EndDate
+	}
+
+	return expiresAt
+}
+
+// keyID names the signing key in the kid header of the tokens, which
+// downstream services use to look up the key verifying them
+const keyID = "sda"
+
+// createECToken creates a token for username, requested by client, issued at
+// issuedAt and valid until expiresAt, holding the extra claims if any. Tokens
+// issued without a client name the pilot.
+func (st *state) createECToken(key *ecdsa.PrivateKey, username, client string, issuedAt, expiresAt time.Time, extra jwt.MapClaims) (string, error) {
 	// signing method of token
 	token := jwt.New(jwt.SigningMethodES256)
 	// token headers
 	token.Header["alg"] = "ES256"
-	token.Header["kid"] = "sda"
+	token.Header["kid"] = keyID
 	// token claims
 	claims := make(jwt.MapClaims)
-	claims["iss"] = helpers.Config.Iss
-	claims["exp"] = time.Now().AddDate(0, 0, helpers.Config.ExpirationDays).Unix()
+	claims["iss"] = st.conf.Iss
+	claims["iat"] = issuedAt.Unix()
+	claims["exp"] = expiresAt.Unix()
 	claims["sub"] = username
-	claims["pilot"] = helpers.Config.Username
+	claims["pilot"] = client
+	if client == "" {
+		claims["pilot"] = st.conf.Username
+	}
+	for name, value := range extra {
+		claims[name] = value
+	}
 	token.Claims = claims
 
 	// create token
@@ -67,41 +139,60 @@ func createECToken(key *ecdsa.PrivateKey, username string) (string, error) {
 	return tokenString, nil
 }
 
-func createS3Config(username string) (s3config string, expiration string, err error) {
-	s3config = "guess_mime_type = True\n" +
-		"human_readable_sizes = True\n" +
-		"use_https = True\n" +
-		"multipart_chunk_size_mb = 50\n" +
-		"check_ssl_certificate = True\n" +
-		"check_ssl_hostname = True\n" +
-		"encoding = UTF-8\n" +
-		"encrypt = False\n" +
-		"socket_timeout = 30\n"
-
-	token, err := createECToken(helpers.Config.JwtParsedKey, username)
+// createS3Config creates the token for username, requested by client and
+// holding the extra claims if any, and the client configuration in the requested format, returned base64
+// encoded. Formats keeping the credentials in a separate file also return
+// those, base64 encoded.
+func (st *state) createS3Config(username, client, projectID, format string, issuedAt, expiresAt time.Time, extra jwt.MapClaims) (s3config string, credentials string, expiration string, err error) {
+	if _, ok := outputFormats[format]; !ok {
+		return "", "", "", fmt.Errorf("unsupported format %s", format)
+	}
+
+	token, err := st.createECToken(st.conf.JwtParsedKey, username, client, issuedAt, expiresAt, extra)
 	if err != nil {
-		return "", "", err
+		return "", "", "", err
 	}
 
-	expiration = time.Now().AddDate(0, 0, helpers.Config.ExpirationDays).Format("01-02-2006 15:04:05")
-	s3config += "secret_key = " + strings.ReplaceAll(username, "@", "_") + "\naccess_key = " + strings.ReplaceAll(username, "@", "_") +
-		"\naccess_token = " + token + "\nhost_base = " + helpers.Config.S3URL + "\nhost_bucket = " + helpers.Config.S3URL
+	expiration = expiresAt.Local().Format("01-02-2006 15:04:05")
+	config, err := st.renderClientConfig(format, helpers.TemplateData{
+		Username:  username,
+		AccessKey: strings.ReplaceAll(username, "@", "_"),
+		Token:     token,
+		Host:      st.conf.S3URL,
+		Endpoint:  endpointURL(st.conf.S3URL),
+		Project:   projectID,
+		Expiry:    expiresAt,
+	})
+	if err != nil {
+		return "", "", "", err
+	}
 
-	s3config = b64.StdEncoding.EncodeToString([]byte(s3config))
+	s3config = b64.StdEncoding.EncodeToString([]byte(config.Config))
+	if config.Credentials != "" {
+		credentials = b64.StdEncoding.EncodeToString([]byte(config.Credentials))
+	}
 
-	return s3config, expiration, nil
+	return s3config, credentials, expiration, nil
 }
 
 // createResponse is populating the struct that contains the response to the request by
 // adding values to the fields and creating an S3 configuration file
-func createResponse(tokenRequest tokenRequest, username string) (tokenResponse tokenResponse, err error) {
+func (st *state) createResponse(tokenRequest tokenRequest, username, client string, issuedAt, expiresAt time.Time) (tokenResponse tokenResponse, err error) {
 
-	tokenResponse.RequestTime = time.Now().Format("01-02-2006 15:04:05")
+	tokenResponse.RequestTime = issuedAt.Local().Format("01-02-2006 15:04:05")
 	tokenResponse.SwamID = tokenRequest.SwamID
 	tokenResponse.ProjectID = tokenRequest.ProjectID
-	tokenResponse.Crypt4ghKey = helpers.Config.Crypt4ghKey
+	tokenResponse.Crypt4ghKey = st.conf.Crypt4ghKeyFor(tokenRequest.ProjectID)
+	format := tokenRequest.Format
+	if format == "" {
+		format = defaultFormat
+	}
+	// the legacy response is unchanged for clients using the default format
+	if format != defaultFormat {
+		tokenResponse.Format = format
+	}
 
-	tokenResponse.S3Config, tokenResponse.Expiration, err = createS3Config(username)
+	tokenResponse.S3Config, tokenResponse.Credentials, tokenResponse.Expiration, err = st.createS3Config(username, client, tokenRequest.ProjectID, format, issuedAt, expiresAt, nil)
 	if err != nil {
 		return tokenResponse, fmt.Errorf("error creating S3 configuration")
 	}
@@ -109,19 +200,88 @@ func createResponse(tokenRequest tokenRequest, username string) (tokenResponse t
 	return tokenResponse, err
 }
 
+// verifyRequest verifies the account and the project concurrently. As soon as
+// one of the checks fails the other one is cancelled. At most one error is
+// returned: a denial is reported in preference to other failures, then the
+// account error, and a check that was only cancelled because the other one
+// failed is not reported, so that the outcome does not depend on which check
+// finished first.
+func (st *state) verifyRequest(ctx context.Context, swamID, projectID string) (project Project, accountErr, projectErr error) {
+	checkCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		if accountErr = st.verifyAccount(checkCtx, swamID); accountErr != nil {
+			cancel()
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		if project, projectErr = st.verifyProjectAccount(checkCtx, swamID, projectID); projectErr != nil {
+			cancel()
+		}
+	}()
+	wg.Wait()
+
+	// a check cancelled by the failure of the other one is not an error on
+	// its own, unlike one cancelled along with the request
+	if ctx.Err() == nil {
+		if errors.Is(accountErr, context.Canceled) && projectErr != nil {
+			accountErr = nil
+		}
+		if errors.Is(projectErr, context.Canceled) && accountErr != nil {
+			projectErr = nil
+		}
+	}
+	var denied *deniedError
+	switch {
+	case accountErr != nil && (errors.As(accountErr, &denied) || !errors.As(projectErr, &denied)):
+		return project, accountErr, nil
+	case projectErr != nil:
+		return project, nil, projectErr
+	}
+
+	return project, nil, nil
+}
+
+// handleVerificationError writes the response for verifications that timed out
+// or were not attempted since an upstream is unavailable with fail, and returns
+// false if the request should not proceed, which is also the case for
+// cancelled requests. A denial is left to the caller.
+func handleVerificationError(fail func(status int, message string), accountErr, projectErr error) bool {
+	err := errors.Join(accountErr, projectErr)
+	var denied *deniedError
+	switch {
+	case errors.As(err, &denied):
+		return true
+	case errors.Is(err, upstream.ErrCircuitOpen):
+		log.Warnf("verification not attempted: %v", err)
+		fail(http.StatusServiceUnavailable, "Unable to verify access to specified project, try again later")
+
+		return false
+	case errors.Is(err, upstream.ErrTimeout):
+		log.Warnf("verification timed out: %v", err)
+		fail(http.StatusGatewayTimeout, "Timed out verifying access to specified project")
+
+		return false
+	case errors.Is(err, context.Canceled):
+		log.Infof("request cancelled before verification finished: %v", err)
+
+		return false
+	}
+
+	return true
+}
+
 // GetToken returns the information require for uploading data to the S3 backend,
 // including the token
-func GetToken(w http.ResponseWriter, r *http.Request) {
+func (s *Service) GetToken(w http.ResponseWriter, r *http.Request) {
 
 	tokenRequest, err := readRequestBody(r.Body)
 
-	// sanitize inputs just in case (and to make CodeQL happy)
-	swamID := strings.ReplaceAll(tokenRequest.SwamID, "\n", "")
-	swamID = strings.ReplaceAll(swamID, "\r", "")
-
-	projectID := strings.ReplaceAll(tokenRequest.ProjectID, "\n", "")
-	projectID = strings.ReplaceAll(projectID, "\r", "")
-
 	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
 	if err != nil {
 		currentError := helpers.CreateErrorResponse("Error reading request body - " + err.Error())
@@ -132,41 +292,118 @@ func GetToken(w http.ResponseWriter, r *http.Request) {
 
 	}
 
-	// Check specified swam_id against project_id
-	err = verifyEGABoxAccount(swamID)
+	version, err := responseVersion(r)
 	if err != nil {
-		log.Infof("%v is not a valid ega account", swamID)
-		currentError := helpers.CreateErrorResponse("Unauthorized to access specified project")
-		w.WriteHeader(http.StatusInternalServerError)
+		currentError := helpers.CreateErrorResponse(err.Error())
+		w.WriteHeader(http.StatusNotAcceptable)
 		fmt.Fprintln(w, string(currentError))
 
 		return
+	}
 
+	client, _, _ := r.BasicAuth()
+	s.current.Load().issueToken(w, r, tokenRequest, client, version, nil)
+}
+
+// issueToken verifies the account and the project of tokenRequest, made by
+// client, and writes the response holding the token and a new refresh token.
+// used is the grant of the refresh token consumed by the request, if any,
+// which is replaced if the request fails for a reason other than a denial, and
+// restored if the request is cancelled.
+func (st *state) issueToken(w http.ResponseWriter, r *http.Request, tokenRequest tokenRequest, client string, version int, used *refreshGrant) {
+	fail := func(status int, message string) {
+		st.writeIssueError(r.Context(), w, status, message, used)
 	}
-	log.Infof("%v is verified as existing ega account", swamID)
 
-	err = verifyProjectAccount(swamID, projectID)
-	if err != nil {
+	// sanitize inputs just in case (and to make CodeQL happy)
+	swamID := strings.ReplaceAll(tokenRequest.SwamID, "\n", "")
+	swamID = strings.ReplaceAll(swamID, "\r", "")
+
+	projectID := strings.ReplaceAll(tokenRequest.ProjectID, "\n", "")
+	projectID = strings.ReplaceAll(projectID, "\r", "")
 
-		log.Infof("%v is not the PI of SUPR project %v", swamID, projectID)
-		currentError := helpers.CreateErrorResponse("Unauthorized to access specified project")
+	// Check specified swam_id against project_id, within the time budget of the request
+	ctx, cancel := context.WithTimeout(r.Context(), st.conf.RequestBudget)
+	defer cancel()
+	project, accountErr, projectErr := st.verifyRequest(ctx, swamID, projectID)
+	if !handleVerificationError(fail, accountErr, projectErr) {
+		if used != nil && errors.Is(errors.Join(accountErr, projectErr), context.Canceled) {
+			st.restoreRefreshToken(r.Context(), *used)
+		}
+
+		return
+	}
+	if accountErr != nil || projectErr != nil {
+		if accountErr != nil {
+			log.Infof("%v is not a valid account: %v", swamID, accountErr)
+		} else {
+			log.Infof("%v is not authorized for project %v: %v", swamID, projectID, projectErr)
+		}
+		// a denial revokes the used refresh token instead of replacing it
+		var denied *deniedError
+		if errors.As(errors.Join(accountErr, projectErr), &denied) {
+			used = nil
+		}
+		fail(http.StatusInternalServerError, "Unauthorized to access specified project")
+
+		return
+	}
+	log.Infof("%v verified as existing account and PI of project %v", swamID, projectID)
+
+	// The token lifetime is bounded by the client and by the end of the project
+	issuedAt := time.Now().UTC().Truncate(time.Second)
+	expiresAt := st.tokenExpiry(issuedAt, tokenRequest.lifetime, client, project)
+	if !expiresAt.After(issuedAt) {
+		log.Infof("project %v ended at %v", projectID, project.EndDate)
+		currentError := helpers.CreateErrorResponse("Specified project has ended")
 		w.WriteHeader(http.StatusInternalServerError)
 		fmt.Fprintln(w, string(currentError))
 
 		return
 	}
-	log.Infof("%v verified as the PI of SUPR project %v", swamID, projectID)
+
+	refreshToken, err := st.createRefreshToken(r.Context(), tokenRequest, client, issuedAt, project, used)
+	if err != nil {
+		log.Errorf("failed to create refresh token: %v", err)
+		fail(http.StatusInternalServerError, "Unable to create token for specified project")
+
+		return
+	}
 
 	// Create token for user corresponding to specified swam_id
-	resp, err := createResponse(tokenRequest, swamID)
+	var resp any
+	if version == 2 {
+		var response tokenResponseV2
+		response, err = st.createResponseV2(tokenRequest, swamID, client, issuedAt, expiresAt)
+		response.RefreshToken = refreshToken
+		resp = response
+	} else {
+		var response tokenResponse
+		response, err = st.createResponse(tokenRequest, swamID, client, issuedAt, expiresAt)
+		response.RefreshToken = refreshToken
+		resp = response
+	}
 	if err != nil {
-		currentError := helpers.CreateErrorResponse("Unable to create token for specified project")
-		w.WriteHeader(http.StatusInternalServerError)
-		fmt.Fprintln(w, string(currentError))
+		// the new refresh token is not handed out, so it is revoked
+		if refreshToken != "" {
+			if err := st.refreshStore.Delete(r.Context(), refreshCacheKey(refreshToken)); err != nil {
+				log.Errorf("failed to revoke refresh token: %v", err)
+			}
+		}
+		fail(http.StatusInternalServerError, "Unable to create token for specified project")
 
 		return
 	}
 
+	source := "token"
+	if used != nil {
+		source = "refresh"
+	}
+	st.auditIssued(source, swamID, projectID, client, issuedAt, expiresAt)
+
+	if version == 2 {
+		w.Header().Set("Content-Type", mediaTypeV2)
+	}
 	response, _ := json.Marshal(resp)
 
 	fmt.Fprint(w, string(response))
@@ -1,18 +1,26 @@
 package token
 
 import (
+	"context"
 	b64 "encoding/base64"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
+	"maps"
 	"net/http"
 	"net/http/httptest"
 	"os"
 	"strings"
 	"testing"
+	"time"
 
+	"github.com/NBISweden/sda-uppmax-integration/cache"
 	"github.com/NBISweden/sda-uppmax-integration/helpers"
 	"github.com/NBISweden/sda-uppmax-integration/testhelpers"
+	"github.com/NBISweden/sda-uppmax-integration/upstream"
+	"github.com/go-ldap/ldap/v3"
 	"github.com/golang-jwt/jwt"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/suite"
@@ -34,7 +42,7 @@ func (suite *TestSuite) SetupTest() {
 	suite.PrivateKeyPath, _ = testhelpers.CreateECkeys(suite.TempDir)
 
 	// Create random public crypt4gh key
-	cryptKey := "-----BEGIN CRYPT4GH PUBLIC KEY-----\nvSome+asd/apublicKey\n-----END CRYPT4GH PUBLIC KEY-----"
+	cryptKey := "-----BEGIN CRYPT4GH PUBLIC KEY-----\nDiuAlYdpdr7jwCIdeHKwJdXGnUGBVUZwRHO2iMG0O2E=\n-----END CRYPT4GH PUBLIC KEY-----"
 	crypt4ghFile, _ := os.CreateTemp(suite.TempDir, "rsakey-")
 	_, err := crypt4ghFile.Write([]byte(cryptKey))
 	if err != nil {
@@ -46,10 +54,39 @@ func (suite *TestSuite) SetupTest() {
 
 }
 
+// newConf reads the configuration of the tests, where overrides replaces or
+// adds the settings given by their keys, e.g. "allowlist.file". The file is
+// written to a temporary directory of the test.
+func (suite *TestSuite) newConf(overrides map[string]any) *helpers.Conf {
+	settings := map[string]any{
+		"global.crypt4ghKey":    suite.Crypt4ghKeyPath,
+		"global.egaUsername":    "some-user",
+		"global.egaPassword":    "some-pass",
+		"global.egaURL":         "http://ega.dev",
+		"global.expirationDays": 14,
+		"global.iss":            "https://some.url",
+		"global.jwtKey":         suite.PrivateKeyPath,
+		"global.suprUsername":   "some-user",
+		"global.suprPassword":   "some-pass",
+		"global.suprURL":        "http://supr.dev",
+		"global.s3url":          "some.s3.url",
+		"global.uppmaxUsername": "user",
+		"global.uppmaxPassword": "password",
+	}
+	maps.Copy(settings, overrides)
+	testhelpers.WriteSettings(suite.T(), settings)
+
+	conf := &helpers.Conf{}
+	suite.Require().NoError(helpers.NewConf(conf))
+
+	return conf
+}
+
 func (suite *TestSuite) TestNewConf() {
 	expectedToken := tokenRequest{
 		SwamID:    "<swamid>",
 		ProjectID: "<projectid>",
+		Format:    "s3cmd",
 	}
 
 	r := io.NopCloser(strings.NewReader(`{
@@ -81,6 +118,16 @@ func (suite *TestSuite) TestNewConf() {
 	_, err = readRequestBody(r)
 
 	assert.EqualError(suite.T(), err, "incomplete incoming data")
+
+	r = io.NopCloser(strings.NewReader(`{
+		"swamid": "<swamid>",
+		"projectid": "<projectid>",
+		"format": "cyberduck"
+	}`))
+
+	_, err = readRequestBody(r)
+
+	assert.EqualError(suite.T(), err, "unsupported format cyberduck")
 }
 
 func (suite *TestSuite) TestCreateECToken() {
@@ -100,16 +147,15 @@ func (suite *TestSuite) TestCreateECToken() {
   uppmaxUsername: "user"
   uppmaxPassword: "password"
 `
-	configName := "config.yaml"
-	err := os.WriteFile(configName, []byte(confData), 0600)
-	if err != nil {
-		log.Printf("failed to write temp config file, %v", err)
-	}
+	configName := testhelpers.WriteConfig(suite.T(), confData)
 
-	err = helpers.NewConf(&helpers.Config)
+	conf := &helpers.Conf{}
+	err := helpers.NewConf(conf)
 	assert.NoError(suite.T(), err)
+	st := &state{conf: conf}
 
-	tokenString, err := createECToken(helpers.Config.JwtParsedKey, helpers.Config.EgaUsername)
+	issuedAt := time.Now()
+	tokenString, err := st.createECToken(conf.JwtParsedKey, conf.EgaUsername, "user", issuedAt, issuedAt.Add(time.Hour), nil)
 	assert.NoError(suite.T(), err)
 
 	// Parse token to make sure it contains the correct information
@@ -117,21 +163,90 @@ func (suite *TestSuite) TestCreateECToken() {
 	claims, _ := token.Claims.(jwt.MapClaims)
 
 	// Check that token includes the correct information
-	assert.Equal(suite.T(), helpers.Config.Username, claims["pilot"])
-	assert.Equal(suite.T(), helpers.Config.Iss, claims["iss"])
-	assert.Equal(suite.T(), helpers.Config.EgaUsername, claims["sub"])
+	assert.Equal(suite.T(), conf.Username, claims["pilot"])
+	assert.Equal(suite.T(), conf.Iss, claims["iss"])
+	assert.Equal(suite.T(), conf.EgaUsername, claims["sub"])
 
-	s3config, _, err := createS3Config("someuser")
+	s3config, credentials, _, err := st.createS3Config("someuser", "user", "someproject", "s3cmd", issuedAt, issuedAt.Add(time.Hour), nil)
 
 	assert.NoError(suite.T(), err)
 
 	// The S3 config base64 encode - Need to decode before running assert
 	s3configDec, _ := b64.StdEncoding.DecodeString(s3config)
 	assert.Contains(suite.T(), string(s3configDec), "someuser")
+	assert.Empty(suite.T(), credentials)
+
+	// The token names the client requesting it, or the pilot without one
+	for client, pilot := range map[string]string{"portal": "portal", "": conf.Username} {
+		tokenString, err = st.createECToken(conf.JwtParsedKey, "someuser", client, issuedAt, issuedAt.Add(time.Hour), nil)
+		assert.NoError(suite.T(), err)
+		token, _ = jwt.Parse(tokenString, func(_ *jwt.Token) (interface{}, error) { return nil, nil })
+		claims, _ = token.Claims.(jwt.MapClaims)
+		assert.Equal(suite.T(), pilot, claims["pilot"])
+	}
 
 	defer os.Remove(configName)
 }
 
+// TestIndependentServices checks that services created from different
+// configurations do not share their settings
+func (suite *TestSuite) TestIndependentServices() {
+
+	confData := `global:
+  crypt4ghKey: ` + suite.Crypt4ghKeyPath + `
+  expirationDays: 14
+  iss: "https://some.url"
+  jwtKey: "` + suite.PrivateKeyPath + `"
+  s3url: "some.s3.url"
+  uppmaxUsername: "user"
+  uppmaxPassword: "password"
+  accountVerifier: allowlist
+  projectRegistries: file
+allowlist:
+  file: ` + suite.TempDir + `/allowlist
+projects:
+  file: ` + suite.TempDir + `/projects.yaml
+`
+	err := os.WriteFile(suite.TempDir+"/allowlist", []byte("some.user@nbis.se\n"), 0600)
+	assert.NoError(suite.T(), err)
+	err = os.WriteFile(suite.TempDir+"/projects.yaml", []byte("projects:\n  - id: sda001\n    pi: some.user@nbis.se\n"), 0600)
+	assert.NoError(suite.T(), err)
+	testhelpers.WriteConfig(suite.T(), confData)
+
+	conf := &helpers.Conf{}
+	err = helpers.NewConf(conf)
+	assert.NoError(suite.T(), err)
+	other := *conf
+	other.Iss = "https://other.url"
+	other.Username = "other-user"
+
+	first, err := NewService(conf, nil, nil)
+	assert.NoError(suite.T(), err)
+	second, err := NewService(&other, nil, nil)
+	assert.NoError(suite.T(), err)
+
+	for service, iss := range map[*Service]string{first: "https://some.url", second: "https://other.url"} {
+		r := httptest.NewRequest(http.MethodPost, "/token?version=2", strings.NewReader(`{"swamid": "some.user@nbis.se", "projectid": "sda001"}`))
+		w := httptest.NewRecorder()
+		service.GetToken(w, r)
+		assert.Equal(suite.T(), http.StatusOK, w.Code)
+		var response tokenResponseV2
+		assert.NoError(suite.T(), json.Unmarshal(w.Body.Bytes(), &response))
+		token, _ := jwt.Parse(response.AccessToken, func(_ *jwt.Token) (interface{}, error) { return nil, nil })
+		claims, _ := token.Claims.(jwt.MapClaims)
+		assert.Equal(suite.T(), iss, claims["iss"])
+	}
+
+	// The basic auth credentials are those of each service
+	mux := http.NewServeMux()
+	second.Register(mux)
+	r := httptest.NewRequest(http.MethodPost, "/token", strings.NewReader(`{"swamid": "some.user@nbis.se", "projectid": "sda001"}`))
+	r.SetBasicAuth("user", "password")
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, r)
+	assert.Equal(suite.T(), http.StatusUnauthorized, w.Code)
+}
+
 func (suite *TestSuite) TestCreateResponse() {
 
 	requestBody := &tokenRequest{
@@ -154,22 +269,30 @@ func (suite *TestSuite) TestCreateResponse() {
   uppmaxUsername: "user"
   uppmaxPassword: "password"
 `
-	configName := "config.yaml"
-	err := os.WriteFile(configName, []byte(confData), 0600)
-	if err != nil {
-		log.Printf("failed to write temp config file, %v", err)
-	}
+	configName := testhelpers.WriteConfig(suite.T(), confData)
 
-	err = helpers.NewConf(&helpers.Config)
+	conf := &helpers.Conf{}
+	err := helpers.NewConf(conf)
 	assert.NoError(suite.T(), err)
+	st := &state{conf: conf}
 
-	responseBody, err := createResponse(*requestBody, "someuser")
+	responseBody, err := st.createResponse(*requestBody, "someuser", "user", time.Now(), time.Now().Add(time.Hour))
 	assert.NoError(suite.T(), err)
 	// Check that the base64 encoded key in the response is the expected one
-	assert.Equal(suite.T(), "LS0tLS1CRUdJTiBDUllQVDRHSCBQVUJMSUMgS0VZLS0tLS0KdlNvbWUrYXNkL2FwdWJsaWNLZXkKLS0tLS1FTkQgQ1JZUFQ0R0ggUFVCTElDIEtFWS0tLS0t", responseBody.Crypt4ghKey)
+	assert.Equal(suite.T(), "LS0tLS1CRUdJTiBDUllQVDRHSCBQVUJMSUMgS0VZLS0tLS0KRGl1QWxZZHBkcjdqd0NJZGVIS3dKZFhHblVHQlZVWndSSE8yaU1HME8yRT0KLS0tLS1FTkQgQ1JZUFQ0R0ggUFVCTElDIEtFWS0tLS0t", responseBody.Crypt4ghKey)
 	assert.Equal(suite.T(), requestBody.ProjectID, responseBody.ProjectID)
 	assert.Equal(suite.T(), requestBody.SwamID, responseBody.SwamID)
 
+	// Projects with a key of their own get that key in both response versions
+	conf.Crypt4ghProjectKeys = []helpers.Crypt4ghProjectKey{{Pattern: "some*", Key: "cHJvamVjdC1rZXk="}}
+	defer func() { conf.Crypt4ghProjectKeys = nil }()
+	responseBody, err = st.createResponse(*requestBody, "someuser", "user", time.Now(), time.Now().Add(time.Hour))
+	assert.NoError(suite.T(), err)
+	assert.Equal(suite.T(), "cHJvamVjdC1rZXk=", responseBody.Crypt4ghKey)
+	responseV2, err := st.createResponseV2(*requestBody, "someuser", "user", time.Now(), time.Now().Add(time.Hour))
+	assert.NoError(suite.T(), err)
+	assert.Equal(suite.T(), "project-key", responseV2.Crypt4ghKey)
+
 	defer os.Remove(configName)
 }
 
@@ -208,19 +331,19 @@ func (suite *TestSuite) TestSuccessfulVerifications() {
   uppmaxUsername: "user"
   uppmaxPassword: "password"
 `
-	configName := "config.yaml"
-	err := os.WriteFile(configName, []byte(confData), 0600)
-	if err != nil {
-		log.Printf("failed to write temp config file, %v", err)
-	}
+	testhelpers.WriteConfig(suite.T(), confData)
 
-	err = helpers.NewConf(&helpers.Config)
+	conf := &helpers.Conf{}
+	err := helpers.NewConf(conf)
+	assert.NoError(suite.T(), err)
+	service, err := NewService(conf, nil, nil)
 	assert.NoError(suite.T(), err)
+	st := service.current.Load()
 
-	err = verifyEGABoxAccount(requestBody.SwamID)
+	err = st.verifyAccount(context.Background(), requestBody.SwamID)
 	assert.NoError(suite.T(), err)
 
-	err = verifyProjectAccount(requestBody.SwamID, requestBody.ProjectID)
+	_, err = st.verifyProjectAccount(context.Background(), requestBody.SwamID, requestBody.ProjectID)
 	assert.NoError(suite.T(), err)
 
 }
@@ -257,23 +380,49 @@ func (suite *TestSuite) TestFailedVerifications() {
   uppmaxUsername: "user"
   uppmaxPassword: "password"
 `
-	configName := "config.yaml"
-	err := os.WriteFile(configName, []byte(confData), 0600)
-	if err != nil {
-		log.Printf("failed to write temp config file, %v", err)
-	}
+	testhelpers.WriteConfig(suite.T(), confData)
 
-	err = helpers.NewConf(&helpers.Config)
+	conf := &helpers.Conf{}
+	err := helpers.NewConf(conf)
 	assert.NoError(suite.T(), err)
+	service, err := NewService(conf, nil, nil)
+	assert.NoError(suite.T(), err)
+	st := service.current.Load()
 
-	err = verifyEGABoxAccount(requestBody.SwamID)
-	log.Print(err)
-	assert.Equal(suite.T(), fmt.Errorf("got [] from EGA"), err)
+	err = st.verifyAccount(context.Background(), requestBody.SwamID)
+	assert.EqualError(suite.T(), err, "got [] from EGA")
 
-	err = verifyProjectAccount(requestBody.SwamID, requestBody.ProjectID)
+	_, err = st.verifyProjectAccount(context.Background(), requestBody.SwamID, requestBody.ProjectID)
 	assert.Equal(suite.T(), fmt.Errorf("got [] from SUPR"), err)
 }
 
+// TestSuprQuery checks that the project is escaped in the query to SUPR and
+// that a project matching several SUPR projects is rejected
+func (suite *TestSuite) TestSuprQuery() {
+	var names []string
+	supr := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		names = append(names, r.URL.Query()["name"]...)
+		assert.Len(suite.T(), r.URL.Query(), 1)
+		if r.URL.Query().Get("name") == "twin" {
+			_, _ = io.WriteString(w, "{\"matches\": [{\"pi\": {\"email\": \"some.user@nbis.se\"}}, {\"pi\": {\"email\": \"some.user@nbis.se\"}}]}")
+
+			return
+		}
+		_, _ = io.WriteString(w, "{\"matches\": [{\"pi\": {\"email\": \"some.user@nbis.se\"}}]}")
+	}))
+	defer supr.Close()
+
+	authorizer := NewSuprAuthorizer(supr.URL, "user", "pass", upstream.NewClient("SUPR", upstream.Options{}))
+	_, err := authorizer.AuthorizeProject(context.Background(), "some.user@nbis.se", "sda 001&type=other#x")
+	assert.NoError(suite.T(), err)
+	assert.Equal(suite.T(), []string{"sda 001&type=other#x"}, names)
+
+	_, err = authorizer.AuthorizeProject(context.Background(), "some.user@nbis.se", "twin")
+	assert.EqualError(suite.T(), err, "project is ambiguous in SUPR")
+	var denied *deniedError
+	assert.True(suite.T(), errors.As(err, &denied))
+}
+
 // TestWrongSuprUser tests the case where SUPR returns a project with a user
 // different than the one the request was made for
 func (suite *TestSuite) TestWrongSuprUser() {
@@ -309,16 +458,1509 @@ func (suite *TestSuite) TestWrongSuprUser() {
   uppmaxUsername: "user"
   uppmaxPassword: "password"
 `
-	configName := "config.yaml"
-	err := os.WriteFile(configName, []byte(confData), 0600)
-	if err != nil {
-		log.Printf("failed to write temp config file, %v", err)
+	testhelpers.WriteConfig(suite.T(), confData)
+
+	conf := &helpers.Conf{}
+	err := helpers.NewConf(conf)
+	assert.NoError(suite.T(), err)
+	service, err := NewService(conf, nil, nil)
+	assert.NoError(suite.T(), err)
+	st := service.current.Load()
+
+	_, err = st.verifyProjectAccount(context.Background(), requestBody.SwamID, requestBody.ProjectID)
+	assert.EqualError(suite.T(), err, "email is different than PI in requested project")
+
+}
+
+// TestCachedVerifications checks that positive and negative answers from EGA
+// and SUPR are cached and that the cache can be flushed
+func (suite *TestSuite) TestCachedVerifications() {
+	egaCalls := 0
+	ega := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		egaCalls++
+		if strings.HasSuffix(r.URL.Path, "unknown.user@nbis.se") {
+			w.WriteHeader(http.StatusNotFound)
+
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		_, _ = io.WriteString(w, "{\"response\": {\"numTotalResults\": 1, \"result\": [{\"username\": \"some.user@nbis.se\"}]}}")
+	}))
+	defer ega.Close()
+
+	suprCalls := 0
+	supr := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		suprCalls++
+		w.WriteHeader(http.StatusOK)
+		_, _ = io.WriteString(w, "{\"matches\": [{\"pi\": {\"email\": \"some.user@nbis.se\"}}]}")
+	}))
+	defer supr.Close()
+
+	confData := `global:
+  crypt4ghKey: ` + suite.Crypt4ghKeyPath + `
+  egaUsername: "some-user"
+  egaPassword: "some-pass"
+  egaURL: "` + ega.URL + `"
+  expirationDays: 14
+  iss: "https://some.url"
+  jwtKey: "` + suite.PrivateKeyPath + `"
+  suprUsername: "some-user"
+  suprPassword: "some-pass"
+  suprURL: "` + supr.URL + `"
+  s3url: "some.s3.url"
+  uppmaxUsername: "user"
+  uppmaxPassword: "password"
+cache:
+  positiveTTL: 1h
+  negativeTTL: 1h
+`
+	testhelpers.WriteConfig(suite.T(), confData)
+
+	conf := &helpers.Conf{}
+	err := helpers.NewConf(conf)
+	assert.NoError(suite.T(), err)
+	service, err := NewService(conf, cache.NewMemoryStore(), nil)
+	assert.NoError(suite.T(), err)
+	st := service.current.Load()
+
+	for i := 0; i < 2; i++ {
+		assert.NoError(suite.T(), st.verifyAccount(context.Background(), "some.user@nbis.se"))
+		assert.EqualError(suite.T(), st.verifyAccount(context.Background(), "unknown.user@nbis.se"), "got [] from EGA")
+		_, err = st.verifyProjectAccount(context.Background(), "some.user@nbis.se", "someproject")
+		assert.NoError(suite.T(), err)
+		_, err = st.verifyProjectAccount(context.Background(), "other.user@nbis.se", "someproject")
+		assert.EqualError(suite.T(), err, "email is different than PI in requested project")
+	}
+	assert.Equal(suite.T(), 2, egaCalls)
+	assert.Equal(suite.T(), 2, suprCalls)
+
+	// Flush the entries of a single user
+	w := httptest.NewRecorder()
+	service.FlushCache(w, httptest.NewRequest(http.MethodDelete, "/admin/cache?swamid=some.user@nbis.se", nil))
+	assert.Equal(suite.T(), http.StatusNoContent, w.Code)
+
+	assert.NoError(suite.T(), st.verifyAccount(context.Background(), "some.user@nbis.se"))
+	_, err = st.verifyProjectAccount(context.Background(), "some.user@nbis.se", "someproject")
+	assert.NoError(suite.T(), err)
+	assert.EqualError(suite.T(), st.verifyAccount(context.Background(), "unknown.user@nbis.se"), "got [] from EGA")
+	assert.Equal(suite.T(), 3, egaCalls)
+	assert.Equal(suite.T(), 3, suprCalls)
+
+	// Flush everything
+	w = httptest.NewRecorder()
+	service.FlushCache(w, httptest.NewRequest(http.MethodDelete, "/admin/cache", nil))
+	assert.Equal(suite.T(), http.StatusNoContent, w.Code)
+
+	assert.EqualError(suite.T(), st.verifyAccount(context.Background(), "unknown.user@nbis.se"), "got [] from EGA")
+	assert.Equal(suite.T(), 4, egaCalls)
+
+	w = httptest.NewRecorder()
+	service.FlushCache(w, httptest.NewRequest(http.MethodGet, "/admin/cache", nil))
+	assert.Equal(suite.T(), http.StatusMethodNotAllowed, w.Code)
+}
+
+// TestUpstreamRetries checks that transient EGA failures are retried and that
+// an upstream that keeps failing is reported in the readiness endpoint
+func (suite *TestSuite) TestUpstreamRetries() {
+	egaCalls := 0
+	ega := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		egaCalls++
+		if egaCalls == 1 || egaCalls > 2 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		_, _ = io.WriteString(w, "{\"response\": {\"numTotalResults\": 1, \"result\": [{\"username\": \"some.user@nbis.se\"}]}}")
+	}))
+	defer ega.Close()
+
+	confData := `global:
+  crypt4ghKey: ` + suite.Crypt4ghKeyPath + `
+  egaUsername: "some-user"
+  egaPassword: "some-pass"
+  egaURL: "` + ega.URL + `"
+  expirationDays: 14
+  iss: "https://some.url"
+  jwtKey: "` + suite.PrivateKeyPath + `"
+  suprUsername: "some-user"
+  suprPassword: "some-pass"
+  suprURL: "http://supr.dev"
+  s3url: "some.s3.url"
+  uppmaxUsername: "user"
+  uppmaxPassword: "password"
+upstream:
+  retries: 1
+  backoff: 1ms
+  breakerThreshold: 1
+  breakerCooldown: 1h
+`
+	testhelpers.WriteConfig(suite.T(), confData)
+
+	conf := &helpers.Conf{}
+	err := helpers.NewConf(conf)
+	assert.NoError(suite.T(), err)
+	service, err := NewService(conf, nil, nil)
+	assert.NoError(suite.T(), err)
+	st := service.current.Load()
+
+	assert.NoError(suite.T(), st.verifyAccount(context.Background(), "some.user@nbis.se"))
+	assert.Equal(suite.T(), 2, egaCalls)
+
+	w := httptest.NewRecorder()
+	service.Ready(w, httptest.NewRequest(http.MethodGet, "/ready", nil))
+	assert.Equal(suite.T(), http.StatusOK, w.Code)
+
+	assert.EqualError(suite.T(), st.verifyAccount(context.Background(), "some.user@nbis.se"), "got [] from EGA")
+	assert.Equal(suite.T(), 4, egaCalls)
+
+	// The breaker is now open and the EGA service is not called
+	assert.EqualError(suite.T(), st.verifyAccount(context.Background(), "some.user@nbis.se"), "EGA: circuit breaker is open")
+	assert.Equal(suite.T(), 4, egaCalls)
+
+	w = httptest.NewRecorder()
+	service.Ready(w, httptest.NewRequest(http.MethodGet, "/ready", nil))
+	assert.Equal(suite.T(), http.StatusServiceUnavailable, w.Code)
+	assert.JSONEq(suite.T(), `{"EGA": "unavailable", "SUPR": "available"}`, w.Body.String())
+}
+
+// ldapStub is an in-process replacement for an LDAP server, which knows the
+// accounts in entries
+type ldapStub struct {
+	entries  map[string][]*ldap.Entry
+	bindDN   string
+	password string
+	searches []string
+}
+
+func (l *ldapStub) Bind(username, password string) error {
+	if username != l.bindDN || password != l.password {
+		return ldap.NewError(ldap.LDAPResultInvalidCredentials, fmt.Errorf("invalid credentials"))
+	}
+
+	return nil
+}
+
+func (l *ldapStub) Search(searchRequest *ldap.SearchRequest) (*ldap.SearchResult, error) {
+	l.searches = append(l.searches, searchRequest.Filter)
+
+	return &ldap.SearchResult{Entries: l.entries[searchRequest.Filter]}, nil
+}
+
+func (l *ldapStub) Close() error {
+	return nil
+}
+
+func (suite *TestSuite) TestLDAPVerifier() {
+	stub := &ldapStub{
+		entries: map[string][]*ldap.Entry{
+			"(mail=some.user@nbis.se)": {ldap.NewEntry("uid=someuser,dc=sda,dc=dev", nil)},
+			"(mail=twin@nbis.se)": {
+				ldap.NewEntry("uid=twin1,dc=sda,dc=dev", nil),
+				ldap.NewEntry("uid=twin2,dc=sda,dc=dev", nil),
+			},
+		},
+		bindDN:   "cn=admin,dc=sda,dc=dev",
+		password: "secret",
+	}
+
+	verifier, err := NewLDAPVerifier(LDAPOptions{BaseDN: "dc=sda,dc=dev", BindDN: stub.bindDN, BindPassword: stub.password})
+	assert.NoError(suite.T(), err)
+	verifier.dial = func(time.Duration) (ldapConn, error) { return stub, nil }
+
+	assert.NoError(suite.T(), verifier.VerifyAccount(context.Background(), "some.user@nbis.se"))
+	assert.EqualError(suite.T(), verifier.VerifyAccount(context.Background(), "other.user@nbis.se"), "account not found in LDAP")
+	assert.EqualError(suite.T(), verifier.VerifyAccount(context.Background(), "twin@nbis.se"), "account is ambiguous in LDAP")
+
+	// The username is escaped in the search filter
+	assert.EqualError(suite.T(), verifier.VerifyAccount(context.Background(), "*)(uid=*"), "account not found in LDAP")
+	assert.Equal(suite.T(), `(mail=\2a\29\28uid=\2a)`, stub.searches[len(stub.searches)-1])
+
+	verifier, _ = NewLDAPVerifier(LDAPOptions{BaseDN: "dc=sda,dc=dev", BindDN: stub.bindDN, BindPassword: "wrong"})
+	verifier.dial = func(time.Duration) (ldapConn, error) { return stub, nil }
+	err = verifier.VerifyAccount(context.Background(), "some.user@nbis.se")
+	assert.ErrorContains(suite.T(), err, "could not bind to LDAP")
+	var denied *deniedError
+	assert.False(suite.T(), errors.As(err, &denied))
+
+	// The time limit of the search is rounded up to whole seconds
+	assert.Equal(suite.T(), 0, searchTimeLimit(0))
+	assert.Equal(suite.T(), 1, searchTimeLimit(50*time.Millisecond))
+	assert.Equal(suite.T(), 1, searchTimeLimit(time.Second))
+	assert.Equal(suite.T(), 2, searchTimeLimit(1500*time.Millisecond))
+
+	// The filter must contain the username exactly once
+	for _, filter := range []string{"(uid=%s)", "(&(mail=%s)(objectClass=person)(cn=100%%))"} {
+		_, err = NewLDAPVerifier(LDAPOptions{Filter: filter})
+		assert.NoError(suite.T(), err, filter)
+	}
+	for _, filter := range []string{"(mail=someuser)", "(|(mail=%s)(uid=%s))", "(mail=%d)", "(&(mail=%s)(cn=%v))", "(mail=%%s)"} {
+		_, err = NewLDAPVerifier(LDAPOptions{Filter: filter})
+		assert.ErrorContains(suite.T(), err, "must contain %s exactly once", filter)
 	}
+}
+
+func (suite *TestSuite) TestEGAVerifier() {
+	var paths []string
+	ega := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		paths = append(paths, r.URL.EscapedPath())
+		if r.URL.Path != "/users/some.user@nbis.se" {
+			w.WriteHeader(http.StatusNotFound)
+
+			return
+		}
+		_, _ = io.WriteString(w, `{"response": {"numTotalResults": 1, "result": [{"username": "some.user@nbis.se"}]}}`)
+	}))
+	defer ega.Close()
+
+	verifier := NewEGAVerifier(ega.URL+"/users", "user", "pass", upstream.NewClient("EGA", upstream.Options{}))
+	assert.NoError(suite.T(), verifier.VerifyAccount(context.Background(), "some.user@nbis.se"))
+
+	// The username is escaped in the path
+	err := verifier.VerifyAccount(context.Background(), "../admin?user=x#")
+	var denied *deniedError
+	assert.True(suite.T(), errors.As(err, &denied))
+	assert.Equal(suite.T(), "/users/..%2Fadmin%3Fuser=x%23", paths[len(paths)-1])
+}
+
+func (suite *TestSuite) TestAllowlistVerifier() {
+	allowlist := suite.TempDir + "/allowlist"
+	err := os.WriteFile(allowlist, []byte("# allowed accounts\nsome.user@nbis.se\n\n  other.user@nbis.se \n"), 0600)
+	assert.NoError(suite.T(), err)
+
+	verifier, err := NewAllowlistVerifier(allowlist)
+	assert.NoError(suite.T(), err)
+	assert.NoError(suite.T(), verifier.VerifyAccount(context.Background(), "some.user@nbis.se"))
+	assert.NoError(suite.T(), verifier.VerifyAccount(context.Background(), "other.user@nbis.se"))
+	assert.EqualError(suite.T(), verifier.VerifyAccount(context.Background(), "# allowed accounts"), "account not in allowlist")
+	assert.EqualError(suite.T(), verifier.VerifyAccount(context.Background(), "unknown.user@nbis.se"), "account not in allowlist")
+
+	_, err = NewAllowlistVerifier(suite.TempDir + "/missing")
+	assert.ErrorContains(suite.T(), err, "could not read account allowlist")
+
+	// The allowlist is selected in the configuration
+	confData := `global:
+  accountVerifier: allowlist
+  crypt4ghKey: ` + suite.Crypt4ghKeyPath + `
+  expirationDays: 14
+  iss: "https://some.url"
+  jwtKey: "` + suite.PrivateKeyPath + `"
+  suprUsername: "some-user"
+  suprPassword: "some-pass"
+  suprURL: "http://supr.dev"
+  s3url: "some.s3.url"
+  uppmaxUsername: "user"
+  uppmaxPassword: "password"
+allowlist:
+  file: ` + allowlist + `
+`
+	testhelpers.WriteConfig(suite.T(), confData)
+
+	conf := &helpers.Conf{}
+	err = helpers.NewConf(conf)
+	assert.NoError(suite.T(), err)
+	service, err := NewService(conf, nil, nil)
+	assert.NoError(suite.T(), err)
+	st := service.current.Load()
+	assert.IsType(suite.T(), &AllowlistVerifier{}, st.accountVerifier)
+	assert.NoError(suite.T(), st.verifyAccount(context.Background(), "some.user@nbis.se"))
+
+	// A configuration that can not be set up does not replace the backends in use
+	invalid := *conf
+	invalid.AllowlistPath = suite.TempDir + "/missing"
+	assert.Error(suite.T(), service.Reload(&invalid))
+	assert.Same(suite.T(), st, service.current.Load())
+	assert.NoError(suite.T(), st.verifyAccount(context.Background(), "some.user@nbis.se"))
+}
+
+func (suite *TestSuite) TestFileAuthorizer() {
+	yamlFile := suite.TempDir + "/projects.yaml"
+	err := os.WriteFile(yamlFile, []byte("projects:\n  - id: sda001\n    pi: some.user@nbis.se\n"), 0600)
+	assert.NoError(suite.T(), err)
+	jsonFile := suite.TempDir + "/projects.json"
+	err = os.WriteFile(jsonFile, []byte(`{"projects": [{"id": "sda002", "pi": "other.user@nbis.se"}]}`), 0600)
+	assert.NoError(suite.T(), err)
+
+	authorizer, err := NewFileAuthorizer(yamlFile)
+	assert.NoError(suite.T(), err)
+	_, err = authorizer.AuthorizeProject(context.Background(), "some.user@nbis.se", "sda001")
+	assert.NoError(suite.T(), err)
+	_, err = authorizer.AuthorizeProject(context.Background(), "other.user@nbis.se", "sda001")
+	assert.EqualError(suite.T(), err, "email is different than PI in requested project")
+	_, err = authorizer.AuthorizeProject(context.Background(), "some.user@nbis.se", "sda002")
+	assert.ErrorIs(suite.T(), err, ErrUnknownProject)
+
+	authorizer, err = NewFileAuthorizer(jsonFile)
+	assert.NoError(suite.T(), err)
+	_, err = authorizer.AuthorizeProject(context.Background(), "other.user@nbis.se", "sda002")
+	assert.NoError(suite.T(), err)
+
+	err = os.WriteFile(jsonFile, []byte(`{"projects": [{"id": "sda002"}]}`), 0600)
+	assert.NoError(suite.T(), err)
+	_, err = NewFileAuthorizer(jsonFile)
+	assert.EqualError(suite.T(), err, "could not parse project file: project without id or pi")
+
+	_, err = NewFileAuthorizer(suite.TempDir + "/missing.yaml")
+	assert.ErrorContains(suite.T(), err, "could not read project file")
+}
+
+// TestProjectChain checks that the first registry knowing the project decides,
+// using a project file in front of a mock SUPR server
+func (suite *TestSuite) TestProjectChain() {
+	suprCalls := 0
+	supr := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		suprCalls++
+		w.WriteHeader(http.StatusOK)
+		if !strings.HasPrefix(r.URL.Query().Get("name"), "supr") {
+			_, _ = io.WriteString(w, "{\"matches\": []}")
+
+			return
+		}
+		_, _ = io.WriteString(w, "{\"matches\": [{\"pi\": {\"email\": \"supr.user@nbis.se\"}}]}")
+	}))
+	defer supr.Close()
+
+	projectFile := suite.TempDir + "/projects.yaml"
+	err := os.WriteFile(projectFile, []byte("projects:\n  - id: sda001\n    pi: some.user@nbis.se\n  - id: supr001\n    pi: some.user@nbis.se\n"), 0600)
+	assert.NoError(suite.T(), err)
+
+	confData := `global:
+  crypt4ghKey: ` + suite.Crypt4ghKeyPath + `
+  egaUsername: "some-user"
+  egaPassword: "some-pass"
+  egaURL: "http://ega.dev"
+  expirationDays: 14
+  iss: "https://some.url"
+  jwtKey: "` + suite.PrivateKeyPath + `"
+  projectRegistries: "file,supr"
+  suprUsername: "some-user"
+  suprPassword: "some-pass"
+  suprURL: "` + supr.URL + `"
+  s3url: "some.s3.url"
+  uppmaxUsername: "user"
+  uppmaxPassword: "password"
+projects:
+  file: ` + projectFile + `
+`
+	testhelpers.WriteConfig(suite.T(), confData)
+
+	conf := &helpers.Conf{}
+	err = helpers.NewConf(conf)
+	assert.NoError(suite.T(), err)
+	assert.Equal(suite.T(), []string{"file", "supr"}, conf.ProjectRegistries)
+	service, err := NewService(conf, nil, nil)
+	assert.NoError(suite.T(), err)
+	st := service.current.Load()
 
-	err = helpers.NewConf(&helpers.Config)
+	// Known by the project file
+	_, err = st.verifyProjectAccount(context.Background(), "some.user@nbis.se", "sda001")
 	assert.NoError(suite.T(), err)
+	_, err = st.verifyProjectAccount(context.Background(), "supr.user@nbis.se", "supr001")
+	assert.EqualError(suite.T(), err, "email is different than PI in requested project")
+	assert.Equal(suite.T(), 0, suprCalls)
+
+	// Only known by SUPR
+	_, err = st.verifyProjectAccount(context.Background(), "supr.user@nbis.se", "supr002")
+	assert.NoError(suite.T(), err)
+	assert.Equal(suite.T(), 1, suprCalls)
+
+	// Not known by any registry
+	_, err = st.verifyProjectAccount(context.Background(), "some.user@nbis.se", "sda003")
+	assert.ErrorIs(suite.T(), err, ErrUnknownProject)
+	assert.EqualError(suite.T(), err, "project not found")
+	assert.Equal(suite.T(), 2, suprCalls)
+}
+
+type accountFunc func(ctx context.Context, username string) error
+
+func (f accountFunc) VerifyAccount(ctx context.Context, username string) error {
+	return f(ctx, username)
+}
+
+type projectFunc func(ctx context.Context, username, projectID string) error
+
+func (f projectFunc) AuthorizeProject(ctx context.Context, username, projectID string) (Project, error) {
+	return Project{}, f(ctx, username, projectID)
+}
+
+// withVerifiers returns a state using the given account verifier and project authorizer
+func withVerifiers(account AccountVerifier, project ProjectAuthorizer) *state {
+	return &state{conf: &helpers.Conf{}, accountVerifier: account, projectAuthorizer: project}
+}
+
+// blockUntilCancelled waits for the context to be cancelled and returns its error
+func blockUntilCancelled(ctx context.Context) error {
+	<-ctx.Done()
+
+	return ctx.Err()
+}
+
+func (suite *TestSuite) TestVerifyRequest() {
+	accountDenied := &deniedError{message: "account not in allowlist"}
+	projectDenied := &deniedError{message: "email is different than PI in requested project"}
+
+	// Both checks succeed
+	st := withVerifiers(
+		accountFunc(func(context.Context, string) error { return nil }),
+		projectFunc(func(context.Context, string, string) error { return nil }),
+	)
+	_, accountErr, projectErr := st.verifyRequest(context.Background(), "some.user@nbis.se", "sda001")
+	assert.NoError(suite.T(), accountErr)
+	assert.NoError(suite.T(), projectErr)
+
+	// A failed check cancels the slower one, which is not reported
+	var slowErr error
+	st = withVerifiers(
+		accountFunc(func(context.Context, string) error { return accountDenied }),
+		projectFunc(func(ctx context.Context, _, _ string) error {
+			slowErr = blockUntilCancelled(ctx)
+
+			return slowErr
+		}),
+	)
+	_, accountErr, projectErr = st.verifyRequest(context.Background(), "some.user@nbis.se", "sda001")
+	assert.Equal(suite.T(), accountDenied, accountErr)
+	assert.NoError(suite.T(), projectErr)
+	assert.ErrorIs(suite.T(), slowErr, context.Canceled)
+
+	st = withVerifiers(
+		accountFunc(func(ctx context.Context, _ string) error { return blockUntilCancelled(ctx) }),
+		projectFunc(func(context.Context, string, string) error { return projectDenied }),
+	)
+	_, accountErr, projectErr = st.verifyRequest(context.Background(), "some.user@nbis.se", "sda001")
+	assert.NoError(suite.T(), accountErr)
+	assert.Equal(suite.T(), projectDenied, projectErr)
+
+	// When both checks fail the account error is reported, whichever check
+	// finishes first
+	for _, delay := range []time.Duration{0, 10 * time.Millisecond} {
+		st = withVerifiers(
+			accountFunc(func(context.Context, string) error {
+				time.Sleep(delay)
+
+				return accountDenied
+			}),
+			projectFunc(func(context.Context, string, string) error {
+				time.Sleep(10*time.Millisecond - delay)
+
+				return projectDenied
+			}),
+		)
+		_, accountErr, projectErr = st.verifyRequest(context.Background(), "some.user@nbis.se", "sda001")
+		assert.Equal(suite.T(), accountDenied, accountErr)
+		assert.NoError(suite.T(), projectErr)
+	}
+
+	// A denial is reported in preference to a timeout of the other check
+	st = withVerifiers(
+		accountFunc(func(context.Context, string) error { return fmt.Errorf("EGA: %w", upstream.ErrTimeout) }),
+		projectFunc(func(context.Context, string, string) error { return projectDenied }),
+	)
+	st.conf.RequestBudget = time.Second
+	w := httptest.NewRecorder()
+	st.issueToken(w, httptest.NewRequest(http.MethodPost, "/token", nil), tokenRequest{SwamID: "some.user@nbis.se", ProjectID: "sda001"}, "", 1, nil)
+	assert.Equal(suite.T(), http.StatusInternalServerError, w.Code)
+	assert.Contains(suite.T(), w.Body.String(), "Unauthorized to access specified project")
+
+	// The request is cancelled by the client
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	st = withVerifiers(
+		accountFunc(func(ctx context.Context, _ string) error { return blockUntilCancelled(ctx) }),
+		projectFunc(func(ctx context.Context, _, _ string) error { return blockUntilCancelled(ctx) }),
+	)
+	_, accountErr, projectErr = st.verifyRequest(ctx, "some.user@nbis.se", "sda001")
+	assert.ErrorIs(suite.T(), accountErr, context.Canceled)
+	assert.NoError(suite.T(), projectErr)
+}
+
+// TestGetTokenTimeout checks that upstream calls are bounded by the request
+// budget and that a timeout is reported as such
+func (suite *TestSuite) TestGetTokenTimeout() {
+	ega := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+		case <-time.After(5 * time.Second):
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer ega.Close()
+
+	supr := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		_, _ = io.WriteString(w, "{\"matches\": [{\"pi\": {\"email\": \"some.user@nbis.se\"}}]}")
+	}))
+	defer supr.Close()
+
+	confData := `global:
+  crypt4ghKey: ` + suite.Crypt4ghKeyPath + `
+  egaUsername: "some-user"
+  egaPassword: "some-pass"
+  egaURL: "` + ega.URL + `"
+  expirationDays: 14
+  iss: "https://some.url"
+  jwtKey: "` + suite.PrivateKeyPath + `"
+  suprUsername: "some-user"
+  suprPassword: "some-pass"
+  suprURL: "` + supr.URL + `"
+  s3url: "some.s3.url"
+  uppmaxUsername: "user"
+  uppmaxPassword: "password"
+upstream:
+  requestBudget: 50ms
+`
+	testhelpers.WriteConfig(suite.T(), confData)
+
+	conf := &helpers.Conf{}
+	err := helpers.NewConf(conf)
+	assert.NoError(suite.T(), err)
+	service, err := NewService(conf, nil, nil)
+	assert.NoError(suite.T(), err)
+
+	body := `{"swamid": "some.user@nbis.se", "projectid": "someproject"}`
+	start := time.Now()
+	w := httptest.NewRecorder()
+	service.GetToken(w, httptest.NewRequest(http.MethodPost, "/token", strings.NewReader(body)))
+	assert.Less(suite.T(), time.Since(start), time.Second)
+	assert.Equal(suite.T(), http.StatusGatewayTimeout, w.Code)
+	assert.Contains(suite.T(), w.Body.String(), "Timed out verifying access to specified project")
+
+	// A request cancelled by the client stops the upstream calls
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(10*time.Millisecond, cancel)
+	w = httptest.NewRecorder()
+	service.GetToken(w, httptest.NewRequest(http.MethodPost, "/token", strings.NewReader(body)).WithContext(ctx))
+	assert.Empty(suite.T(), w.Body.String())
+}
+
+// TestUpstreamUnavailable checks that requests rejected by an open circuit
+// breaker are reported as a temporary failure
+func (suite *TestSuite) TestUpstreamUnavailable() {
+	ega := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer ega.Close()
+
+	supr := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		_, _ = io.WriteString(w, "{\"matches\": [{\"pi\": {\"email\": \"some.user@nbis.se\"}}]}")
+	}))
+	defer supr.Close()
+
+	userinfo := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		_, _ = io.WriteString(w, `{"email": "some.user@nbis.se"}`)
+	}))
+	defer userinfo.Close()
+
+	conf := suite.newConf(map[string]any{
+		"global.egaURL":             ega.URL,
+		"global.suprURL":            supr.URL,
+		"oauth.userinfoURL":         userinfo.URL,
+		"upstream.retries":          0,
+		"upstream.breakerThreshold": 2,
+		"upstream.breakerCooldown":  "1h",
+	})
+	service, err := NewService(conf, nil, nil)
+	assert.NoError(suite.T(), err)
+
+	exchange := func() (int, string) {
+		form := "grant_type=urn%3Aietf%3Aparams%3Aoauth%3Agrant-type%3Atoken-exchange&subject_token_type=urn%3Aietf%3Aparams%3Aoauth%3Atoken-type%3Aaccess_token&subject_token=valid&resource=someproject"
+		r := httptest.NewRequest(http.MethodPost, "/oauth/token", strings.NewReader(form))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		r.SetBasicAuth("user", "password")
+		w := httptest.NewRecorder()
+		service.ExchangeToken(w, r)
+		var response map[string]any
+		assert.NoError(suite.T(), json.Unmarshal(w.Body.Bytes(), &response))
+		code, _ := response["error"].(string)
+
+		return w.Code, code
+	}
+
+	// A failing upstream is not a denial of access to the project
+	status, code := exchange()
+	assert.Equal(suite.T(), http.StatusInternalServerError, status)
+	assert.Equal(suite.T(), "server_error", code)
+
+	// The second failure opens the breaker of EGA
+	body := `{"swamid": "some.user@nbis.se", "projectid": "someproject"}`
+	w := httptest.NewRecorder()
+	service.GetToken(w, httptest.NewRequest(http.MethodPost, "/token", strings.NewReader(body)))
+	assert.Equal(suite.T(), http.StatusInternalServerError, w.Code)
+
+	w = httptest.NewRecorder()
+	service.GetToken(w, httptest.NewRequest(http.MethodPost, "/token", strings.NewReader(body)))
+	assert.Equal(suite.T(), http.StatusServiceUnavailable, w.Code)
+	assert.Contains(suite.T(), w.Body.String(), "try again later")
+
+	status, code = exchange()
+	assert.Equal(suite.T(), http.StatusServiceUnavailable, status)
+	assert.Equal(suite.T(), "temporarily_unavailable", code)
+
+	// A reload keeps the breaker open, unless the upstream settings changed
+	clients := service.current.Load().upstreams
+	assert.NoError(suite.T(), service.Reload(conf))
+	assert.Equal(suite.T(), clients, service.current.Load().upstreams)
+	w = httptest.NewRecorder()
+	service.GetToken(w, httptest.NewRequest(http.MethodPost, "/token", strings.NewReader(body)))
+	assert.Equal(suite.T(), http.StatusServiceUnavailable, w.Code)
+
+	changed := *conf
+	changed.BreakerCooldown = time.Minute
+	assert.NoError(suite.T(), service.Reload(&changed))
+	w = httptest.NewRecorder()
+	service.GetToken(w, httptest.NewRequest(http.MethodPost, "/token", strings.NewReader(body)))
+	assert.Equal(suite.T(), http.StatusInternalServerError, w.Code)
+}
+
+func (suite *TestSuite) TestCreateS3ConfigFormats() {
+	confData := `global:
+  crypt4ghKey: ` + suite.Crypt4ghKeyPath + `
+  egaUsername: "some-user"
+  egaPassword: "some-pass"
+  egaURL: "http://ega.dev"
+  expirationDays: 14
+  iss: "https://some.url"
+  jwtKey: "` + suite.PrivateKeyPath + `"
+  suprUsername: "some-user"
+  suprPassword: "some-pass"
+  suprURL: "http://supr.dev"
+  s3url: "some.s3.url"
+  uppmaxUsername: "user"
+  uppmaxPassword: "password"
+`
+	testhelpers.WriteConfig(suite.T(), confData)
+
+	conf := &helpers.Conf{}
+	err := helpers.NewConf(conf)
+	assert.NoError(suite.T(), err)
+	st := &state{conf: conf}
+
+	s3config, _, _, err := st.createS3Config("some.user@nbis.se", "user", "sda001", "sda-cli", time.Now(), time.Now().Add(time.Hour), nil)
+	assert.NoError(suite.T(), err)
+	s3configDec, _ := b64.StdEncoding.DecodeString(s3config)
+	assert.Contains(suite.T(), string(s3configDec), "access_key = some.user_nbis.se\n")
+	assert.Contains(suite.T(), string(s3configDec), "host_base = some.s3.url\n")
+
+	s3config, _, _, err = st.createS3Config("some.user@nbis.se", "user", "sda001", "rclone", time.Now(), time.Now().Add(time.Hour), nil)
+	assert.NoError(suite.T(), err)
+	s3configDec, _ = b64.StdEncoding.DecodeString(s3config)
+	assert.True(suite.T(), strings.HasPrefix(string(s3configDec), "[sda]\ntype = s3\n"))
+	assert.Contains(suite.T(), string(s3configDec), "access_key_id = some.user_nbis.se\n")
+	assert.Contains(suite.T(), string(s3configDec), "endpoint = https://some.s3.url\n")
+	assert.Regexp(suite.T(), "session_token = [^.]+\\.[^.]+\\.[^.]+\n", string(s3configDec))
+
+	s3config, credentials, _, err := st.createS3Config("some.user@nbis.se", "user", "sda001", "aws", time.Now(), time.Now().Add(time.Hour), nil)
+	assert.NoError(suite.T(), err)
+	s3configDec, _ = b64.StdEncoding.DecodeString(s3config)
+	assert.True(suite.T(), strings.HasPrefix(string(s3configDec), "[profile sda]\n"))
+	assert.Contains(suite.T(), string(s3configDec), "endpoint_url = https://some.s3.url\n")
+	assert.Contains(suite.T(), string(s3configDec), "    addressing_style = path\n")
+	credentialsDec, _ := b64.StdEncoding.DecodeString(credentials)
+	assert.True(suite.T(), strings.HasPrefix(string(credentialsDec), "[sda]\n"))
+	assert.Contains(suite.T(), string(credentialsDec), "aws_access_key_id = some.user_nbis.se\n")
+	assert.Regexp(suite.T(), "aws_session_token = [^.]+\\.[^.]+\\.[^.]+\n", string(credentialsDec))
+
+	_, _, _, err = st.createS3Config("some.user@nbis.se", "user", "sda001", "cyberduck", time.Now(), time.Now().Add(time.Hour), nil)
+	assert.EqualError(suite.T(), err, "unsupported format cyberduck")
+
+	responseBody, err := st.createResponse(tokenRequest{SwamID: "some.user@nbis.se", ProjectID: "sda001", Format: "rclone"}, "some.user@nbis.se", "user", time.Now(), time.Now().Add(time.Hour))
+	assert.NoError(suite.T(), err)
+	assert.Equal(suite.T(), "rclone", responseBody.Format)
+
+	// The legacy response has no format for the default format
+	responseBody, err = st.createResponse(tokenRequest{SwamID: "some.user@nbis.se", ProjectID: "sda001", Format: "s3cmd"}, "some.user@nbis.se", "user", time.Now(), time.Now().Add(time.Hour))
+	assert.NoError(suite.T(), err)
+	response, _ := json.Marshal(responseBody)
+	assert.NotContains(suite.T(), string(response), `"format"`)
+}
+
+func (suite *TestSuite) TestResponseVersion() {
+	r := httptest.NewRequest(http.MethodPost, "/token", nil)
+	version, err := responseVersion(r)
+	assert.NoError(suite.T(), err)
+	assert.Equal(suite.T(), 1, version)
+
+	r.Header.Set("Accept", "application/json, application/vnd.sda.token.v2+json; q=0.9")
+	version, err = responseVersion(r)
+	assert.NoError(suite.T(), err)
+	assert.Equal(suite.T(), 2, version)
+
+	r = httptest.NewRequest(http.MethodPost, "/token?version=2", nil)
+	version, err = responseVersion(r)
+	assert.NoError(suite.T(), err)
+	assert.Equal(suite.T(), 2, version)
+
+	r = httptest.NewRequest(http.MethodPost, "/token?version=3", nil)
+	_, err = responseVersion(r)
+	assert.EqualError(suite.T(), err, "unsupported API version 3")
+}
+
+// TestGetTokenV2 requests version 2 of the token response, with allowlist and
+// project file backends instead of EGA and SUPR
+func (suite *TestSuite) TestGetTokenV2() {
+	allowlist := suite.TempDir + "/allowlist"
+	err := os.WriteFile(allowlist, []byte("some.user@nbis.se\n"), 0600)
+	assert.NoError(suite.T(), err)
+	projectFile := suite.TempDir + "/projects.yaml"
+	err = os.WriteFile(projectFile, []byte("projects:\n  - id: sda001\n    pi: some.user@nbis.se\n"), 0600)
+	assert.NoError(suite.T(), err)
+
+	confData := `global:
+  accountVerifier: allowlist
+  crypt4ghKey: ` + suite.Crypt4ghKeyPath + `
+  expirationDays: 14
+  iss: "https://some.url"
+  jwtKey: "` + suite.PrivateKeyPath + `"
+  projectRegistries: file
+  s3url: "some.s3.url"
+  uppmaxUsername: "user"
+  uppmaxPassword: "password"
+allowlist:
+  file: ` + allowlist + `
+projects:
+  file: ` + projectFile + `
+`
+	testhelpers.WriteConfig(suite.T(), confData)
+
+	conf := &helpers.Conf{}
+	err = helpers.NewConf(conf)
+	assert.NoError(suite.T(), err)
+	service, err := NewService(conf, nil, nil)
+	assert.NoError(suite.T(), err)
+
+	r := httptest.NewRequest(http.MethodPost, "/token", strings.NewReader(`{"swamid": "some.user@nbis.se", "projectid": "sda001"}`))
+	r.Header.Set("Accept", "application/vnd.sda.token.v2+json")
+	w := httptest.NewRecorder()
+	service.GetToken(w, r)
+	assert.Equal(suite.T(), http.StatusOK, w.Code)
+	assert.Equal(suite.T(), "application/vnd.sda.token.v2+json", w.Header().Get("Content-Type"))
+
+	var response tokenResponseV2
+	assert.NoError(suite.T(), json.Unmarshal(w.Body.Bytes(), &response))
+	assert.Equal(suite.T(), "some.user@nbis.se", response.SwamID)
+	assert.Equal(suite.T(), "sda001", response.ProjectID)
+	assert.Equal(suite.T(), "some.user_nbis.se", response.AccessKey)
+	assert.Equal(suite.T(), "some.user_nbis.se", response.SecretKey)
+	assert.Equal(suite.T(), "some.s3.url", response.HostBase)
+	assert.Equal(suite.T(), "some.s3.url", response.HostBucket)
+	assert.Equal(suite.T(), "-----BEGIN CRYPT4GH PUBLIC KEY-----\nDiuAlYdpdr7jwCIdeHKwJdXGnUGBVUZwRHO2iMG0O2E=\n-----END CRYPT4GH PUBLIC KEY-----", response.Crypt4ghKey)
+
+	issuedAt, err := time.Parse(time.RFC3339, response.IssuedAt)
+	assert.NoError(suite.T(), err)
+	assert.True(suite.T(), strings.HasSuffix(response.IssuedAt, "Z"))
+	expiration, err := time.Parse(time.RFC3339, response.Expiration)
+	assert.NoError(suite.T(), err)
+	assert.True(suite.T(), strings.HasSuffix(response.Expiration, "Z"))
+	assert.WithinDuration(suite.T(), time.Now(), issuedAt, time.Minute)
+	assert.Equal(suite.T(), issuedAt.AddDate(0, 0, 14), expiration)
+
+	// The times are exactly the claims of the token
+	token, _ := jwt.Parse(response.AccessToken, func(_ *jwt.Token) (interface{}, error) { return nil, nil })
+	claims, _ := token.Claims.(jwt.MapClaims)
+	assert.Equal(suite.T(), "some.user@nbis.se", claims["sub"])
+	assert.Equal(suite.T(), float64(issuedAt.Unix()), claims["iat"])
+	assert.Equal(suite.T(), float64(expiration.Unix()), claims["exp"])
+
+	// The legacy response is returned by default
+	r = httptest.NewRequest(http.MethodPost, "/token", strings.NewReader(`{"swamid": "some.user@nbis.se", "projectid": "sda001"}`))
+	w = httptest.NewRecorder()
+	service.GetToken(w, r)
+	assert.Equal(suite.T(), http.StatusOK, w.Code)
+	assert.Equal(suite.T(), "application/json; charset=UTF-8", w.Header().Get("Content-Type"))
+	assert.Contains(suite.T(), w.Body.String(), `"s3config":`)
+}
+
+// TestGetTokenLifetime requests tokens with a given lifetime, which is bounded
+// by the maximum lifetime of the client and by the end of the project
+func (suite *TestSuite) TestGetTokenLifetime() {
+	allowlist := suite.TempDir + "/allowlist"
+	err := os.WriteFile(allowlist, []byte("some.user@nbis.se\n"), 0600)
+	assert.NoError(suite.T(), err)
+	endDate := time.Now().UTC().AddDate(0, 0, 2)
+	projectFile := suite.TempDir + "/projects.yaml"
+	err = os.WriteFile(projectFile, []byte("projects:\n  - id: sda001\n    pi: some.user@nbis.se\n  - id: sda002\n    pi: some.user@nbis.se\n    endDate: "+endDate.Format(time.DateOnly)+"\n  - id: sda003\n    pi: some.user@nbis.se\n    endDate: 2022-12-31\n"), 0600)
+	assert.NoError(suite.T(), err)
+
+	confData := `global:
+  accountVerifier: allowlist
+  crypt4ghKey: ` + suite.Crypt4ghKeyPath + `
+  expirationDays: 7
+  iss: "https://some.url"
+  jwtKey: "` + suite.PrivateKeyPath + `"
+  maxLifetime: 168h
+  projectRegistries: file
+  s3url: "some.s3.url"
+  uppmaxUsername: "user"
+  uppmaxPassword: "password"
+clients:
+  shortlived:
+    maxLifetime: 2h
+    password: "password"
+allowlist:
+  file: ` + allowlist + `
+projects:
+  file: ` + projectFile + `
+`
+	testhelpers.WriteConfig(suite.T(), confData)
+
+	conf := &helpers.Conf{}
+	err = helpers.NewConf(conf)
+	assert.NoError(suite.T(), err)
+	service, err := NewService(conf, nil, nil)
+	assert.NoError(suite.T(), err)
+	assert.Equal(suite.T(), 168*time.Hour, conf.MaxLifetime)
+	assert.Equal(suite.T(), map[string]time.Duration{"shortlived": 2 * time.Hour}, conf.ClientMaxLifetimes)
+	mux := http.NewServeMux()
+	service.Register(mux)
+
+	getLifetime := func(client, body string) (time.Duration, int) {
+		r := httptest.NewRequest(http.MethodPost, "/token?version=2", strings.NewReader(body))
+		r.SetBasicAuth(client, "password")
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, r)
+		if w.Code != http.StatusOK {
+			return 0, w.Code
+		}
+		var response tokenResponseV2
+		assert.NoError(suite.T(), json.Unmarshal(w.Body.Bytes(), &response))
+		issuedAt, _ := time.Parse(time.RFC3339, response.IssuedAt)
+		expiration, _ := time.Parse(time.RFC3339, response.Expiration)
+
+		return expiration.Sub(issuedAt), w.Code
+	}
+
+	// The default lifetime is expirationDays, which may be an hour off across
+	// a daylight saving time change
+	lifetime, code := getLifetime("user", `{"swamid": "some.user@nbis.se", "projectid": "sda001"}`)
+	assert.Equal(suite.T(), http.StatusOK, code)
+	assert.InDelta(suite.T(), float64(168*time.Hour), float64(lifetime), float64(time.Hour))
+
+	// A shorter lifetime is granted as requested
+	lifetime, _ = getLifetime("user", `{"swamid": "some.user@nbis.se", "projectid": "sda001", "lifetime": "4h"}`)
+	assert.Equal(suite.T(), 4*time.Hour, lifetime)
+
+	// A longer lifetime is capped by the maximum lifetime of the client
+	lifetime, code = getLifetime("shortlived", `{"swamid": "some.user@nbis.se", "projectid": "sda001", "lifetime": "4h"}`)
+	assert.Equal(suite.T(), http.StatusOK, code)
+	assert.Equal(suite.T(), 2*time.Hour, lifetime)
+	lifetime, _ = getLifetime("shortlived", `{"swamid": "some.user@nbis.se", "projectid": "sda001"}`)
+	assert.Equal(suite.T(), 2*time.Hour, lifetime)
+
+	// Clients without a password can not authenticate
+	_, code = getLifetime("unknown", `{"swamid": "some.user@nbis.se", "projectid": "sda001"}`)
+	assert.Equal(suite.T(), http.StatusUnauthorized, code)
+
+	// The token expires at the end of the project
+	lifetime, _ = getLifetime("user", `{"swamid": "some.user@nbis.se", "projectid": "sda002"}`)
+	assert.LessOrEqual(suite.T(), lifetime, 72*time.Hour)
+	assert.Greater(suite.T(), lifetime, 24*time.Hour)
+
+	// No token is issued for a project that has ended
+	_, code = getLifetime("user", `{"swamid": "some.user@nbis.se", "projectid": "sda003"}`)
+	assert.Equal(suite.T(), http.StatusInternalServerError, code)
+
+	// Invalid lifetimes are rejected
+	for _, invalid := range []string{"4", "-1h", "0s"} {
+		_, code = getLifetime("user", `{"swamid": "some.user@nbis.se", "projectid": "sda001", "lifetime": "`+invalid+`"}`)
+		assert.Equal(suite.T(), http.StatusInternalServerError, code)
+	}
+}
+
+// TestTokenExpiry checks that the default lifetime is counted in calendar days
+// across a daylight saving time change
+func (suite *TestSuite) TestTokenExpiry() {
+	location, err := time.LoadLocation("Europe/Stockholm")
+	if err != nil {
+		suite.T().Skip("time zone database not available")
+	}
+	local := time.Local
+	time.Local = location
+	defer func() { time.Local = local }()
+
+	st := &state{conf: &helpers.Conf{ExpirationDays: 14, MaxLifetime: 14 * 24 * time.Hour}}
+	// the clocks are turned forward on 2026-03-29
+	issuedAt := time.Date(2026, 3, 20, 12, 0, 0, 0, location).UTC()
+	expiresAt := st.tokenExpiry(issuedAt, 0, "", Project{})
+	assert.Equal(suite.T(), "2026-04-03 12:00", expiresAt.In(location).Format("2006-01-02 15:04"))
+	assert.Equal(suite.T(), 14*24*time.Hour-time.Hour, expiresAt.Sub(issuedAt))
+	assert.Equal(suite.T(), time.UTC, expiresAt.Location())
+
+	// a requested lifetime is a duration
+	expiresAt = st.tokenExpiry(issuedAt, 48*time.Hour, "", Project{})
+	assert.Equal(suite.T(), 48*time.Hour, expiresAt.Sub(issuedAt))
+
+	// the default lifetime is capped by a shorter maximum lifetime of the client
+	st.conf.ClientMaxLifetimes = map[string]time.Duration{"shortlived": 24 * time.Hour}
+	expiresAt = st.tokenExpiry(issuedAt, 0, "shortlived", Project{})
+	assert.Equal(suite.T(), 24*time.Hour, expiresAt.Sub(issuedAt))
+
+	// a longer maximum lifetime of the client does not exceed the global one
+	st.conf.ClientMaxLifetimes["longlived"] = 30 * 24 * time.Hour
+	expiresAt = st.tokenExpiry(issuedAt, 60*24*time.Hour, "longlived", Project{})
+	assert.Equal(suite.T(), 14*24*time.Hour, expiresAt.Sub(issuedAt))
+
+	// and by a global maximum lifetime lowered below global.expirationDays
+	st.conf.MaxLifetime = 72 * time.Hour
+	expiresAt = st.tokenExpiry(issuedAt, 0, "", Project{})
+	assert.Equal(suite.T(), 72*time.Hour, expiresAt.Sub(issuedAt))
+}
+
+// TestIssue issues tokens as an operator, with and without verifying the
+// account and the project, and checks the audit trail
+func (suite *TestSuite) TestIssue() {
+	allowlist := suite.TempDir + "/allowlist"
+	err := os.WriteFile(allowlist, []byte("some.user@nbis.se\n"), 0600)
+	assert.NoError(suite.T(), err)
+	projectFile := suite.TempDir + "/projects.yaml"
+	err = os.WriteFile(projectFile, []byte("projects:\n  - id: sda001\n    pi: some.user@nbis.se\n"), 0600)
+	assert.NoError(suite.T(), err)
+	auditFile := suite.TempDir + "/audit.log"
+
+	confData := `global:
+  accountVerifier: allowlist
+  crypt4ghKey: ` + suite.Crypt4ghKeyPath + `
+  expirationDays: 7
+  iss: "https://some.url"
+  jwtKey: "` + suite.PrivateKeyPath + `"
+  maxLifetime: 168h
+  projectRegistries: file
+  s3url: "some.s3.url"
+  uppmaxUsername: "user"
+  uppmaxPassword: "password"
+allowlist:
+  file: ` + allowlist + `
+projects:
+  file: ` + projectFile + `
+audit:
+  file: ` + auditFile + `
+`
+	testhelpers.WriteConfig(suite.T(), confData)
+
+	conf := &helpers.Conf{}
+	err = helpers.NewConf(conf)
+	assert.NoError(suite.T(), err)
+	assert.Equal(suite.T(), auditFile, conf.AuditFile)
+	service, err := NewService(conf, nil, nil)
+	assert.NoError(suite.T(), err)
+
+	tokenClaims := func(config string) jwt.MapClaims {
+		var tokenString string
+		for _, line := range strings.Split(config, "\n") {
+			if value, ok := strings.CutPrefix(line, "access_token = "); ok {
+				tokenString = value
+			}
+			if value, ok := strings.CutPrefix(line, "aws_session_token = "); ok {
+				tokenString = value
+			}
+		}
+		token, _ := jwt.Parse(tokenString, func(_ *jwt.Token) (interface{}, error) { return nil, nil })
+		claims, _ := token.Claims.(jwt.MapClaims)
+
+		return claims
+	}
+
+	// A verified token does not have the override claim
+	issued, err := service.Issue(context.Background(), IssueRequest{SwamID: "some.user@nbis.se", ProjectID: "sda001", Lifetime: 4 * time.Hour, Operator: "operator"})
+	assert.NoError(suite.T(), err)
+	assert.Contains(suite.T(), issued.Config, "access_key = some.user_nbis.se")
+	assert.Empty(suite.T(), issued.Credentials)
+	assert.WithinDuration(suite.T(), time.Now().Add(4*time.Hour), issued.ExpiresAt, time.Minute)
+	claims := tokenClaims(issued.Config)
+	assert.Equal(suite.T(), "some.user@nbis.se", claims["sub"])
+	assert.NotContains(suite.T(), claims, "override")
+
+	// Accounts and projects that can not be verified are refused
+	_, err = service.Issue(context.Background(), IssueRequest{SwamID: "other.user@nbis.se", ProjectID: "sda001", Operator: "operator"})
+	assert.ErrorContains(suite.T(), err, "other.user@nbis.se is not a valid account")
+	_, err = service.Issue(context.Background(), IssueRequest{SwamID: "some.user@nbis.se", ProjectID: "sda002", Operator: "operator"})
+	assert.ErrorContains(suite.T(), err, "some.user@nbis.se is not authorized for project sda002")
+
+	// An override requires a reason, and is recorded in the token
+	_, err = service.Issue(context.Background(), IssueRequest{SwamID: "other.user@nbis.se", ProjectID: "sda002", Override: true, Operator: "operator"})
+	assert.EqualError(suite.T(), err, "an override requires a reason")
+	unaudited := *conf
+	unaudited.AuditFile = ""
+	unauditedService, err := NewService(&unaudited, nil, nil)
+	assert.NoError(suite.T(), err)
+	_, err = unauditedService.Issue(context.Background(), IssueRequest{SwamID: "other.user@nbis.se", ProjectID: "sda002", Override: true, Operator: "operator", Reason: "SUPR is down"})
+	assert.EqualError(suite.T(), err, "an override requires audit.file to be set")
+	issued, err = service.Issue(context.Background(), IssueRequest{SwamID: "other.user@nbis.se", ProjectID: "sda002", Format: "aws", Override: true, Operator: "operator", Reason: "SUPR is down"})
+	assert.NoError(suite.T(), err)
+	assert.NotEmpty(suite.T(), issued.Credentials)
+	assert.Equal(suite.T(), true, tokenClaims(issued.Credentials)["override"])
+	assert.WithinDuration(suite.T(), time.Now().Add(168*time.Hour), issued.ExpiresAt, time.Minute)
+
+	// Tokens issued by the service are also recorded
+	r := httptest.NewRequest(http.MethodPost, "/token", strings.NewReader(`{"swamid": "some.user@nbis.se", "projectid": "sda001"}`))
+	r.SetBasicAuth("user", "password")
+	w := httptest.NewRecorder()
+	service.GetToken(w, r)
+	assert.Equal(suite.T(), http.StatusOK, w.Code)
+
+	content, err := os.ReadFile(auditFile)
+	assert.NoError(suite.T(), err)
+	lines := strings.Split(strings.TrimSpace(string(content)), "\n")
+	assert.Len(suite.T(), lines, 3)
+	records := make([]auditRecord, len(lines))
+	for i, line := range lines {
+		assert.NoError(suite.T(), json.Unmarshal([]byte(line), &records[i]))
+	}
+	assert.Equal(suite.T(), "cli", records[0].Source)
+	assert.Equal(suite.T(), "operator", records[0].Operator)
+	assert.False(suite.T(), records[0].Override)
+	assert.Equal(suite.T(), "other.user@nbis.se", records[1].SwamID)
+	assert.Equal(suite.T(), "sda002", records[1].ProjectID)
+	assert.True(suite.T(), records[1].Override)
+	assert.Equal(suite.T(), "SUPR is down", records[1].Reason)
+	assert.Equal(suite.T(), "token", records[2].Source)
+	assert.Equal(suite.T(), "user", records[2].Client)
+
+	// No token is handed out unless it is recorded
+	conf.AuditFile = suite.TempDir + "/missing/audit.log"
+	_, err = service.Issue(context.Background(), IssueRequest{SwamID: "some.user@nbis.se", ProjectID: "sda001", Operator: "operator"})
+	assert.ErrorContains(suite.T(), err, "could not record the token in the audit trail")
+}
+
+// TestVerify decodes tokens and client configurations and checks their signature
+func (suite *TestSuite) TestVerify() {
+	confData := `global:
+  crypt4ghKey: ` + suite.Crypt4ghKeyPath + `
+  egaUsername: "some-user"
+  egaPassword: "some-pass"
+  egaURL: "http://ega.dev"
+  expirationDays: 14
+  iss: "https://some.url"
+  jwtKey: "` + suite.PrivateKeyPath + `"
+  suprUsername: "some-user"
+  suprPassword: "some-pass"
+  suprURL: "http://supr.dev"
+  s3url: "some.s3.url"
+  uppmaxUsername: "user"
+  uppmaxPassword: "password"
+`
+	testhelpers.WriteConfig(suite.T(), confData)
+
+	conf := &helpers.Conf{}
+	err := helpers.NewConf(conf)
+	assert.NoError(suite.T(), err)
+	service, err := NewService(conf, nil, nil)
+	assert.NoError(suite.T(), err)
+	st := service.current.Load()
+
+	// The token is extracted from the client configurations
+	issuedAt := time.Now().UTC().Truncate(time.Second)
+	for _, format := range []string{"s3cmd", "rclone", "aws"} {
+		s3config, credentials, _, err := st.createS3Config("some.user@nbis.se", "user", "sda001", format, issuedAt, issuedAt.Add(time.Hour), jwt.MapClaims{"override": true})
+		assert.NoError(suite.T(), err)
+		if credentials != "" {
+			s3config = credentials
+		}
+		config, _ := b64.StdEncoding.DecodeString(s3config)
+		tokenString, err := ExtractToken(string(config))
+		assert.NoError(suite.T(), err, format)
+
+		info, err := service.Verify(tokenString)
+		assert.NoError(suite.T(), err, format)
+		assert.Equal(suite.T(), "some.user@nbis.se", info.Claims["sub"])
+		assert.Equal(suite.T(), "sda", info.KeyID)
+		assert.Equal(suite.T(), issuedAt, info.IssuedAt)
+		assert.Equal(suite.T(), issuedAt.Add(time.Hour), info.ExpiresAt)
+		assert.True(suite.T(), info.Override)
+	}
+	_, err = ExtractToken("host_base = some.s3.url\nhost_bucket = some.s3.url\n")
+	assert.EqualError(suite.T(), err, "no token found in the client configuration")
+
+	// An expired token is decoded, and is not an error on its own
+	tokenString, err := st.createECToken(conf.JwtParsedKey, "some.user@nbis.se", "user", issuedAt.Add(-2*time.Hour), issuedAt.Add(-time.Hour), nil)
+	assert.NoError(suite.T(), err)
+	extracted, err := ExtractToken(" " + tokenString + "\n")
+	assert.NoError(suite.T(), err)
+	assert.Equal(suite.T(), tokenString, extracted)
+	info, err := service.Verify(tokenString)
+	assert.NoError(suite.T(), err)
+	assert.Equal(suite.T(), issuedAt.Add(-time.Hour), info.ExpiresAt)
+	assert.False(suite.T(), info.Override)
+
+	// A token signed with another key is decoded, but not valid
+	otherDir := suite.T().TempDir()
+	otherKeyPath, _ := testhelpers.CreateECkeys(otherDir)
+	otherKey, err := os.ReadFile(otherKeyPath)
+	assert.NoError(suite.T(), err)
+	parsedKey, err := jwt.ParseECPrivateKeyFromPEM(otherKey)
+	assert.NoError(suite.T(), err)
+	tokenString, err = st.createECToken(parsedKey, "some.user@nbis.se", "user", issuedAt, issuedAt.Add(time.Hour), nil)
+	assert.NoError(suite.T(), err)
+	info, err = service.Verify(tokenString)
+	assert.ErrorContains(suite.T(), err, "invalid token")
+	assert.Equal(suite.T(), "some.user@nbis.se", info.Claims["sub"])
+
+	// A token naming another key is not valid
+	token := jwt.NewWithClaims(jwt.SigningMethodES256, jwt.MapClaims{"iss": "https://some.url", "sub": "some.user@nbis.se"})
+	token.Header["kid"] = "other"
+	tokenString, err = token.SignedString(conf.JwtParsedKey)
+	assert.NoError(suite.T(), err)
+	_, err = service.Verify(tokenString)
+	assert.ErrorContains(suite.T(), err, `unknown key id "other"`)
+
+	// A token from another issuer is not valid
+	other := &state{conf: &helpers.Conf{Iss: "https://other.url"}}
+	tokenString, err = other.createECToken(conf.JwtParsedKey, "some.user@nbis.se", "user", issuedAt, issuedAt.Add(time.Hour), nil)
+	assert.NoError(suite.T(), err)
+	_, err = service.Verify(tokenString)
+	assert.EqualError(suite.T(), err, `token issued by "https://other.url", expected "https://some.url"`)
+
+	_, err = service.Verify("not a token")
+	assert.ErrorContains(suite.T(), err, "could not decode token")
+}
+
+// TestRefreshToken exchanges a refresh token for a new token, after which the
+// refresh token is rotated and the account and project are verified again
+func (suite *TestSuite) TestRefreshToken() {
+	allowlist := suite.TempDir + "/allowlist"
+	err := os.WriteFile(allowlist, []byte("some.user@nbis.se\n"), 0600)
+	assert.NoError(suite.T(), err)
+	projectFile := suite.TempDir + "/projects.yaml"
+	err = os.WriteFile(projectFile, []byte("projects:\n  - id: sda001\n    pi: some.user@nbis.se\n"), 0600)
+	assert.NoError(suite.T(), err)
+
+	confData := `global:
+  accountVerifier: allowlist
+  crypt4ghKey: ` + suite.Crypt4ghKeyPath + `
+  expirationDays: 14
+  iss: "https://some.url"
+  jwtKey: "` + suite.PrivateKeyPath + `"
+  projectRegistries: file
+  s3url: "some.s3.url"
+  uppmaxUsername: "user"
+  uppmaxPassword: "password"
+clients:
+  user:
+    maxLifetime: 2h
+allowlist:
+  file: ` + allowlist + `
+projects:
+  file: ` + projectFile + `
+refresh:
+  lifetime: 720h
+`
+
+	testhelpers.WriteConfig(suite.T(), confData)
+
+	conf := &helpers.Conf{}
+	err = helpers.NewConf(conf)
+	assert.NoError(suite.T(), err)
+	service, err := NewService(conf, nil, cache.NewMemoryStore())
+	assert.NoError(suite.T(), err)
+	assert.Equal(suite.T(), 30*24*time.Hour, conf.RefreshLifetime)
+
+	r := httptest.NewRequest(http.MethodPost, "/token?version=2", strings.NewReader(`{"swamid": "some.user@nbis.se", "projectid": "sda001", "lifetime": "1h"}`))
+	r.SetBasicAuth("user", "password")
+	w := httptest.NewRecorder()
+	service.GetToken(w, r)
+	assert.Equal(suite.T(), http.StatusOK, w.Code)
+	var response tokenResponseV2
+	assert.NoError(suite.T(), json.Unmarshal(w.Body.Bytes(), &response))
+	assert.NotEmpty(suite.T(), response.RefreshToken)
+
+	refresh := func(refreshToken string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		service.RefreshToken(w, httptest.NewRequest(http.MethodPost, "/token/refresh?version=2", strings.NewReader(`{"refresh_token": "`+refreshToken+`"}`)))
+
+		return w
+	}
+
+	// The refreshed token keeps the requested lifetime and the refresh token is rotated
+	w = refresh(response.RefreshToken)
+	assert.Equal(suite.T(), http.StatusOK, w.Code)
+	var refreshed tokenResponseV2
+	assert.NoError(suite.T(), json.Unmarshal(w.Body.Bytes(), &refreshed))
+	assert.Equal(suite.T(), "some.user@nbis.se", refreshed.SwamID)
+	assert.Equal(suite.T(), "sda001", refreshed.ProjectID)
+	assert.NotEmpty(suite.T(), refreshed.AccessToken)
+	assert.NotEqual(suite.T(), response.RefreshToken, refreshed.RefreshToken)
+	issuedAt, _ := time.Parse(time.RFC3339, refreshed.IssuedAt)
+	expiration, _ := time.Parse(time.RFC3339, refreshed.Expiration)
+	assert.Equal(suite.T(), time.Hour, expiration.Sub(issuedAt))
+
+	// A refresh token can only be used once
+	assert.Equal(suite.T(), http.StatusUnauthorized, refresh(response.RefreshToken).Code)
+	assert.Equal(suite.T(), http.StatusUnauthorized, refresh("unknown").Code)
+
+	// The legacy response also carries the refresh token
+	w = httptest.NewRecorder()
+	service.RefreshToken(w, httptest.NewRequest(http.MethodPost, "/token/refresh", strings.NewReader(`{"refresh_token": "`+refreshed.RefreshToken+`"}`)))
+	assert.Equal(suite.T(), http.StatusOK, w.Code)
+	var legacy tokenResponse
+	assert.NoError(suite.T(), json.Unmarshal(w.Body.Bytes(), &legacy))
+	assert.NotEmpty(suite.T(), legacy.S3Config)
+	assert.NotEmpty(suite.T(), legacy.RefreshToken)
+
+	// Of concurrent refreshes with the same token only one succeeds
+	codes := make(chan int, 5)
+	for i := 0; i < cap(codes); i++ {
+		go func() { codes <- refresh(legacy.RefreshToken).Code }()
+	}
+	succeeded := 0
+	for i := 0; i < cap(codes); i++ {
+		if <-codes == http.StatusOK {
+			succeeded++
+		}
+	}
+	assert.Equal(suite.T(), 1, succeeded)
+
+	// A refresh failing for another reason than a denial hands out a replacement
+	var latest tokenResponseV2
+	w = httptest.NewRecorder()
+	r = httptest.NewRequest(http.MethodPost, "/token?version=2", strings.NewReader(`{"swamid": "some.user@nbis.se", "projectid": "sda001"}`))
+	r.SetBasicAuth("user", "password")
+	service.GetToken(w, r)
+	assert.NoError(suite.T(), json.Unmarshal(w.Body.Bytes(), &latest))
+	st := service.current.Load()
+	grant, found, err := st.consumeRefreshToken(context.Background(), latest.RefreshToken)
+	assert.NoError(suite.T(), err)
+	assert.True(suite.T(), found)
+	failing := *st
+	failing.accountVerifier = accountFunc(func(context.Context, string) error { return fmt.Errorf("EGA: %w", upstream.ErrTimeout) })
+	tokenRequest, err := grant.tokenRequest()
+	assert.NoError(suite.T(), err)
+	w = httptest.NewRecorder()
+	failing.issueToken(w, httptest.NewRequest(http.MethodPost, "/token/refresh", nil), tokenRequest, grant.Client, 2, &grant)
+	assert.Equal(suite.T(), http.StatusGatewayTimeout, w.Code)
+	var failed refreshErrorResponse
+	assert.NoError(suite.T(), json.Unmarshal(w.Body.Bytes(), &failed))
+	assert.Equal(suite.T(), "Timed out verifying access to specified project", failed.Error.Message)
+	assert.NotEmpty(suite.T(), failed.RefreshToken)
+	replaced, found, err := st.consumeRefreshToken(context.Background(), failed.RefreshToken)
+	assert.NoError(suite.T(), err)
+	assert.True(suite.T(), found)
+	assert.Equal(suite.T(), grant.ExpiresAt, replaced.ExpiresAt)
+	replaced.token = grant.token
+	assert.Equal(suite.T(), grant, replaced)
+
+	// A refresh cancelled by the client keeps the used refresh token
+	cancelling := *st
+	cancelling.accountVerifier = accountFunc(func(ctx context.Context, _ string) error { return blockUntilCancelled(ctx) })
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	w = httptest.NewRecorder()
+	cancelling.issueToken(w, httptest.NewRequest(http.MethodPost, "/token/refresh", nil).WithContext(ctx), tokenRequest, grant.Client, 2, &grant)
+	assert.Empty(suite.T(), w.Body.String())
+	restored, found, err := st.consumeRefreshToken(context.Background(), grant.token)
+	assert.NoError(suite.T(), err)
+	assert.True(suite.T(), found)
+	assert.Equal(suite.T(), grant, restored)
+
+	// The refresh token handed out by a refresh expires with the used one
+	restored.ExpiresAt = time.Now().Add(time.Hour).Unix()
+	w = httptest.NewRecorder()
+	st.issueToken(w, httptest.NewRequest(http.MethodPost, "/token/refresh", nil), tokenRequest, grant.Client, 2, &restored)
+	assert.Equal(suite.T(), http.StatusOK, w.Code)
+	assert.NoError(suite.T(), json.Unmarshal(w.Body.Bytes(), &refreshed))
+	rotated, found, err := st.consumeRefreshToken(context.Background(), refreshed.RefreshToken)
+	assert.NoError(suite.T(), err)
+	assert.True(suite.T(), found)
+	assert.Equal(suite.T(), restored.ExpiresAt, rotated.ExpiresAt)
+
+	// The account is verified again, and a denied refresh token is used up
+	w = httptest.NewRecorder()
+	r = httptest.NewRequest(http.MethodPost, "/token?version=2", strings.NewReader(`{"swamid": "some.user@nbis.se", "projectid": "sda001"}`))
+	r.SetBasicAuth("user", "password")
+	service.GetToken(w, r)
+	assert.NoError(suite.T(), json.Unmarshal(w.Body.Bytes(), &latest))
+	err = os.WriteFile(allowlist, []byte("other.user@nbis.se\n"), 0600)
+	assert.NoError(suite.T(), err)
+	assert.NoError(suite.T(), service.Reload(conf))
+	w = refresh(latest.RefreshToken)
+	assert.Equal(suite.T(), http.StatusInternalServerError, w.Code)
+	assert.NotContains(suite.T(), w.Body.String(), "refresh_token")
+	_, found, err = service.current.Load().consumeRefreshToken(context.Background(), latest.RefreshToken)
+	assert.NoError(suite.T(), err)
+	assert.False(suite.T(), found)
+
+	// Refresh tokens are not issued by default
+	err = os.WriteFile(allowlist, []byte("some.user@nbis.se\n"), 0600)
+	assert.NoError(suite.T(), err)
+	conf = suite.newConf(map[string]any{
+		"global.accountVerifier":   "allowlist",
+		"global.projectRegistries": "file",
+		"allowlist.file":           allowlist,
+		"projects.file":            projectFile,
+	})
+	assert.Equal(suite.T(), time.Duration(0), conf.RefreshLifetime)
+	service, err = NewService(conf, nil, cache.NewMemoryStore())
+	assert.NoError(suite.T(), err)
+	w = httptest.NewRecorder()
+	service.GetToken(w, httptest.NewRequest(http.MethodPost, "/token", strings.NewReader(`{"swamid": "some.user@nbis.se", "projectid": "sda001"}`)))
+	assert.Equal(suite.T(), http.StatusOK, w.Code)
+	assert.NotContains(suite.T(), w.Body.String(), "refresh_token")
+
+	// Refresh tokens are not issued without a store
+	service, err = NewService(conf, nil, nil)
+	assert.NoError(suite.T(), err)
+	w = httptest.NewRecorder()
+	service.GetToken(w, httptest.NewRequest(http.MethodPost, "/token", strings.NewReader(`{"swamid": "some.user@nbis.se", "projectid": "sda001"}`)))
+	assert.Equal(suite.T(), http.StatusOK, w.Code)
+	assert.NotContains(suite.T(), w.Body.String(), "refresh_token")
+}
+
+// TestExchangeToken exchanges subject tokens, validated by a stub userinfo
+// endpoint, for inbox tokens
+func (suite *TestSuite) TestExchangeToken() {
+	userinfo := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Header.Get("Authorization") {
+		case "Bearer valid":
+			_, _ = io.WriteString(w, `{"sub": "123@lifescience-ri.eu", "email": "some.user@nbis.se"}`)
+		case "Bearer other":
+			_, _ = io.WriteString(w, `{"sub": "456@lifescience-ri.eu", "email": "other.user@nbis.se"}`)
+		default:
+			w.WriteHeader(http.StatusUnauthorized)
+		}
+	}))
+	defer userinfo.Close()
+
+	allowlist := suite.TempDir + "/allowlist"
+	err := os.WriteFile(allowlist, []byte("some.user@nbis.se\nother.user@nbis.se\n"), 0600)
+	assert.NoError(suite.T(), err)
+	projectFile := suite.TempDir + "/projects.yaml"
+	err = os.WriteFile(projectFile, []byte("projects:\n  - id: sda001\n    pi: some.user@nbis.se\n"), 0600)
+	assert.NoError(suite.T(), err)
+
+	confData := `global:
+  accountVerifier: allowlist
+  crypt4ghKey: ` + suite.Crypt4ghKeyPath + `
+  expirationDays: 14
+  iss: "https://some.url"
+  jwtKey: "` + suite.PrivateKeyPath + `"
+  projectRegistries: file
+  s3url: "some.s3.url"
+  uppmaxUsername: "user"
+  uppmaxPassword: "password"
+allowlist:
+  file: ` + allowlist + `
+projects:
+  file: ` + projectFile + `
+oauth:
+  userinfoURL: ` + userinfo.URL + `
+`
+	testhelpers.WriteConfig(suite.T(), confData)
+
+	conf := &helpers.Conf{}
+	err = helpers.NewConf(conf)
+	assert.NoError(suite.T(), err)
+	service, err := NewService(conf, nil, nil)
+	assert.NoError(suite.T(), err)
+	assert.Equal(suite.T(), "email", conf.OAuthUserClaim)
+
+	exchange := func(form string) (*httptest.ResponseRecorder, map[string]any) {
+		r := httptest.NewRequest(http.MethodPost, "/oauth/token", strings.NewReader(form))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		r.SetBasicAuth("user", "password")
+		w := httptest.NewRecorder()
+		service.ExchangeToken(w, r)
+		var response map[string]any
+		assert.NoError(suite.T(), json.Unmarshal(w.Body.Bytes(), &response))
+
+		return w, response
+	}
+	grant := "grant_type=urn%3Aietf%3Aparams%3Aoauth%3Agrant-type%3Atoken-exchange&subject_token_type=urn%3Aietf%3Aparams%3Aoauth%3Atoken-type%3Aaccess_token"
+
+	// The project can be given as resource or scope
+	for _, target := range []string{"resource=sda001", "scope=sda001", "resource=sda001&scope=sda001"} {
+		w, response := exchange(grant + "&subject_token=valid&" + target)
+		assert.Equal(suite.T(), http.StatusOK, w.Code, target)
+		assert.Equal(suite.T(), "no-store", w.Header().Get("Cache-Control"))
+		assert.Equal(suite.T(), "urn:ietf:params:oauth:token-type:jwt", response["issued_token_type"])
+		assert.Equal(suite.T(), "Bearer", response["token_type"])
+		assert.Equal(suite.T(), float64(14*24*60*60), response["expires_in"])
+		assert.Equal(suite.T(), "sda001", response["scope"])
+
+		token, _ := jwt.Parse(response["access_token"].(string), func(_ *jwt.Token) (interface{}, error) { return nil, nil })
+		claims, _ := token.Claims.(jwt.MapClaims)
+		assert.Equal(suite.T(), "some.user@nbis.se", claims["sub"])
+		assert.Equal(suite.T(), "user", claims["pilot"])
+	}
+
+	// Failed exchanges give OAuth errors
+	for form, expected := range map[string]string{
+		"grant_type=password&subject_token=valid&resource=sda001":                                   "unsupported_grant_type",
+		grant + "&resource=sda001":                                                                  "invalid_request",
+		grant + "&subject_token=valid":                                                              "invalid_target",
+		grant + "&subject_token=valid&resource=sda001&scope=sda002":                                 "invalid_target",
+		grant + "&subject_token=invalid&resource=sda001":                                            "invalid_grant",
+		grant + "&subject_token=other&resource=sda001":                                              "invalid_target",
+		grant + "&subject_token=valid&resource=sda002":                                              "invalid_target",
+		strings.Replace(grant, "access_token", "saml2", 1) + "&subject_token=valid&resource=sda001": "invalid_request",
+	} {
+		w, response := exchange(form)
+		assert.Equal(suite.T(), http.StatusBadRequest, w.Code, form)
+		assert.Equal(suite.T(), expected, response["error"], form)
+	}
+}
+
+func (suite *TestSuite) TestGetCrypt4ghKey() {
+	confData := `global:
+  crypt4ghKey: ` + suite.Crypt4ghKeyPath + `
+  egaUsername: "some-user"
+  egaPassword: "some-pass"
+  egaURL: "http://ega.dev"
+  iss: "https://some.url"
+  jwtKey: "` + suite.PrivateKeyPath + `"
+  suprUsername: "some-user"
+  suprPassword: "some-pass"
+  suprURL: "http://supr.dev"
+  s3url: "some.s3.url"
+  uppmaxUsername: "user"
+  uppmaxPassword: "password"
+crypt4gh:
+  projectKeys:
+    - project: "sens*"
+      key: ` + suite.TempDir + `/project.pub.pem
+`
+	err := os.WriteFile(suite.TempDir+"/project.pub.pem", []byte("-----BEGIN CRYPT4GH PUBLIC KEY-----\nXWd0GvGwL14Dt1U6tTzBq6e0IVvyP4oEGEqAOBMZBxo=\n-----END CRYPT4GH PUBLIC KEY-----\n"), 0600)
+	assert.NoError(suite.T(), err)
+	testhelpers.WriteConfig(suite.T(), confData)
+
+	conf := &helpers.Conf{}
+	err = helpers.NewConf(conf)
+	assert.NoError(suite.T(), err)
+	service, err := NewService(conf, nil, nil)
+	assert.NoError(suite.T(), err)
+
+	w := httptest.NewRecorder()
+	service.GetCrypt4ghKey(w, httptest.NewRequest(http.MethodGet, "/crypt4gh/key", nil))
+	assert.Equal(suite.T(), http.StatusOK, w.Code)
+	var response crypt4ghKeysResponse
+	assert.NoError(suite.T(), json.Unmarshal(w.Body.Bytes(), &response))
+	assert.Equal(suite.T(), "-----BEGIN CRYPT4GH PUBLIC KEY-----\nDiuAlYdpdr7jwCIdeHKwJdXGnUGBVUZwRHO2iMG0O2E=\n-----END CRYPT4GH PUBLIC KEY-----", response.Key.PEM)
+	assert.Equal(suite.T(), "DiuAlYdpdr7jwCIdeHKwJdXGnUGBVUZwRHO2iMG0O2E=", response.Key.Key)
+	assert.Equal(suite.T(), conf.Crypt4ghFingerprint, response.Key.Fingerprint)
+	assert.Len(suite.T(), response.ProjectKeys, 1)
+	assert.Equal(suite.T(), "sens*", response.ProjectKeys[0].Project)
+	assert.Equal(suite.T(), "XWd0GvGwL14Dt1U6tTzBq6e0IVvyP4oEGEqAOBMZBxo=", response.ProjectKeys[0].Key)
+	assert.Equal(suite.T(), conf.Crypt4ghProjectKeys[0].Fingerprint, response.ProjectKeys[0].Fingerprint)
+
+	// The ETag is stable and revalidates the cached keys
+	etag := w.Header().Get("ETag")
+	assert.NotEmpty(suite.T(), etag)
+	r := httptest.NewRequest(http.MethodGet, "/crypt4gh/key", nil)
+	r.Header.Set("If-None-Match", etag)
+	w = httptest.NewRecorder()
+	service.GetCrypt4ghKey(w, r)
+	assert.Equal(suite.T(), http.StatusNotModified, w.Code)
+	assert.Equal(suite.T(), etag, w.Header().Get("ETag"))
+	assert.Empty(suite.T(), w.Body.String())
 
-	err = verifyProjectAccount(requestBody.SwamID, requestBody.ProjectID)
-	assert.Equal(suite.T(), fmt.Errorf("email is different than PI in requested project"), err)
+	// The key of a single project
+	w = httptest.NewRecorder()
+	service.GetCrypt4ghKey(w, httptest.NewRequest(http.MethodGet, "/crypt4gh/key?project=sensitive001", nil))
+	assert.Equal(suite.T(), http.StatusOK, w.Code)
+	var projectKey crypt4ghKey
+	assert.NoError(suite.T(), json.Unmarshal(w.Body.Bytes(), &projectKey))
+	assert.Equal(suite.T(), "sensitive001", projectKey.Project)
+	assert.Equal(suite.T(), "XWd0GvGwL14Dt1U6tTzBq6e0IVvyP4oEGEqAOBMZBxo=", projectKey.Key)
+	assert.NotEqual(suite.T(), etag, w.Header().Get("ETag"))
 
+	w = httptest.NewRecorder()
+	service.GetCrypt4ghKey(w, httptest.NewRequest(http.MethodPost, "/crypt4gh/key", nil))
+	assert.Equal(suite.T(), http.StatusMethodNotAllowed, w.Code)
 }
@@ -0,0 +1,58 @@
+package token
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/NBISweden/sda-uppmax-integration/helpers"
+	"github.com/NBISweden/sda-uppmax-integration/upstream"
+)
+
+// newUpstreamClient returns a client for the external service called name,
+// using the upstream settings in conf. The client of the previous
+// configuration is kept if its settings did not change, so that a reload does
+// not reset the state of its circuit breaker.
+func (st *state) newUpstreamClient(name string, conf *helpers.Conf) *upstream.Client {
+	options := upstream.Options{
+		Timeout:          conf.UpstreamTimeout,
+		Retries:          conf.UpstreamRetries,
+		Backoff:          conf.UpstreamBackoff,
+		MaxBackoff:       conf.UpstreamMaxBackoff,
+		BreakerThreshold: conf.BreakerThreshold,
+		BreakerCooldown:  conf.BreakerCooldown,
+	}
+	var client *upstream.Client
+	for _, previous := range st.previousUpstreams {
+		if previous.Name() == name && previous.Options() == options {
+			client = previous
+		}
+	}
+	if client == nil {
+		client = upstream.NewClient(name, options)
+	}
+	st.upstreams = append(st.upstreams, client)
+
+	return client
+}
+
+// Ready reports whether the service can serve tokens, which is not the case
+// while the circuit breaker of an upstream is open
+func (s *Service) Ready(w http.ResponseWriter, _ *http.Request) {
+	status := map[string]string{}
+	ready := true
+	for _, client := range s.current.Load().upstreams {
+		status[client.Name()] = "available"
+		if !client.Available() {
+			status[client.Name()] = "unavailable"
+			ready = false
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	if !ready {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	response, _ := json.Marshal(status)
+	fmt.Fprint(w, string(response))
+}
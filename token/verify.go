@@ -0,0 +1,86 @@
+package token
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt"
+)
+
+// tokenSettings are the settings holding the token in the client configurations
+var tokenSettings = []string{"access_token", "session_token", "aws_session_token"}
+
+// ExtractToken returns the token held in a client configuration, such as an
+// s3cmd configuration, or content itself if it is not a configuration
+func ExtractToken(content string) (string, error) {
+	content = strings.TrimSpace(content)
+	if !strings.ContainsAny(content, "=\n") {
+		return content, nil
+	}
+
+	for _, line := range strings.Split(content, "\n") {
+		name, value, found := strings.Cut(line, "=")
+		if !found {
+			continue
+		}
+		for _, setting := range tokenSettings {
+			if strings.TrimSpace(name) == setting {
+				return strings.TrimSpace(value), nil
+			}
+		}
+	}
+
+	return "", fmt.Errorf("no token found in the client configuration")
+}
+
+// TokenInfo describes a decoded token
+type TokenInfo struct {
+	Claims    jwt.MapClaims
+	KeyID     string
+	IssuedAt  time.Time
+	ExpiresAt time.Time
+	// Override is set for tokens issued without verifying the account and the project
+	Override bool
+}
+
+// Verify decodes tokenString and checks its signature against the configured
+// key named by its key id, and its issuer against global.iss. The claims of a
+// token that could be decoded are returned even if it is not valid. An
+// expired token is not an error, as the expiry is part of the returned
+// information.
+func (s *Service) Verify(tokenString string) (TokenInfo, error) {
+	st := s.current.Load()
+
+	parser := &jwt.Parser{ValidMethods: []string{jwt.SigningMethodES256.Alg()}, SkipClaimsValidation: true}
+	token, err := parser.Parse(tokenString, func(token *jwt.Token) (any, error) {
+		if kid, _ := token.Header["kid"].(string); kid != keyID {
+			return nil, fmt.Errorf("unknown key id %q", kid)
+		}
+
+		return &st.conf.JwtParsedKey.PublicKey, nil
+	})
+	if token == nil {
+		return TokenInfo{}, fmt.Errorf("could not decode token: %v", err)
+	}
+
+	var info TokenInfo
+	info.Claims, _ = token.Claims.(jwt.MapClaims)
+	info.KeyID, _ = token.Header["kid"].(string)
+	if iat, ok := info.Claims["iat"].(float64); ok {
+		info.IssuedAt = time.Unix(int64(iat), 0).UTC()
+	}
+	if exp, ok := info.Claims["exp"].(float64); ok {
+		info.ExpiresAt = time.Unix(int64(exp), 0).UTC()
+	}
+	info.Override, _ = info.Claims["override"].(bool)
+
+	if err != nil {
+		return info, fmt.Errorf("invalid token: %v", err)
+	}
+	if iss, _ := info.Claims["iss"].(string); iss != st.conf.Iss {
+		return info, fmt.Errorf("token issued by %q, expected %q", iss, st.conf.Iss)
+	}
+
+	return info, nil
+}
@@ -0,0 +1,231 @@
+package upstream
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// ErrCircuitOpen is returned when requests are not sent to an upstream since
+// its circuit breaker is open
+var ErrCircuitOpen = errors.New("circuit breaker is open")
+
+// ErrTimeout is returned when a request to an upstream did not finish in time
+var ErrTimeout = errors.New("request timed out")
+
+// Options describes the behaviour of a Client
+type Options struct {
+	// Timeout is the timeout of a single attempt
+	Timeout time.Duration
+	// Retries is the number of retries after a failed attempt
+	Retries int
+	// Backoff is the base delay between retries, which is doubled for every retry
+	Backoff time.Duration
+	// MaxBackoff caps the delay between retries
+	MaxBackoff time.Duration
+	// BreakerThreshold is the number of consecutive failed requests that
+	// opens the circuit breaker, zero disables the breaker
+	BreakerThreshold int
+	// BreakerCooldown is the time the breaker stays open before a single
+	// trial request is let through, other requests are rejected until the
+	// trial has finished
+	BreakerCooldown time.Duration
+}
+
+// Client is an HTTP client for the external services, which retries
+// idempotent requests and stops calling an upstream that keeps failing
+type Client struct {
+	name    string
+	client  *http.Client
+	options Options
+
+	mu        sync.Mutex
+	failures  int
+	openUntil time.Time
+	// halfOpen is set once the breaker has opened, until a request succeeds
+	halfOpen bool
+	// trial is set while the trial request of a half-open breaker is in flight
+	trial bool
+}
+
+// NewClient returns a client for the upstream called name
+func NewClient(name string, options Options) *Client {
+	return &Client{
+		name:    name,
+		client:  &http.Client{Timeout: options.Timeout},
+		options: options,
+	}
+}
+
+// Name returns the name of the upstream
+func (c *Client) Name() string {
+	return c.name
+}
+
+// Options returns the options the client was created with
+func (c *Client) Options() Options {
+	return c.options
+}
+
+// Available returns false while the circuit breaker is open. A half-open
+// breaker is available, although only one request is let through at a time.
+func (c *Client) Available() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return !time.Now().Before(c.openUntil)
+}
+
+// Do sends the request, retrying GET and HEAD requests on network errors and
+// 5xx responses. Any other response is returned to the caller. Retries are
+// only made while they fit within the deadline of the request context, and
+// errors caused by timeouts wrap ErrTimeout.
+func (c *Client) Do(req *http.Request) (*http.Response, error) {
+	trial, ok := c.allow()
+	if !ok {
+		return nil, fmt.Errorf("%s: %w", c.name, ErrCircuitOpen)
+	}
+	if trial {
+		defer c.endTrial()
+	}
+
+	attempts := 1
+	if req.Method == http.MethodGet || req.Method == http.MethodHead {
+		attempts += c.options.Retries
+	}
+
+	var resp *http.Response
+	var err error
+	for attempt := 0; attempt < attempts; attempt++ {
+		if attempt > 0 {
+			delay := c.backoff(attempt)
+			if deadline, ok := req.Context().Deadline(); ok && time.Until(deadline) < delay {
+				log.Debugf("not retrying request to %s since the deadline would be exceeded", c.name)
+
+				break
+			}
+			if resp != nil {
+				_, _ = io.Copy(io.Discard, resp.Body)
+				resp.Body.Close()
+			}
+			log.Debugf("retrying request to %s in %v", c.name, delay)
+			select {
+			case <-req.Context().Done():
+				return nil, c.wrapError(req.Context().Err())
+			case <-time.After(delay):
+			}
+		}
+
+		resp, err = c.client.Do(req)
+		if err == nil && resp.StatusCode < http.StatusInternalServerError {
+			c.record(true)
+
+			return resp, nil
+		}
+		if err != nil {
+			log.Warnf("request to %s failed: %v", c.name, err)
+
+			continue
+		}
+		log.Warnf("request to %s failed with status %v", c.name, resp.StatusCode)
+	}
+	// a request cancelled by the caller says nothing about the health of the upstream
+	if !errors.Is(req.Context().Err(), context.Canceled) {
+		c.record(false)
+	}
+
+	return resp, c.wrapError(err)
+}
+
+// wrapError marks errors caused by timeouts with ErrTimeout
+func (c *Client) wrapError(err error) error {
+	return WrapTimeout(c.name, err)
+}
+
+// WrapTimeout wraps err with ErrTimeout if it was caused by a timeout in a
+// request to the upstream called name, other errors are returned as is
+func WrapTimeout(name string, err error) error {
+	var netErr net.Error
+	if errors.Is(err, context.DeadlineExceeded) || (errors.As(err, &netErr) && netErr.Timeout()) {
+		return fmt.Errorf("%s: %w: %w", name, ErrTimeout, err)
+	}
+
+	return err
+}
+
+// backoff returns a random delay between zero and the exponential backoff
+// for the given attempt
+func (c *Client) backoff(attempt int) time.Duration {
+	delay := c.options.Backoff << (attempt - 1)
+	if c.options.MaxBackoff > 0 && (delay > c.options.MaxBackoff || delay <= 0) {
+		delay = c.options.MaxBackoff
+	}
+	if delay <= 0 {
+		return 0
+	}
+
+	return rand.N(delay) // #nosec G404 -- jitter does not need a secure source
+}
+
+// allow returns whether a request can be sent, and whether it is the trial
+// request of a half-open breaker
+func (c *Client) allow() (trial, ok bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if time.Now().Before(c.openUntil) {
+		return false, false
+	}
+	if !c.halfOpen {
+		return false, true
+	}
+	if c.trial {
+		return false, false
+	}
+	c.trial = true
+
+	return true, true
+}
+
+// endTrial lets the next trial request through once a trial has finished
+// without closing the breaker, e.g. when it was cancelled
+func (c *Client) endTrial() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.trial = false
+}
+
+// record updates the circuit breaker with the outcome of a request
+func (c *Client) record(success bool) {
+	if c.options.BreakerThreshold <= 0 {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if success {
+		c.failures = 0
+		c.halfOpen = false
+
+		return
+	}
+
+	c.failures++
+	if c.failures >= c.options.BreakerThreshold {
+		log.Errorf("opening circuit breaker for %s after %v failed requests", c.name, c.failures)
+		c.openUntil = time.Now().Add(c.options.BreakerCooldown)
+		c.halfOpen = true
+		// a single failure after the cooldown opens the breaker again
+		c.failures = c.options.BreakerThreshold - 1
+	}
+}
@@ -0,0 +1,245 @@
+package upstream
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/suite"
+)
+
+type TestSuite struct {
+	suite.Suite
+	Options Options
+}
+
+func TestUpstreamTestSuite(t *testing.T) {
+	suite.Run(t, new(TestSuite))
+}
+
+func (suite *TestSuite) SetupTest() {
+	suite.Options = Options{
+		Timeout:          time.Second,
+		Retries:          2,
+		Backoff:          time.Millisecond,
+		MaxBackoff:       5 * time.Millisecond,
+		BreakerThreshold: 2,
+		BreakerCooldown:  time.Hour,
+	}
+}
+
+// statusServer returns a server replying with the given statuses in order,
+// repeating the last one
+func statusServer(calls *int, statuses ...int) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		status := statuses[min(*calls, len(statuses)-1)]
+		*calls++
+		w.WriteHeader(status)
+	}))
+}
+
+func (suite *TestSuite) TestRetryOnServerError() {
+	calls := 0
+	server := statusServer(&calls, http.StatusServiceUnavailable, http.StatusOK)
+	defer server.Close()
+
+	client := NewClient("test", suite.Options)
+	req, _ := http.NewRequest(http.MethodGet, server.URL, nil)
+	resp, err := client.Do(req)
+	assert.NoError(suite.T(), err)
+	defer resp.Body.Close()
+	assert.Equal(suite.T(), http.StatusOK, resp.StatusCode)
+	assert.Equal(suite.T(), 2, calls)
+}
+
+func (suite *TestSuite) TestNoRetryOnClientError() {
+	calls := 0
+	server := statusServer(&calls, http.StatusNotFound)
+	defer server.Close()
+
+	client := NewClient("test", suite.Options)
+	req, _ := http.NewRequest(http.MethodGet, server.URL, nil)
+	resp, err := client.Do(req)
+	assert.NoError(suite.T(), err)
+	defer resp.Body.Close()
+	assert.Equal(suite.T(), http.StatusNotFound, resp.StatusCode)
+	assert.Equal(suite.T(), 1, calls)
+	assert.True(suite.T(), client.Available())
+}
+
+func (suite *TestSuite) TestNoRetryOnPost() {
+	calls := 0
+	server := statusServer(&calls, http.StatusServiceUnavailable)
+	defer server.Close()
+
+	client := NewClient("test", suite.Options)
+	req, _ := http.NewRequest(http.MethodPost, server.URL, nil)
+	resp, err := client.Do(req)
+	assert.NoError(suite.T(), err)
+	defer resp.Body.Close()
+	assert.Equal(suite.T(), http.StatusServiceUnavailable, resp.StatusCode)
+	assert.Equal(suite.T(), 1, calls)
+}
+
+func (suite *TestSuite) TestCircuitBreaker() {
+	calls := 0
+	server := statusServer(&calls, http.StatusServiceUnavailable)
+	defer server.Close()
+
+	client := NewClient("test", suite.Options)
+	for i := 0; i < 2; i++ {
+		req, _ := http.NewRequest(http.MethodGet, server.URL, nil)
+		resp, err := client.Do(req)
+		assert.NoError(suite.T(), err)
+		resp.Body.Close()
+		assert.Equal(suite.T(), http.StatusServiceUnavailable, resp.StatusCode)
+	}
+	assert.Equal(suite.T(), 6, calls)
+	assert.False(suite.T(), client.Available())
+
+	// The breaker is open, so the upstream is not called
+	req, _ := http.NewRequest(http.MethodGet, server.URL, nil)
+	_, err := client.Do(req) //nolint:bodyclose
+	assert.True(suite.T(), errors.Is(err, ErrCircuitOpen))
+	assert.EqualError(suite.T(), err, "test: circuit breaker is open")
+	assert.Equal(suite.T(), 6, calls)
+
+	// After the cooldown a single trial request is let through
+	client.mu.Lock()
+	client.openUntil = time.Now()
+	client.mu.Unlock()
+	started := make(chan struct{})
+	release := make(chan struct{})
+	server.Config.Handler = http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		started <- struct{}{}
+		<-release
+		w.WriteHeader(http.StatusOK)
+	})
+	done := make(chan error)
+	go func() {
+		resp, err := client.Do(req)
+		if err == nil {
+			resp.Body.Close()
+		}
+		done <- err
+	}()
+	<-started
+	_, err = client.Do(req) //nolint:bodyclose
+	assert.ErrorIs(suite.T(), err, ErrCircuitOpen)
+	close(release)
+	assert.NoError(suite.T(), <-done)
+	assert.True(suite.T(), client.Available())
+
+	// The breaker is closed again, so requests are sent concurrently
+	server.Config.Handler = http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+	resp, err := client.Do(req)
+	assert.NoError(suite.T(), err)
+	resp.Body.Close()
+	assert.False(suite.T(), client.halfOpen)
+}
+
+// TestCancelledTrial checks that a cancelled trial request lets the next one
+// through
+func (suite *TestSuite) TestCancelledTrial() {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-r.Context().Done()
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	client := NewClient("test", suite.Options)
+	client.halfOpen = true
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(20*time.Millisecond, cancel)
+	req, _ := http.NewRequestWithContext(ctx, http.MethodGet, server.URL, nil)
+	_, err := client.Do(req) //nolint:bodyclose
+	assert.ErrorIs(suite.T(), err, context.Canceled)
+
+	trial, ok := client.allow()
+	assert.True(suite.T(), trial)
+	assert.True(suite.T(), ok)
+}
+
+func (suite *TestSuite) TestRetryWithinDeadline() {
+	calls := 0
+	server := statusServer(&calls, http.StatusServiceUnavailable)
+	defer server.Close()
+
+	suite.Options.Backoff = time.Hour
+	suite.Options.MaxBackoff = time.Hour
+	client := NewClient("test", suite.Options)
+
+	// The retry would not finish before the deadline, so the response is returned as is
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	req, _ := http.NewRequestWithContext(ctx, http.MethodGet, server.URL, nil)
+	resp, err := client.Do(req)
+	assert.NoError(suite.T(), err)
+	defer resp.Body.Close()
+	assert.Equal(suite.T(), http.StatusServiceUnavailable, resp.StatusCode)
+	assert.Equal(suite.T(), 1, calls)
+}
+
+func (suite *TestSuite) TestTimeout() {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+		case <-time.After(time.Second):
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	suite.Options.Retries = 0
+	client := NewClient("test", suite.Options)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	req, _ := http.NewRequestWithContext(ctx, http.MethodGet, server.URL, nil)
+	_, err := client.Do(req) //nolint:bodyclose
+	assert.ErrorIs(suite.T(), err, ErrTimeout)
+	assert.ErrorIs(suite.T(), err, context.DeadlineExceeded)
+
+	// The timeout of a single attempt is also reported as a timeout
+	suite.Options.Timeout = 20 * time.Millisecond
+	client = NewClient("test", suite.Options)
+	req, _ = http.NewRequest(http.MethodGet, server.URL, nil)
+	_, err = client.Do(req) //nolint:bodyclose
+	assert.ErrorIs(suite.T(), err, ErrTimeout)
+}
+
+func (suite *TestSuite) TestCancelledRequest() {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-r.Context().Done()
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	suite.Options.BreakerThreshold = 1
+	client := NewClient("test", suite.Options)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(20*time.Millisecond, cancel)
+	req, _ := http.NewRequestWithContext(ctx, http.MethodGet, server.URL, nil)
+	_, err := client.Do(req) //nolint:bodyclose
+	assert.ErrorIs(suite.T(), err, context.Canceled)
+	assert.NotErrorIs(suite.T(), err, ErrTimeout)
+	assert.True(suite.T(), client.Available())
+}
+
+func (suite *TestSuite) TestBackoff() {
+	client := NewClient("test", suite.Options)
+	for attempt := 1; attempt < 10; attempt++ {
+		assert.Less(suite.T(), client.backoff(attempt), suite.Options.MaxBackoff)
+	}
+
+	client = NewClient("test", Options{})
+	assert.Equal(suite.T(), time.Duration(0), client.backoff(1))
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/NBISweden/sda-uppmax-integration/helpers"
+	"github.com/NBISweden/sda-uppmax-integration/token"
+)
+
+// verify decodes a token, given as is, as a client configuration file or on
+// stdin with -, and prints its claims after checking the signature against
+// the configured key. The returned exit code is non-zero if the token is not
+// valid or has expired.
+func verify(args []string, stdout, stderr io.Writer) int {
+	flags := flag.NewFlagSet("verify", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	flags.Usage = func() {
+		fmt.Fprintln(stderr, "usage: verify <token|client configuration file|->")
+	}
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if flags.NArg() != 1 {
+		flags.Usage()
+
+		return 2
+	}
+
+	content, err := readTokenArgument(flags.Arg(0))
+	if err != nil {
+		fmt.Fprintf(stderr, "error: %v\n", err)
+
+		return 1
+	}
+	tokenString, err := token.ExtractToken(content)
+	if err != nil {
+		fmt.Fprintf(stderr, "error: %v\n", err)
+
+		return 1
+	}
+
+	conf := &helpers.Conf{}
+	if err := helpers.NewConf(conf); err != nil {
+		fmt.Fprintf(stderr, "error: %v\n", err)
+
+		return 1
+	}
+	service, err := token.NewService(conf, nil, nil)
+	if err != nil {
+		fmt.Fprintf(stderr, "error: %v\n", err)
+
+		return 1
+	}
+
+	info, verifyErr := service.Verify(tokenString)
+	if info.Claims != nil {
+		claims, _ := json.MarshalIndent(info.Claims, "", "  ")
+		fmt.Fprintf(stdout, "claims: %s\n", claims)
+		fmt.Fprintf(stdout, "key id: %s\n", info.KeyID)
+		fmt.Fprintf(stdout, "issued at: %s\n", info.IssuedAt.Format(time.RFC3339))
+		remaining := time.Until(info.ExpiresAt).Round(time.Second)
+		if remaining > 0 {
+			fmt.Fprintf(stdout, "expires at: %s, in %v\n", info.ExpiresAt.Format(time.RFC3339), remaining)
+		} else {
+			fmt.Fprintf(stdout, "expires at: %s, expired %v ago\n", info.ExpiresAt.Format(time.RFC3339), -remaining)
+		}
+		if info.Override {
+			fmt.Fprintln(stdout, "override: issued without verifying the account and the project")
+		}
+		fmt.Fprintln(stdout, "revocation: not revocable, the token is valid until it expires")
+	}
+	if verifyErr != nil {
+		fmt.Fprintf(stderr, "error: %v\n", verifyErr)
+
+		return 1
+	}
+	if !info.ExpiresAt.After(time.Now()) {
+		fmt.Fprintln(stderr, "error: the token has expired")
+
+		return 1
+	}
+	fmt.Fprintln(stdout, "signature: valid")
+
+	return 0
+}
+
+// readTokenArgument returns the content of the file named arg, or stdin if
+// arg is -, or arg itself if there is no such file. An argument that looks
+// like a path is always read as a file, so that a mistyped path is reported
+// rather than verified as a token.
+func readTokenArgument(arg string) (string, error) {
+	if arg == "-" {
+		content, err := io.ReadAll(os.Stdin)
+
+		return string(content), err
+	}
+	if _, err := os.Stat(arg); err != nil {
+		if looksLikePath(arg) {
+			return "", err
+		}
+
+		return arg, nil
+	}
+	content, err := os.ReadFile(filepath.Clean(arg))
+
+	return string(content), err
+}
+
+// looksLikePath reports whether arg is a path rather than a token, which
+// never holds a path separator
+func looksLikePath(arg string) bool {
+	return strings.ContainsRune(arg, '/') || strings.ContainsRune(arg, filepath.Separator) ||
+		strings.HasSuffix(arg, ".s3cfg") || strings.HasSuffix(arg, ".conf")
+}